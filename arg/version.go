@@ -1,6 +1,7 @@
 package arg
 
 import (
+	"regexp"
 	"strings"
 )
 
@@ -37,3 +38,18 @@ func (v Version) parse() []string {
 	str := string(v)
 	return strings.Split(str, "@")
 }
+
+var minorShorthand = regexp.MustCompile(`^v?(\d+)\.(\d+)(\.x)?$`)
+
+// Minor returns the minor version of a shorthand version, i.e. "1.22" for 1.22 and 1.22.x.
+func (v Version) Minor() (string, bool) {
+	parts := v.parse()
+	if len(parts) != 2 {
+		return "", false
+	}
+	m := minorShorthand.FindStringSubmatch(parts[1])
+	if m == nil {
+		return "", false
+	}
+	return m[1] + "." + m[2], true
+}
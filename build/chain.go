@@ -0,0 +1,112 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dio/leo/arg"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/istio"
+	"github.com/dio/leo/istioproxy"
+)
+
+// Chain is the dependency chain of a target: the istio commit, the proxy commit from istio.deps,
+// the envoy commit from the proxy WORKSPACE, and the envoy version from VERSION.txt.
+type Chain struct {
+	Target string `json:"target" yaml:"target"`
+	// Istio is nil when the target is a proxy.
+	Istio *IstioCoordinates `json:"istio,omitempty" yaml:"istio,omitempty"`
+	Proxy SourceCoordinates `json:"proxy" yaml:"proxy"`
+	Envoy ChainEnvoy        `json:"envoy" yaml:"envoy"`
+}
+
+type ChainEnvoy struct {
+	Repo    string `json:"repo" yaml:"repo"`
+	SHA     string `json:"sha" yaml:"sha"`
+	SHA256  string `json:"sha256" yaml:"sha256"`
+	Version string `json:"version" yaml:"version"`
+}
+
+// ResolveChain resolves the dependency chain of istio@<ref>, <owner>/istio@<ref>,
+// istio/proxy@<ref> or tetrateio-proxy@<ref>. An istio minor shorthand, e.g. istio@1.22, resolves
+// to the newest patch release, or prerelease when prereleases is set.
+func ResolveChain(ctx context.Context, target string, prereleases bool) (*Chain, error) {
+	if err := validateRepoRef("target", target); err != nil {
+		return nil, err
+	}
+	v := arg.Version(target)
+	chain := &Chain{Target: target}
+
+	switch v.Repo().Name() {
+	case "istio":
+		istioRepo := "istio/istio"
+		if len(v.Repo().Owner()) != 0 {
+			istioRepo = v.Name()
+		}
+		ref, tag, err := resolveShorthand(ctx, istioRepo, v, prereleases)
+		if err != nil {
+			return nil, err
+		}
+		sha, err := github.ResolveCommitSHA(ctx, istioRepo, ref)
+		if err != nil {
+			return nil, err
+		}
+		chain.Istio = &IstioCoordinates{Ref: target, Tag: tag, SHA: sha}
+		deps, err := istio.GetDeps(ctx, istioRepo, sha)
+		if err != nil {
+			return nil, err
+		}
+		chain.Proxy = SourceCoordinates{Repo: "istio/proxy", SHA: deps.Get("proxy").SHA}
+
+	case "proxy", "tetrateio-proxy":
+		// Like the builder, tetrateio-proxy refs are istio/proxy refs.
+		proxyRepo := "istio/proxy"
+		if v.Repo().Name() == "proxy" && len(v.Repo().Owner()) != 0 {
+			proxyRepo = v.Name()
+		}
+		sha, err := github.ResolveCommitSHA(ctx, proxyRepo, v.Version())
+		if err != nil {
+			return nil, err
+		}
+		chain.Proxy = SourceCoordinates{Repo: proxyRepo, SHA: sha}
+
+	default:
+		return nil, fmt.Errorf("cannot resolve the chain of %q, supported targets: istio@<ref>, istio/proxy@<ref>, tetrateio-proxy@<ref>", target)
+	}
+
+	workspace, err := github.GetRaw(ctx, chain.Proxy.Repo, "WORKSPACE", chain.Proxy.SHA)
+	if err != nil {
+		return nil, err
+	}
+	e, err := istioproxy.EnvoyFromWorkspace(workspace)
+	if err != nil {
+		return nil, err
+	}
+	chain.Envoy = ChainEnvoy{Repo: e.Org + "/" + e.Repo, SHA: e.SHA, SHA256: e.SHA256}
+	version, err := github.GetRaw(ctx, chain.Envoy.Repo, "VERSION.txt", e.SHA)
+	if err != nil {
+		return nil, err
+	}
+	chain.Envoy.Version = strings.TrimSpace(version)
+	return chain, nil
+}
+
+// WriteText writes the chain in the same shape as "proxy info".
+func (c *Chain) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintln(&b, "resolved chain:")
+	if c.Istio != nil {
+		if len(c.Istio.Tag) > 0 {
+			fmt.Fprintf(&b, "  istioTag: %s\n", c.Istio.Tag)
+		}
+		fmt.Fprintf(&b, "  istio: %s\n", c.Istio.SHA)
+	}
+	fmt.Fprintf(&b, "  proxy: %s@%s\n", c.Proxy.Repo, c.Proxy.SHA)
+	fmt.Fprintf(&b, "  envoy: %s@%s\n", c.Envoy.Repo, c.Envoy.SHA)
+	fmt.Fprintf(&b, "  envoySHA256: %s\n", c.Envoy.SHA256)
+	fmt.Fprintf(&b, "  envoyVersion: %s\n", c.Envoy.Version)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,67 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/dio/leo/github/githubtest"
+)
+
+func TestResolveChain(t *testing.T) {
+	githubtest.Use(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/istio/istio/commits/1.22.3":
+			fmt.Fprint(w, `{"sha": "5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22"}`)
+		case "/repos/istio/proxy/commits/release-1.22":
+			fmt.Fprint(w, `{"sha": "757b63df346fc8bea3740cb44a75db9576e0d378"}`)
+		case "/repos/istio/istio/contents/istio.deps":
+			fmt.Fprint(w, `[{"repoName": "proxy", "lastStableSHA": "757b63df346fc8bea3740cb44a75db9576e0d378"}]`)
+		case "/repos/istio/proxy/contents/WORKSPACE":
+			fmt.Fprintln(w, `ENVOY_SHA = "88a80e6bbbee56de8c3899c75eaf36c46fad1aa7"`)
+			fmt.Fprintln(w, `ENVOY_SHA256 = "abc"`)
+			fmt.Fprintln(w, `ENVOY_ORG = "envoyproxy"`)
+			fmt.Fprintln(w, `ENVOY_REPO = "envoy"`)
+		case "/repos/envoyproxy/envoy/contents/VERSION.txt":
+			fmt.Fprintln(w, "1.30.4")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	chain, err := ResolveChain(context.Background(), "istio@1.22.3", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Chain{
+		Target: "istio@1.22.3",
+		Istio:  &IstioCoordinates{Ref: "istio@1.22.3", SHA: "5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22"},
+		Proxy:  SourceCoordinates{Repo: "istio/proxy", SHA: "757b63df346fc8bea3740cb44a75db9576e0d378"},
+		Envoy:  ChainEnvoy{Repo: "envoyproxy/envoy", SHA: "88a80e6bbbee56de8c3899c75eaf36c46fad1aa7", SHA256: "abc", Version: "1.30.4"},
+	}
+	if chain.Istio == nil || *chain.Istio != *want.Istio || chain.Proxy != want.Proxy || chain.Envoy != want.Envoy {
+		t.Fatalf("ResolveChain() = %+v", chain)
+	}
+
+	chain, err = ResolveChain(context.Background(), "istio/proxy@release-1.22", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain.Istio != nil || chain.Proxy != want.Proxy || chain.Envoy != want.Envoy {
+		t.Fatalf("ResolveChain() = %+v", chain)
+	}
+
+	var text bytes.Buffer
+	if err := chain.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(text.Bytes(), []byte("envoyVersion: 1.30.4")) {
+		t.Fatalf("WriteText() = %s", text.String())
+	}
+
+	if _, err := ResolveChain(context.Background(), "isito@1.22.3", false); err == nil {
+		t.Fatal("ResolveChain() should fail on unsupported targets")
+	}
+}
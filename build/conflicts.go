@@ -0,0 +1,80 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dio/leo/arg"
+)
+
+// Conflict is a contradictory combination of flags.
+type Conflict struct {
+	Flags  []string
+	Reason string
+	// Warning is set when the combination is accepted, but some of the flags have no effect.
+	Warning bool
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("conflicting flags %s: %s", strings.Join(c.Flags, " and "), c.Reason)
+}
+
+var outputTargets = []string{"istio-proxy", "istio-proxy-centos7", "envoy", "envoy-contrib", "envoy-centos7"}
+
+// Conflicts returns the contradictory flavor combinations of the spec. The output target is only
+// checked when Output is set.
+func (s *Spec) Conflicts() []Conflict {
+	var conflicts []Conflict
+	if s.CryptoUpdateStream && !s.FIPSBuild {
+		conflicts = append(conflicts, Conflict{
+			Flags:  []string{"--crypto-updatestream", "--fips-build=false"},
+			Reason: "crypto update stream is a FIPS build flavor, set --fips-build",
+		})
+	}
+
+	if isEnvoyTarget(s.Target) && len(s.OverrideEnvoy) > 0 {
+		conflicts = append(conflicts, Conflict{
+			Flags:  []string{"--override-envoy", s.Target},
+			Reason: "the envoy target already sets envoy",
+		})
+	}
+
+	if s.Output == nil || len(s.Output.Target) == 0 {
+		return conflicts
+	}
+	targetFlag := "--target=" + s.Output.Target
+	if isEnvoyTarget(s.Target) && strings.HasPrefix(s.Output.Target, "istio-proxy") {
+		conflicts = append(conflicts, Conflict{
+			Flags:  []string{targetFlag, s.Target},
+			Reason: "envoy targets only build envoy, envoy-contrib and envoy-centos7",
+		})
+	}
+	if s.Wasm && strings.HasSuffix(s.Output.Target, "-centos7") {
+		conflicts = append(conflicts, Conflict{
+			Flags:   []string{"--wasm", targetFlag},
+			Reason:  "centos7 targets do not build wasm extensions, --wasm is ignored",
+			Warning: true,
+		})
+	}
+	if s.Debug && s.Output.Target != "istio-proxy" {
+		conflicts = append(conflicts, Conflict{
+			Flags:  []string{"--debug", targetFlag},
+			Reason: "only istio-proxy has a debug tarball, the release would replace the non-debug one",
+		})
+	} else if s.Debug && arg.Version(s.Target).Repo().Name() == "tetrateio-proxy" {
+		conflicts = append(conflicts, Conflict{
+			Flags:  []string{"--debug", s.Target},
+			Reason: "tetrateio-proxy releases have no debug flavor, the release would replace the non-debug one",
+		})
+	}
+	return conflicts
+}
+
+func validOutputTarget(target string) bool {
+	for _, t := range outputTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
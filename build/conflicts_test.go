@@ -0,0 +1,73 @@
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpecConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     Spec
+		err      string
+		warnings int
+	}{
+		{name: "fips", spec: Spec{Target: "istio@1.22.3", FIPSBuild: true, CryptoUpdateStream: true}},
+		{
+			name: "crypto update stream without fips",
+			spec: Spec{Target: "istio@1.22.3", CryptoUpdateStream: true},
+			err:  "conflicting flags --crypto-updatestream and --fips-build=false",
+		},
+		{
+			name:     "wasm with centos7",
+			spec:     Spec{Target: "istio@1.22.3", Wasm: true, Output: &Output{Target: "istio-proxy-centos7"}},
+			warnings: 1,
+		},
+		{
+			name: "debug envoy",
+			spec: Spec{Target: "istio@1.22.3", Debug: true, Output: &Output{Target: "envoy"}},
+			err:  "conflicting flags --debug and --target=envoy",
+		},
+		{name: "debug istio-proxy", spec: Spec{Target: "istio@1.22.3", Debug: true, Output: &Output{Target: "istio-proxy"}}},
+		{
+			name: "debug tetrateio-proxy",
+			spec: Spec{Target: "tetrateio-proxy@757b63d", Debug: true, Output: &Output{Target: "istio-proxy"}},
+			err:  "conflicting flags --debug and tetrateio-proxy@757b63d",
+		},
+		{
+			name: "envoy istio-proxy",
+			spec: Spec{Target: "envoyproxy/envoy@v1.30.4", Output: &Output{Target: "istio-proxy"}},
+			err:  "conflicting flags --target=istio-proxy and envoyproxy/envoy@v1.30.4",
+		},
+		{
+			name: "envoy override",
+			spec: Spec{Target: "envoyproxy/envoy@v1.30.4", OverrideEnvoy: "tetratelabs/envoy@main"},
+			err:  "conflicting flags --override-envoy and envoyproxy/envoy@v1.30.4",
+		},
+		{
+			name: "unsupported output target",
+			spec: Spec{Target: "istio@1.22.3", Output: &Output{Target: "proxy"}},
+			err:  `unsupported output target "proxy"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.err)
+			}
+			warnings := 0
+			for _, c := range tt.spec.Conflicts() {
+				if c.Warning {
+					warnings++
+				}
+			}
+			if warnings != tt.warnings {
+				t.Fatalf("Conflicts() warnings = %d, want %d", warnings, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dio/leo/arg"
+)
+
+// ContextFileName is the name of the build context file written by Build into the proxy work
+// directory, next to the "out" directory.
+const ContextFileName = "leo-context.json"
+
+// BuildContext records the refs resolved by Build. Passing it to Output and Release makes sure the
+// published coordinates match the compiled sources, even when a branch moved in between.
+type BuildContext struct {
+	// Target is the requested target, e.g. istio@1.22.3.
+	Target    string            `json:"target"`
+	Istio     IstioCoordinates  `json:"istio"`
+	Proxy     SourceCoordinates `json:"proxy"`
+	Envoy     EnvoyCoordinates  `json:"envoy"`
+	Flavors   Flavors           `json:"flavors"`
+	Dir       string            `json:"dir"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// ReadContext reads a build context file.
+func ReadContext(name string) (*BuildContext, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c BuildContext
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid build context %s: %w", name, err)
+	}
+	return &c, nil
+}
+
+// Write writes the build context to a file.
+func (c *BuildContext) Write(name string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+// check makes sure the builder asks for the same target and flavors the context was built with.
+func (c *BuildContext) check(target arg.Version, flavors Flavors) error {
+	if string(target) != c.Target {
+		return fmt.Errorf("target %s does not match build context target %s", target, c.Target)
+	}
+
+	var mismatches []string
+	mismatch := func(flag string, got, want any) {
+		if got != want {
+			mismatches = append(mismatches, fmt.Sprintf("--%s=%v (built with %v)", flag, got, want))
+		}
+	}
+	mismatch("fips-build", flavors.FIPSBuild, c.Flavors.FIPSBuild)
+	mismatch("crypto-updatestream", flavors.CryptoUpdateStream, c.Flavors.CryptoUpdateStream)
+	mismatch("dynamic-modules-build", flavors.DynamicModulesBuild, c.Flavors.DynamicModulesBuild)
+	mismatch("wasm", flavors.Wasm, c.Flavors.Wasm)
+	mismatch("gperftools", flavors.Gperftools, c.Flavors.Gperftools)
+	mismatch("debug", flavors.Debug, c.Flavors.Debug)
+	mismatch("patch-source-name", flavors.PatchSourceName, c.Flavors.PatchSourceName)
+	mismatch("patch-suffix", flavors.PatchSuffix, c.Flavors.PatchSuffix)
+	if len(mismatches) > 0 {
+		return fmt.Errorf("flags do not match build context: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// fromContext fills in the resolved refs from the build context instead of resolving them again.
+func (b *IstioProxyBuilder) fromContext() (string, string, error) {
+	c := b.Context
+	if err := c.check(b.Istio, b.flavors(c.Envoy.Version)); err != nil {
+		return "", "", err
+	}
+	b.Version = c.Istio.SHA
+	b.Tag = c.Istio.Tag
+	b.IstioProxy = arg.Version(c.Proxy.Repo + "@" + c.Proxy.SHA)
+	b.Envoy = arg.Version(c.Envoy.Repo + "@" + c.Envoy.SHA)
+	return c.Proxy.SHA, c.Envoy.Version, nil
+}
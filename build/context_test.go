@@ -0,0 +1,63 @@
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dio/leo/arg"
+)
+
+func TestBuildContext(t *testing.T) {
+	written := &BuildContext{
+		Target:  "istio@master",
+		Istio:   IstioCoordinates{Ref: "istio@master", SHA: "5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22"},
+		Proxy:   SourceCoordinates{Repo: "istio/proxy", SHA: "757b63df346fc8bea3740cb44a75db9576e0d378"},
+		Envoy:   EnvoyCoordinates{Repo: "envoyproxy/envoy", SHA: "88a80e6bbbee56de8c3899c75eaf36c46fad1aa7", Version: "1.31.0-dev"},
+		Flavors: Flavors{FIPSBuild: true, PatchSourceName: "envoy"},
+	}
+	name := filepath.Join(t.TempDir(), ContextFileName)
+	if err := written.Write(name); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadContext(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := &IstioProxyBuilder{
+		Istio:     arg.Version("istio@master"),
+		Version:   "master",
+		FIPSBuild: true,
+		Context:   c,
+	}
+	proxyRef, envoyVersion, err := builder.info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyRef != c.Proxy.SHA || envoyVersion != "1.31.0-dev" {
+		t.Fatalf("info() = %s, %s", proxyRef, envoyVersion)
+	}
+	if builder.Version != c.Istio.SHA || builder.Envoy.Version() != c.Envoy.SHA || builder.IstioProxy.Name() != "istio/proxy" {
+		t.Fatalf("unexpected resolved refs: %s %s %s", builder.Version, builder.IstioProxy, builder.Envoy)
+	}
+
+	builder = &IstioProxyBuilder{
+		Istio:   arg.Version("istio@master"),
+		Version: "master",
+		Context: c,
+	}
+	if _, _, err := builder.info(context.Background()); err == nil || !strings.Contains(err.Error(), "--fips-build=false") {
+		t.Fatalf("info() error = %v, want flavor mismatch", err)
+	}
+
+	builder = &IstioProxyBuilder{
+		Istio:     arg.Version("istio@1.22.3"),
+		FIPSBuild: true,
+		Context:   c,
+	}
+	if _, _, err := builder.info(context.Background()); err == nil {
+		t.Fatal("info() should fail on target mismatch")
+	}
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"context"
+	"path"
+	"runtime"
+
+	"github.com/dio/leo/istioproxy"
+	"github.com/dio/leo/patch"
+)
+
+// Description is the machine-readable form of "proxy info" and "proxy output". Fields are only
+// added, never renamed, so downstream jobs can rely on them.
+type Description struct {
+	Istio   IstioCoordinates  `json:"istio" yaml:"istio"`
+	Proxy   SourceCoordinates `json:"proxy" yaml:"proxy"`
+	Envoy   EnvoyCoordinates  `json:"envoy" yaml:"envoy"`
+	Flavors Flavors           `json:"flavors" yaml:"flavors"`
+	Target  string            `json:"target" yaml:"target"`
+	Arch    string            `json:"arch" yaml:"arch"`
+	// Patches lists the patch files that are applied, in order.
+	Patches []PatchFile `json:"patches" yaml:"patches"`
+	// Tarballs lists the expected tarball names in the output directory.
+	Tarballs []string `json:"tarballs" yaml:"tarballs"`
+	// Output is the glob of the build output directory.
+	Output  string             `json:"output" yaml:"output"`
+	GCS     string             `json:"gcs" yaml:"gcs"`
+	Release ReleaseCoordinates `json:"release" yaml:"release"`
+}
+
+// IstioCoordinates are the requested and resolved Istio sources.
+type IstioCoordinates struct {
+	// Ref is the requested reference, e.g. istio@1.22.3.
+	Ref string `json:"ref" yaml:"ref"`
+	// Tag is the release tag a shorthand ref, e.g. istio@1.22, resolved to.
+	Tag string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	SHA string `json:"sha" yaml:"sha"`
+}
+
+// SourceCoordinates are the repository and commit of the proxy sources.
+type SourceCoordinates struct {
+	Repo string `json:"repo" yaml:"repo"`
+	SHA  string `json:"sha" yaml:"sha"`
+}
+
+// EnvoyCoordinates are the repository, commit and version of the envoy sources.
+type EnvoyCoordinates struct {
+	Repo    string `json:"repo" yaml:"repo"`
+	SHA     string `json:"sha" yaml:"sha"`
+	Version string `json:"version" yaml:"version"`
+}
+
+// Flavors are the build options that change the produced binaries.
+type Flavors struct {
+	FIPSBuild           bool   `json:"fipsBuild" yaml:"fipsBuild"`
+	CryptoUpdateStream  bool   `json:"cryptoUpdateStream" yaml:"cryptoUpdateStream"`
+	DynamicModulesBuild string `json:"dynamicModulesBuild" yaml:"dynamicModulesBuild"`
+	Wasm                bool   `json:"wasm" yaml:"wasm"`
+	Gperftools          bool   `json:"gperftools" yaml:"gperftools"`
+	Debug               bool   `json:"debug" yaml:"debug"`
+	PatchSourceName     string `json:"patchSourceName" yaml:"patchSourceName"`
+	PatchSuffix         string `json:"patchSuffix" yaml:"patchSuffix"`
+	RemoteCache         string `json:"remoteCache" yaml:"remoteCache"`
+}
+
+// PatchFile is a patch applied to the sources.
+type PatchFile struct {
+	// Dir is the source directory the patch is applied to, i.e. envoy or proxy.
+	Dir  string `json:"dir" yaml:"dir"`
+	Path string `json:"path" yaml:"path"`
+}
+
+// ReleaseCoordinates are the GitHub release the tarballs are uploaded to.
+type ReleaseCoordinates struct {
+	Repo  string `json:"repo" yaml:"repo"`
+	Tag   string `json:"tag" yaml:"tag"`
+	Title string `json:"title" yaml:"title"`
+}
+
+func (b *IstioProxyBuilder) Describe(ctx context.Context) (*Description, error) {
+	requested := b.Istio
+	istioProxyRef, envoyVersion, err := b.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.output == nil {
+		b.output = &Output{}
+	}
+	if len(b.output.Target) == 0 {
+		b.output.Target = "istio-proxy"
+	}
+	if len(b.output.Arch) == 0 {
+		b.output.Arch = runtime.GOARCH
+	}
+
+	tag, title, remoteProxyRef, err := b.releaseCoordinates(istioProxyRef)
+	if err != nil {
+		return nil, err
+	}
+
+	patches, err := b.describePatches(ctx, envoyVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Description{
+		Istio: IstioCoordinates{
+			Ref: string(requested),
+			Tag: b.Tag,
+			SHA: b.Version,
+		},
+		Proxy: SourceCoordinates{
+			Repo: b.IstioProxy.Name(),
+			SHA:  istioProxyRef,
+		},
+		Envoy: EnvoyCoordinates{
+			Repo:    b.Envoy.Name(),
+			SHA:     b.Envoy.Version(),
+			Version: envoyVersion,
+		},
+		Flavors: b.flavors(envoyVersion),
+		Target:  b.output.Target,
+		Arch:    b.output.Arch,
+		Patches: patches,
+		Tarballs: []string{
+			istioproxy.TarballName(b.output.Target, b.output.Arch, b.FIPSBuild, b.CryptoUpdateStream, b.Debug),
+		},
+		Output: path.Join(b.workDir(), "proxy-"+istioProxyRef, "out", "*"),
+		GCS:    "gs://" + b.remoteFile(remoteProxyRef),
+		Release: ReleaseCoordinates{
+			Repo:  b.output.Repo,
+			Tag:   tag,
+			Title: title,
+		},
+	}, nil
+}
+
+func (b *IstioProxyBuilder) flavors(envoyVersion string) Flavors {
+	return Flavors{
+		FIPSBuild:           b.FIPSBuild,
+		CryptoUpdateStream:  b.CryptoUpdateStream,
+		DynamicModulesBuild: b.DynamicModulesBuild,
+		Wasm:                b.Wasm,
+		Gperftools:          b.Gperftools,
+		Debug:               b.Debug,
+		PatchSourceName:     b.patchInfo(envoyVersion, "").Name,
+		PatchSuffix:         b.PatchSuffix,
+		RemoteCache:         b.remoteCache,
+	}
+}
+
+// describePatches follows the same lookup as Build, without applying anything.
+func (b *IstioProxyBuilder) describePatches(ctx context.Context, envoyVersion string) ([]PatchFile, error) {
+	var patches []PatchFile
+
+	if locator, ok := b.Patch.(patch.Locator); ok {
+		suffix := b.patchInfoSuffix()
+		name, err := locator.Locate(ctx, b.patchInfo(envoyVersion, suffix))
+		if err != nil && len(suffix) > 0 {
+			name, err = locator.Locate(ctx, b.patchInfo(envoyVersion, ""))
+		}
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, PatchFile{Dir: "envoy", Path: name})
+	}
+
+	if len(b.AdditionalPatchDir) > 0 {
+		for _, dir := range []string{"proxy", "envoy"} {
+			infos, err := b.AdditionalPatchGetter.List(ctx, b.AdditionalPatchDir, dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				patches = append(patches, PatchFile{Dir: dir, Path: info.Name})
+			}
+		}
+	}
+	return patches, nil
+}
+
+func (b *ProxyBuilder) Describe(ctx context.Context) (*Description, error) {
+	source, err := b.source()
+	if err != nil {
+		return nil, err
+	}
+	return source.Describe(ctx)
+}
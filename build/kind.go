@@ -0,0 +1,76 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SourceBuilder builds one kind of source, for example istio.
+type SourceBuilder interface {
+	Info(ctx context.Context) error
+	Output(ctx context.Context) error
+	Describe(ctx context.Context) (*Description, error)
+	// Build prepares the sources and returns the prepared directory.
+	Build(ctx context.Context) (string, error)
+	Release(ctx context.Context) error
+}
+
+// Kind returns the builder of a kind of source, for the spec of b.
+type Kind func(b *ProxyBuilder) SourceBuilder
+
+var (
+	kindsMu sync.RWMutex
+	kinds   = map[string]Kind{}
+)
+
+func init() {
+	RegisterKind("istio", istioKind)
+	RegisterKind("tetrateio-proxy", istioKind)
+	RegisterKind("envoy", envoyKind)
+}
+
+// RegisterKind makes a kind of source available by name, the repository name of a target. For
+// example, "istio" for istio@1.22.3 and tetrateio/istio@release-1.22. It replaces an existing
+// kind with the same name.
+func RegisterKind(name string, kind Kind) {
+	kindsMu.Lock()
+	defer kindsMu.Unlock()
+	kinds[name] = kind
+}
+
+// Kinds returns the names of the registered kinds, sorted.
+func Kinds() []string {
+	kindsMu.RLock()
+	defer kindsMu.RUnlock()
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupKind(name string) (Kind, error) {
+	kindsMu.RLock()
+	kind, ok := kinds[name]
+	kindsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported target kind %q, supported kinds: %s", name, strings.Join(Kinds(), ", "))
+	}
+	return kind, nil
+}
+
+func istioKind(b *ProxyBuilder) SourceBuilder {
+	return istioSource{b.istioProxyBuilder()}
+}
+
+type istioSource struct {
+	*IstioProxyBuilder
+}
+
+func (s istioSource) Build(ctx context.Context) (string, error) {
+	return s.build(ctx)
+}
@@ -0,0 +1,38 @@
+package build
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeSource struct {
+	SourceBuilder
+	dir string
+}
+
+func (s fakeSource) Build(ctx context.Context) (string, error) {
+	return s.dir, nil
+}
+
+func TestRegisterKind(t *testing.T) {
+	RegisterKind("fake", func(b *ProxyBuilder) SourceBuilder {
+		return fakeSource{dir: "work/" + b.Spec().Target}
+	})
+	t.Cleanup(func() {
+		kindsMu.Lock()
+		delete(kinds, "fake")
+		kindsMu.Unlock()
+	})
+
+	builder, err := New(Spec{Target: "example/fake@main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := builder.Prepare(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != "work/example/fake@main" {
+		t.Fatalf("Prepare() = %s", dir)
+	}
+}
@@ -0,0 +1,196 @@
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dio/leo/arg"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/patch"
+)
+
+// Lock records every resolved input of a build, so the exact same sources can be rebuilt later.
+type Lock struct {
+	Target         string            `json:"target"`
+	Istio          IstioCoordinates  `json:"istio"`
+	Proxy          SourceCoordinates `json:"proxy"`
+	Envoy          EnvoyCoordinates  `json:"envoy"`
+	DynamicModules SourceCoordinates `json:"dynamicModules"`
+	PatchSource    PatchSource       `json:"patchSource"`
+	Flavors        Flavors           `json:"flavors"`
+	// Patches lists the applied patches, in order, with the SHA-256 of their content.
+	Patches []LockedPatch `json:"patches"`
+}
+
+type PatchSource struct {
+	// Source is the patch source as passed to --patch-source, e.g. github://dio/leo.
+	Source string `json:"source"`
+	// SHA is the resolved commit of a GitHub patch source.
+	SHA string `json:"sha,omitempty"`
+	// AdditionalSource and AdditionalSHA are for --additional-patch-source.
+	AdditionalSource string `json:"additionalSource,omitempty"`
+	AdditionalSHA    string `json:"additionalSHA,omitempty"`
+}
+
+type LockedPatch struct {
+	// Dir is the source directory the patch is applied to, i.e. envoy or proxy.
+	Dir    string `json:"dir"`
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// LockOptions tells Build where to record the lock and whether to enforce it.
+type LockOptions struct {
+	File string
+	// Frozen refuses to build when anything resolves differently from the lock.
+	Frozen bool
+}
+
+// ReadLock reads a lock file.
+func ReadLock(name string) (*Lock, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var l Lock
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %w", name, err)
+	}
+	return &l, nil
+}
+
+// Write writes the lock to a file.
+func (l *Lock) Write(name string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
+
+// CheckRefs returns an error listing every resolved ref that differs from the locked one.
+func (l *Lock) CheckRefs(other *Lock) error {
+	var diffs []string
+	diff := func(name, locked, got string) {
+		if locked != got {
+			diffs = append(diffs, fmt.Sprintf("%s: locked %q, resolved %q", name, locked, got))
+		}
+	}
+	diff("target", l.Target, other.Target)
+	diff("istio", l.Istio.SHA, other.Istio.SHA)
+	diff("proxy", l.Proxy.Repo+"@"+l.Proxy.SHA, other.Proxy.Repo+"@"+other.Proxy.SHA)
+	diff("envoy", l.Envoy.Repo+"@"+l.Envoy.SHA, other.Envoy.Repo+"@"+other.Envoy.SHA)
+	diff("envoy version", l.Envoy.Version, other.Envoy.Version)
+	diff("dynamic modules", l.DynamicModules.Repo+"@"+l.DynamicModules.SHA, other.DynamicModules.Repo+"@"+other.DynamicModules.SHA)
+	diff("patch source", l.PatchSource.Source+"@"+l.PatchSource.SHA, other.PatchSource.Source+"@"+other.PatchSource.SHA)
+	diff("additional patch source", l.PatchSource.AdditionalSource+"@"+l.PatchSource.AdditionalSHA,
+		other.PatchSource.AdditionalSource+"@"+other.PatchSource.AdditionalSHA)
+	if err := (&BuildContext{Target: l.Target, Flavors: l.Flavors}).check(arg.Version(other.Target), other.Flavors); err != nil {
+		diffs = append(diffs, err.Error())
+	}
+	if len(diffs) > 0 {
+		return errors.New("build does not match lock: " + strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// CheckPatches returns an error when the applied patches differ from the locked ones.
+func (l *Lock) CheckPatches(patches []LockedPatch) error {
+	var diffs []string
+	for i := 0; i < max(len(l.Patches), len(patches)); i++ {
+		var locked, got LockedPatch
+		if i < len(l.Patches) {
+			locked = l.Patches[i]
+		}
+		if i < len(patches) {
+			got = patches[i]
+		}
+		if locked != got {
+			diffs = append(diffs, fmt.Sprintf("locked %s %s (%s), applied %s %s (%s)",
+				locked.Dir, locked.Name, locked.SHA256, got.Dir, got.Name, got.SHA256))
+		}
+	}
+	if len(diffs) > 0 {
+		return errors.New("patches do not match lock: " + strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+func lockedPatches(dir string, applied ...patch.Applied) []LockedPatch {
+	patches := make([]LockedPatch, 0, len(applied))
+	for _, a := range applied {
+		patches = append(patches, LockedPatch{Dir: dir, Name: a.Name, SHA256: a.SHA256})
+	}
+	return patches
+}
+
+// resolveLock resolves the inputs that are not resolved by info(), i.e. the dynamic modules and
+// the patch sources.
+func (b *IstioProxyBuilder) resolveLock(ctx context.Context, istioProxyRef, envoyVersion string) (*Lock, error) {
+	l := &Lock{
+		Target: string(b.Istio),
+		Istio: IstioCoordinates{
+			Ref: string(b.Istio),
+			Tag: b.Tag,
+			SHA: b.Version,
+		},
+		Proxy: SourceCoordinates{
+			Repo: b.IstioProxy.Name(),
+			SHA:  istioProxyRef,
+		},
+		Envoy: EnvoyCoordinates{
+			Repo:    b.Envoy.Name(),
+			SHA:     b.Envoy.Version(),
+			Version: envoyVersion,
+		},
+		Flavors: b.flavors(envoyVersion),
+	}
+
+	if len(b.DynamicModulesBuild) > 0 {
+		parsed, err := parseRepoRef(b.DynamicModulesBuild)
+		if err != nil {
+			return nil, err
+		}
+		sha, err := github.ResolveCommitSHA(ctx, parsed.Repo, parsed.Ref)
+		if err != nil {
+			return nil, err
+		}
+		l.DynamicModules = SourceCoordinates{Repo: parsed.Repo, SHA: sha}
+	}
+
+	var err error
+	l.PatchSource.Source, l.PatchSource.SHA, err = resolvePatchSource(ctx, b.Patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.AdditionalPatchDir) > 0 {
+		l.PatchSource.AdditionalSource, l.PatchSource.AdditionalSHA, err = resolvePatchSource(ctx, b.AdditionalPatchGetter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func resolvePatchSource(ctx context.Context, getter patch.Getter) (string, string, error) {
+	switch g := getter.(type) {
+	case *patch.GitHubGetter:
+		ref := g.Ref
+		if ref == "" {
+			ref = "main"
+		}
+		sha, err := github.ResolveCommitSHA(ctx, g.Repo, ref)
+		if err != nil {
+			return "", "", err
+		}
+		return "github://" + g.Repo + "@" + ref, sha, nil
+	case *patch.FSGetter:
+		// Local patches are pinned by their content hashes.
+		return "file://" + g.Dir, "", nil
+	}
+	return "", "", nil
+}
@@ -0,0 +1,51 @@
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	locked := &Lock{
+		Target:      "istio@1.22.3",
+		Istio:       IstioCoordinates{Ref: "istio@1.22.3", SHA: "5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22"},
+		Proxy:       SourceCoordinates{Repo: "istio/proxy", SHA: "757b63df346fc8bea3740cb44a75db9576e0d378"},
+		Envoy:       EnvoyCoordinates{Repo: "envoyproxy/envoy", SHA: "88a80e6bbbee56de8c3899c75eaf36c46fad1aa7", Version: "1.30.4"},
+		PatchSource: PatchSource{Source: "github://dio/leo@main", SHA: "f34db71d0c6e56a3a9a5b8a6b0b1c2d3e4f5a6b7"},
+		Flavors:     Flavors{FIPSBuild: true, PatchSourceName: "envoy"},
+		Patches: []LockedPatch{
+			{Dir: "envoy", Name: "patches/envoy/1.30-fips.patch", SHA256: "abc"},
+		},
+	}
+	name := filepath.Join(t.TempDir(), "leo.lock")
+	if err := locked.Write(name); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLock(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := *read
+	if err := locked.CheckRefs(&resolved); err != nil {
+		t.Fatal(err)
+	}
+	if err := locked.CheckPatches(resolved.Patches); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved.Envoy.SHA = "2e4228b0ee73ae640c92e0974c91e251997a3d2f"
+	resolved.PatchSource.SHA = "0000000000000000000000000000000000000000"
+	err = locked.CheckRefs(&resolved)
+	if err == nil || !strings.Contains(err.Error(), "envoy:") || !strings.Contains(err.Error(), "patch source:") {
+		t.Fatalf("CheckRefs() error = %v", err)
+	}
+
+	if err := locked.CheckPatches([]LockedPatch{{Dir: "envoy", Name: "patches/envoy/1.30-fips.patch", SHA256: "def"}}); err == nil {
+		t.Fatal("CheckPatches() should fail on content change")
+	}
+	if err := locked.CheckPatches(nil); err == nil {
+		t.Fatal("CheckPatches() should fail on missing patch")
+	}
+}
@@ -0,0 +1,379 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Matrix is the content of a leo.yaml file. Every source is built for every combination of the
+// axes, on top of the defaults. For example:
+//
+//	sources:
+//	  - istio@1.22.3
+//	defaults:
+//	  remoteCache: us-central1
+//	matrix:
+//	  fipsBuild: [false, true]
+//	  target: [istio-proxy, envoy]
+//	exclude:
+//	  - fipsBuild: true
+//	    target: envoy
+//	include:
+//	  - name: crypto-updatestream
+//	    fipsBuild: true
+//	    cryptoUpdateStream: true
+type Matrix struct {
+	Sources  []string      `yaml:"sources"`
+	Defaults MatrixEntry   `yaml:"defaults"`
+	Axes     MatrixAxes    `yaml:"matrix"`
+	Include  []MatrixEntry `yaml:"include"`
+	Exclude  []MatrixEntry `yaml:"exclude"`
+}
+
+// MatrixAxes lists the values to combine. An empty axis keeps the default.
+type MatrixAxes struct {
+	FIPSBuild           []bool   `yaml:"fipsBuild"`
+	CryptoUpdateStream  []bool   `yaml:"cryptoUpdateStream"`
+	DynamicModulesBuild []string `yaml:"dynamicModulesBuild"`
+	PatchSourceName     []string `yaml:"patchSourceName"`
+	Debug               []bool   `yaml:"debug"`
+	Target              []string `yaml:"target"`
+}
+
+// MatrixEntry mirrors the "proxy" command flags. Unset fields take the defaults.
+type MatrixEntry struct {
+	Name                     string `yaml:"name,omitempty"`
+	Source                   string `yaml:"source,omitempty"`
+	OverrideIstioProxy       string `yaml:"overrideIstioProxy,omitempty"`
+	OverrideEnvoy            string `yaml:"overrideEnvoy,omitempty"`
+	PatchSource              string `yaml:"patchSource,omitempty"`
+	PatchSourceName          string `yaml:"patchSourceName,omitempty"`
+	PatchSuffix              string `yaml:"patchSuffix,omitempty"`
+	AdditionalPatchDir       string `yaml:"additionalPatchDir,omitempty"`
+	AdditionalPatchDirSource string `yaml:"additionalPatchSource,omitempty"`
+	DynamicModulesBuild      string `yaml:"dynamicModulesBuild,omitempty"`
+	RemoteCache              string `yaml:"remoteCache,omitempty"`
+	FIPSBuild                *bool  `yaml:"fipsBuild,omitempty"`
+	CryptoUpdateStream       *bool  `yaml:"cryptoUpdateStream,omitempty"`
+	Wasm                     *bool  `yaml:"wasm,omitempty"`
+	Gperftools               *bool  `yaml:"gperftools,omitempty"`
+	Debug                    *bool  `yaml:"debug,omitempty"`
+	Prereleases              *bool  `yaml:"prereleases,omitempty"`
+	Target                   string `yaml:"target,omitempty"`
+	Arch                     string `yaml:"arch,omitempty"`
+	Repo                     string `yaml:"repo,omitempty"`
+	Dir                      string `yaml:"dir,omitempty"`
+}
+
+// ReadMatrix reads a matrix file.
+func ReadMatrix(name string) (*Matrix, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m Matrix
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid matrix file %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// Expand returns the entries of the matrix, each with a unique name.
+func (m *Matrix) Expand() ([]MatrixEntry, error) {
+	sources := m.Sources
+	if len(sources) == 0 && len(m.Defaults.Source) > 0 {
+		sources = []string{m.Defaults.Source}
+	}
+
+	var entries []MatrixEntry
+	for _, source := range sources {
+		base := mergeEntry(m.Defaults, MatrixEntry{Source: source})
+		for _, combination := range m.Axes.combinations() {
+			entry := mergeEntry(base, combination)
+			if m.excluded(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, include := range m.Include {
+		if len(include.Source) > 0 {
+			entries = append(entries, mergeEntry(m.Defaults, include))
+			continue
+		}
+		for _, source := range sources {
+			entries = append(entries, mergeEntry(mergeEntry(m.Defaults, MatrixEntry{Source: source}), include))
+		}
+	}
+
+	names := make(map[string]bool, len(entries))
+	for i := range entries {
+		if len(entries[i].Source) == 0 {
+			return nil, errors.New("matrix entry without source")
+		}
+		if len(entries[i].Name) == 0 {
+			entries[i].Name = entries[i].defaultName()
+		}
+		if names[entries[i].Name] {
+			return nil, fmt.Errorf("duplicate matrix entry %s", entries[i].Name)
+		}
+		names[entries[i].Name] = true
+		spec := entries[i].Spec()
+		if err := spec.Validate(); err != nil {
+			return nil, fmt.Errorf("matrix entry %s: %w", entries[i].Name, err)
+		}
+	}
+	return entries, nil
+}
+
+func (a MatrixAxes) combinations() []MatrixEntry {
+	combinations := []MatrixEntry{{}}
+	expand := func(n int, set func(*MatrixEntry, int)) {
+		if n == 0 {
+			return
+		}
+		next := make([]MatrixEntry, 0, len(combinations)*n)
+		for _, c := range combinations {
+			for i := 0; i < n; i++ {
+				e := c
+				set(&e, i)
+				next = append(next, e)
+			}
+		}
+		combinations = next
+	}
+	expand(len(a.FIPSBuild), func(e *MatrixEntry, i int) { e.FIPSBuild = &a.FIPSBuild[i] })
+	expand(len(a.CryptoUpdateStream), func(e *MatrixEntry, i int) { e.CryptoUpdateStream = &a.CryptoUpdateStream[i] })
+	expand(len(a.DynamicModulesBuild), func(e *MatrixEntry, i int) { e.DynamicModulesBuild = a.DynamicModulesBuild[i] })
+	expand(len(a.PatchSourceName), func(e *MatrixEntry, i int) { e.PatchSourceName = a.PatchSourceName[i] })
+	expand(len(a.Debug), func(e *MatrixEntry, i int) { e.Debug = &a.Debug[i] })
+	expand(len(a.Target), func(e *MatrixEntry, i int) { e.Target = a.Target[i] })
+	return combinations
+}
+
+func (m *Matrix) excluded(entry MatrixEntry) bool {
+	for _, exclude := range m.Exclude {
+		if matchEntry(entry, exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeEntry returns base with the fields set in over.
+func mergeEntry(base, over MatrixEntry) MatrixEntry {
+	merged := base
+	dst := reflect.ValueOf(&merged).Elem()
+	src := reflect.ValueOf(over)
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return merged
+}
+
+// matchEntry tells whether every field set in pattern has the same value in entry.
+func matchEntry(entry, pattern MatrixEntry) bool {
+	e := reflect.ValueOf(entry)
+	p := reflect.ValueOf(pattern)
+	for i := 0; i < p.NumField(); i++ {
+		if p.Field(i).IsZero() {
+			continue
+		}
+		// The pointers are bools, an unset one in the entry means false.
+		if p.Field(i).Kind() == reflect.Pointer {
+			if p.Field(i).Elem().Bool() != (!e.Field(i).IsNil() && e.Field(i).Elem().Bool()) {
+				return false
+			}
+			continue
+		}
+		if p.Field(i).Interface() != e.Field(i).Interface() {
+			return false
+		}
+	}
+	return true
+}
+
+func isSet(b *bool) bool {
+	return b != nil && *b
+}
+
+func (e MatrixEntry) defaultName() string {
+	parts := []string{strings.NewReplacer("/", "-", "@", "-").Replace(e.Source)}
+	if len(e.PatchSourceName) > 0 && e.PatchSourceName != "envoy" {
+		parts = append(parts, e.PatchSourceName)
+	}
+	if len(e.DynamicModulesBuild) > 0 {
+		parts = append(parts, "dynamic-modules")
+	}
+	if isSet(e.FIPSBuild) && isSet(e.CryptoUpdateStream) {
+		parts = append(parts, "crypto-updatestream")
+	} else if isSet(e.FIPSBuild) {
+		parts = append(parts, "fips")
+	}
+	if isSet(e.Debug) {
+		parts = append(parts, "debug")
+	}
+	if len(e.Target) > 0 {
+		parts = append(parts, e.Target)
+	}
+	return strings.Join(parts, "-")
+}
+
+func (e MatrixEntry) output() *Output {
+	output := &Output{
+		Target: e.Target,
+		Arch:   e.Arch,
+		Repo:   e.Repo,
+		Dir:    e.Dir,
+		Debug:  isSet(e.Debug),
+	}
+	if len(output.Arch) == 0 {
+		output.Arch = runtime.GOARCH
+	}
+	if len(output.Repo) == 0 {
+		output.Repo = "tetrateio/proxy-archives"
+	}
+	return output
+}
+
+// Spec returns the spec of this entry, with the same defaults as the "proxy" command flags.
+func (e MatrixEntry) Spec() Spec {
+	wasm := runtime.GOARCH == "amd64"
+	if e.Wasm != nil {
+		wasm = *e.Wasm
+	}
+	return Spec{
+		Target:                e.Source,
+		OverrideIstioProxy:    e.OverrideIstioProxy,
+		OverrideEnvoy:         e.OverrideEnvoy,
+		PatchSource:           e.PatchSource,
+		PatchSourceName:       e.PatchSourceName,
+		PatchSuffix:           e.PatchSuffix,
+		AdditionalPatchDir:    e.AdditionalPatchDir,
+		AdditionalPatchSource: e.AdditionalPatchDirSource,
+		DynamicModulesBuild:   e.DynamicModulesBuild,
+		RemoteCache:           e.RemoteCache,
+		FIPSBuild:             isSet(e.FIPSBuild),
+		CryptoUpdateStream:    isSet(e.CryptoUpdateStream),
+		Wasm:                  wasm,
+		Gperftools:            isSet(e.Gperftools),
+		Debug:                 isSet(e.Debug),
+		Prereleases:           isSet(e.Prereleases),
+		Output:                e.output(),
+	}
+}
+
+// MatrixResult is the outcome of one matrix entry.
+type MatrixResult struct {
+	Name     string
+	Dir      string
+	Duration time.Duration
+	Err      error
+}
+
+// MatrixRunner builds or releases matrix entries. Entries share resolved refs and, through the
+// GitHub cache, downloaded tarballs. Every entry gets its own work directory.
+type MatrixRunner struct {
+	// WorkDir is the parent of the entries work directories, defaults to "work".
+	WorkDir string
+	// Wrap, when set, runs the build or the release of every entry, e.g. to record it.
+	Wrap func(entry MatrixEntry, builder *ProxyBuilder, run func() error) error
+
+	refs *sharedRefs
+}
+
+func (r *MatrixRunner) entryWorkDir(entry MatrixEntry) string {
+	workDir := r.WorkDir
+	if len(workDir) == 0 {
+		workDir = "work"
+	}
+	return filepath.Join(workDir, entry.Name)
+}
+
+func (r *MatrixRunner) builder(entry MatrixEntry) (*ProxyBuilder, error) {
+	if r.refs == nil {
+		r.refs = newSharedRefs()
+	}
+	builder, err := New(entry.Spec())
+	if err != nil {
+		return nil, err
+	}
+	builder.UseWorkDir(r.entryWorkDir(entry))
+	builder.refs = r.refs
+	return builder, nil
+}
+
+// Build prepares the sources of every entry. It carries on after a failure, check the results.
+func (r *MatrixRunner) Build(ctx context.Context, entries []MatrixEntry) []MatrixResult {
+	return r.run(ctx, entries, func(entry MatrixEntry, builder *ProxyBuilder) (string, error) {
+		return builder.Prepare(ctx)
+	})
+}
+
+// Release releases every entry, using the build context written by Build for that entry.
+func (r *MatrixRunner) Release(ctx context.Context, entries []MatrixEntry) []MatrixResult {
+	return r.run(ctx, entries, func(entry MatrixEntry, builder *ProxyBuilder) (string, error) {
+		contextFiles, err := filepath.Glob(filepath.Join(r.entryWorkDir(entry), "proxy-*", ContextFileName))
+		if err != nil {
+			return "", err
+		}
+		if len(contextFiles) != 1 {
+			return "", fmt.Errorf("expecting one build context in %s, found %d", r.entryWorkDir(entry), len(contextFiles))
+		}
+		c, err := ReadContext(contextFiles[0])
+		if err != nil {
+			return "", err
+		}
+		builder.UseContext(c)
+		output := builder.spec.Output
+		if len(output.Dir) == 0 {
+			output.Dir = filepath.Join(c.Dir, "out")
+		}
+		return output.Dir, builder.Release(ctx)
+	})
+}
+
+func (r *MatrixRunner) run(ctx context.Context, entries []MatrixEntry,
+	f func(MatrixEntry, *ProxyBuilder) (string, error)) []MatrixResult {
+	results := make([]MatrixResult, 0, len(entries))
+	for _, entry := range entries {
+		start := time.Now()
+		result := MatrixResult{Name: entry.Name}
+		if err := ctx.Err(); err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, "matrix entry:", entry.Name)
+		builder, err := r.builder(entry)
+		if err == nil {
+			run := func() (err error) {
+				result.Dir, err = f(entry, builder)
+				return err
+			}
+			if r.Wrap != nil {
+				err = r.Wrap(entry, builder, run)
+			} else {
+				err = run()
+			}
+		}
+		result.Err = err
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,80 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatrixExpand(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "leo.yaml")
+	if err := os.WriteFile(name, []byte(`
+sources:
+  - istio@1.22.3
+defaults:
+  remoteCache: us-central1
+matrix:
+  fipsBuild: [false, true]
+  target: [istio-proxy, envoy]
+exclude:
+  - fipsBuild: true
+    target: envoy
+include:
+  - fipsBuild: true
+    cryptoUpdateStream: true
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMatrix(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := m.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.RemoteCache != "us-central1" || e.Source != "istio@1.22.3" {
+			t.Fatalf("defaults not applied to %+v", e)
+		}
+		names = append(names, e.Name)
+	}
+	want := []string{
+		"istio-1.22.3-istio-proxy",
+		"istio-1.22.3-envoy",
+		"istio-1.22.3-fips-istio-proxy",
+		"istio-1.22.3-crypto-updatestream",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("Expand() names = %v, want %v", names, want)
+	}
+
+	// A bool left unset by the axes and the defaults is excluded as false.
+	fips, debug := false, true
+	unset := &Matrix{
+		Sources: []string{"istio@1.22.3"},
+		Axes:    MatrixAxes{Target: []string{"istio-proxy", "envoy"}},
+		Exclude: []MatrixEntry{{FIPSBuild: &fips, Target: "envoy"}, {Debug: &debug}},
+	}
+	entries, err = unset.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "istio-1.22.3-istio-proxy" {
+		t.Fatalf("Expand() = %+v, want only istio-proxy", entries)
+	}
+
+	m.Include = append(m.Include, MatrixEntry{Name: "istio-1.22.3-envoy"})
+	if _, err := m.Expand(); err == nil {
+		t.Fatal("Expand() should fail on duplicate names")
+	}
+
+	if err := os.WriteFile(name, []byte("sources: [istio@1.22.3]\nfips: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMatrix(name); err == nil {
+		t.Fatal("ReadMatrix() should reject unknown fields")
+	}
+}
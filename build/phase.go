@@ -0,0 +1,22 @@
+package build
+
+// Phase is a step of a build.
+type Phase string
+
+const (
+	// PhaseResolve resolves the Istio, proxy and envoy refs.
+	PhaseResolve Phase = "resolve"
+	// PhaseFetch downloads the proxy and envoy sources.
+	PhaseFetch Phase = "fetch"
+	// PhasePatch applies the patches.
+	PhasePatch Phase = "patch"
+	// PhaseGenerate writes the workspace status, the make targets and the build context.
+	PhaseGenerate Phase = "generate"
+	// PhaseCompile runs the make target, outside of the builder.
+	PhaseCompile Phase = "compile"
+	// PhaseRelease uploads the artifacts.
+	PhaseRelease Phase = "release"
+)
+
+// Phases lists the phases in order.
+var Phases = []Phase{PhaseResolve, PhaseFetch, PhasePatch, PhaseGenerate, PhaseCompile, PhaseRelease}
@@ -2,6 +2,8 @@ package build
 
 import (
 	"context"
+	"fmt"
+	"os"
 
 	"github.com/dio/leo/arg"
 	"github.com/dio/leo/patch"
@@ -15,6 +17,7 @@ type Output struct {
 	Debug  bool
 }
 
+// NewProxyBuilder returns a builder from the "proxy" command flags. Prefer New.
 func NewProxyBuilder(target,
 	overrideIstioProxy, overrideEnvoy,
 	patchSource, patchSourceName,
@@ -22,205 +25,196 @@ func NewProxyBuilder(target,
 	additionalPatchDir, additionalPatchDirSource string,
 	fipsBuild, cryptoUpdateStream, wasm, gperftools, debug bool,
 	output *Output) (*ProxyBuilder, error) {
-	var patchGetter patch.Getter
-	var additionalPatchGetter patch.Getter
-
-	patchGetterSource := patch.Source(patchSource)
-	patchPath := patchGetterSource.Path()
+	return New(Spec{
+		Target:                target,
+		OverrideIstioProxy:    overrideIstioProxy,
+		OverrideEnvoy:         overrideEnvoy,
+		PatchSource:           patchSource,
+		PatchSourceName:       patchSourceName,
+		PatchSuffix:           patchSuffix,
+		AdditionalPatchDir:    additionalPatchDir,
+		AdditionalPatchSource: additionalPatchDirSource,
+		DynamicModulesBuild:   dynamicModulesBuild,
+		RemoteCache:           remoteCache,
+		FIPSBuild:             fipsBuild,
+		CryptoUpdateStream:    cryptoUpdateStream,
+		Wasm:                  wasm,
+		Gperftools:            gperftools,
+		Debug:                 debug,
+		Output:                output,
+	})
+}
 
-	if patchGetterSource.IsLocal() {
-		patchGetter = &patch.FSGetter{
-			Dir: patchPath, // TODO(dio): Allow to override this.
-		}
-	} else {
-		patchGetter = &patch.GitHubGetter{
-			Repo: patchPath, // TODO(dio): Allow to override this.
-			Ref:  patchGetterSource.Ref(),
-		}
+// New returns a builder for a validated spec.
+func New(spec Spec) (*ProxyBuilder, error) {
+	spec = spec.withDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
 	}
-
-	if additionalPatchDirSource == "" {
-		additionalPatchDirSource = patchSource
-		additionalPatchGetter = patchGetter
+	for _, c := range spec.Conflicts() {
+		if c.Warning {
+			fmt.Fprintln(os.Stderr, "warning:", c)
+		}
 	}
 
-	if additionalPatchDirSource != patchSource {
-		additionalPatchGetterSource := patch.Source(additionalPatchDirSource)
-		additionalPatchPath := additionalPatchGetterSource.Path()
-
-		if additionalPatchGetterSource.IsLocal() {
-			additionalPatchGetter = &patch.FSGetter{
-				Dir: additionalPatchPath, // TODO(dio): Allow to override this.
-			}
-		} else {
-			additionalPatchGetter = &patch.GitHubGetter{
-				Repo: additionalPatchPath, // TODO(dio): Allow to override this.
-				Ref:  additionalPatchGetterSource.Ref(),
-			}
-		}
+	patchGetter := newPatchGetter(spec.PatchSource)
+	additionalPatchGetter := patchGetter
+	if len(spec.AdditionalPatchSource) > 0 && spec.AdditionalPatchSource != spec.PatchSource {
+		additionalPatchGetter = newPatchGetter(spec.AdditionalPatchSource)
 	}
 
 	return &ProxyBuilder{
-		target:                arg.Version(target),
-		envoy:                 arg.Version(overrideEnvoy),
-		istioProxy:            arg.Version(overrideIstioProxy),
+		spec:                  spec,
 		patchGetter:           patchGetter,
-		fipsBuild:             fipsBuild,
-		cryptoUpdateStream:    cryptoUpdateStream,
-		dynamicModulesBuild:   dynamicModulesBuild,
-		gperftools:            gperftools,
-		wasm:                  wasm,
-		debug:                 debug,
-		output:                output,
-		remoteCache:           remoteCache,
-		patchInfoName:         patchSourceName,
-		patchSuffix:           patchSuffix,
-		additionalPatchDir:    additionalPatchDir,
 		additionalPatchGetter: additionalPatchGetter,
 	}, nil
 }
 
+func newPatchGetter(source string) patch.Getter {
+	patchGetterSource := patch.Source(source)
+	if patchGetterSource.IsLocal() {
+		return &patch.FSGetter{
+			Dir: patchGetterSource.Path(),
+		}
+	}
+	return &patch.GitHubGetter{
+		Repo: patchGetterSource.Path(),
+		Ref:  patchGetterSource.Ref(),
+	}
+}
+
 type ProxyBuilder struct {
-	target              arg.Version
-	envoy               arg.Version
-	istioProxy          arg.Version
-	patchGetter         patch.Getter
-	fipsBuild           bool
-	cryptoUpdateStream  bool
-	debug               bool
-	wasm                bool
-	gperftools          bool
-	remoteCache         string
-	patchInfoName       string
-	dynamicModulesBuild string
-	patchSuffix         string
+	spec        Spec
+	patchGetter patch.Getter
 
 	// Additional patches support.
 	// The patches are placed in the additionalPatchDir directory and applied after the main patch.
 	// The proxy patch filenames are prefixed with the 'proxy-' and the envoy patch filenames
 	// are prefixed with 'envoy-'.
-	additionalPatchDir    string
 	additionalPatchGetter patch.Getter
 
-	// these are for output
-	output *Output
+	// context holds refs resolved by a previous build.
+	context *BuildContext
+	lock    *LockOptions
+	workDir string
+	onPhase func(Phase)
+	refs    *sharedRefs
 }
 
-func (b *ProxyBuilder) Info(ctx context.Context) error {
-	switch b.target.Repo().Name() {
-	case "tetrateio-proxy":
-		fallthrough
-	case "istio":
-		builder := &IstioProxyBuilder{
-			Istio:                 b.target,
-			Version:               b.target.Version(),
-			Envoy:                 b.envoy,
-			IstioProxy:            b.istioProxy,
-			Patch:                 b.patchGetter,
-			FIPSBuild:             b.fipsBuild,
-			CryptoUpdateStream:    b.cryptoUpdateStream,
-			DynamicModulesBuild:   b.dynamicModulesBuild,
-			Gperftools:            b.gperftools,
-			Wasm:                  b.wasm,
-			Debug:                 b.debug,
-			remoteCache:           b.remoteCache,
-			PatchInfoName:         b.patchInfoName,
-			PatchSuffix:           b.patchSuffix,
-			AdditionalPatchDir:    b.additionalPatchDir,
-			AdditionalPatchGetter: b.additionalPatchGetter,
-		}
-		return builder.Info(ctx)
+// UseContext makes Info, Output and Release use the refs resolved by a previous Build instead of
+// resolving them again.
+func (b *ProxyBuilder) UseContext(c *BuildContext) {
+	b.context = c
+}
+
+// UseLock makes Build record the resolved inputs into a lock file, or, when frozen, refuse to build
+// when anything resolves differently from the lock file.
+func (b *ProxyBuilder) UseLock(opts *LockOptions) {
+	b.lock = opts
+}
+
+// UseWorkDir sets where the sources are extracted to, defaults to "work".
+func (b *ProxyBuilder) UseWorkDir(dir string) {
+	b.workDir = dir
+}
+
+// UsePhases makes Prepare and Release call f when a phase starts. A phase may be reported more
+// than once in a row.
+func (b *ProxyBuilder) UsePhases(f func(Phase)) {
+	b.onPhase = f
+}
+
+func (b *ProxyBuilder) phase(p Phase) {
+	if b.onPhase != nil {
+		b.onPhase(p)
 	}
+}
 
-	return nil
+// Spec returns the spec of this builder, with the defaults applied.
+func (b *ProxyBuilder) Spec() Spec {
+	return b.spec
 }
 
-func (b *ProxyBuilder) Output(ctx context.Context) error {
-	switch b.target.Repo().Name() {
-	case "tetrateio-proxy":
-		fallthrough
-	case "istio":
-		builder := &IstioProxyBuilder{
-			Istio:                 b.target,
-			Version:               b.target.Version(),
-			Envoy:                 b.envoy,
-			IstioProxy:            b.istioProxy,
-			Patch:                 b.patchGetter,
-			FIPSBuild:             b.fipsBuild,
-			CryptoUpdateStream:    b.cryptoUpdateStream,
-			DynamicModulesBuild:   b.dynamicModulesBuild,
-			Wasm:                  b.wasm,
-			Debug:                 b.debug,
-			Gperftools:            b.gperftools,
-			output:                b.output,
-			remoteCache:           b.remoteCache,
-			PatchInfoName:         b.patchInfoName,
-			PatchSuffix:           b.patchSuffix,
-			AdditionalPatchDir:    b.additionalPatchDir,
-			AdditionalPatchGetter: b.additionalPatchGetter,
-		}
-		return builder.Output(ctx)
+func (b *ProxyBuilder) Info(ctx context.Context) error {
+	source, err := b.source()
+	if err != nil {
+		return err
 	}
+	return source.Info(ctx)
+}
 
-	return nil
+func (b *ProxyBuilder) Output(ctx context.Context) error {
+	source, err := b.source()
+	if err != nil {
+		return err
+	}
+	return source.Output(ctx)
 }
 
 func (b *ProxyBuilder) Release(ctx context.Context) error {
-	switch b.target.Repo().Name() {
-	case "tetrateio-proxy":
-		fallthrough
-	case "istio":
-		builder := &IstioProxyBuilder{
-			Istio:                 b.target,
-			Version:               b.target.Version(),
-			Envoy:                 b.envoy,
-			IstioProxy:            b.istioProxy,
-			Patch:                 b.patchGetter,
-			FIPSBuild:             b.fipsBuild,
-			CryptoUpdateStream:    b.cryptoUpdateStream,
-			DynamicModulesBuild:   b.dynamicModulesBuild,
-			Gperftools:            b.gperftools,
-			Wasm:                  b.wasm,
-			Debug:                 b.debug,
-			output:                b.output,
-			remoteCache:           b.remoteCache,
-			PatchInfoName:         b.patchInfoName,
-			PatchSuffix:           b.patchSuffix,
-			AdditionalPatchDir:    b.additionalPatchDir,
-			AdditionalPatchGetter: b.additionalPatchGetter,
-		}
-
-		return builder.Release(ctx)
+	source, err := b.source()
+	if err != nil {
+		return err
 	}
+	return source.Release(ctx)
+}
 
+func (b *ProxyBuilder) Build(ctx context.Context) error {
+	dir, err := b.Prepare(ctx)
+	if err != nil {
+		return err
+	}
+	if len(dir) > 0 {
+		fmt.Print(dir)
+	}
 	return nil
 }
 
-func (b *ProxyBuilder) Build(ctx context.Context) error {
-	switch b.target.Repo().Name() {
-	case "tetrateio-proxy":
-		fallthrough
-	case "istio":
-		builder := &IstioProxyBuilder{
-			Istio:                 b.target,
-			Version:               b.target.Version(),
-			Envoy:                 b.envoy,
-			IstioProxy:            b.istioProxy,
-			Patch:                 b.patchGetter,
-			FIPSBuild:             b.fipsBuild,
-			CryptoUpdateStream:    b.cryptoUpdateStream,
-			DynamicModulesBuild:   b.dynamicModulesBuild,
-			Gperftools:            b.gperftools,
-			Wasm:                  b.wasm,
-			Debug:                 b.debug,
-			remoteCache:           b.remoteCache,
-			PatchInfoName:         b.patchInfoName,
-			PatchSuffix:           b.patchSuffix,
-			AdditionalPatchDir:    b.additionalPatchDir,
-			AdditionalPatchGetter: b.additionalPatchGetter,
-		}
-		return builder.Build(ctx)
+// Prepare is Build without printing, it returns the prepared proxy directory. The build context is
+// written in that directory, and the make targets write to its "out" directory.
+func (b *ProxyBuilder) Prepare(ctx context.Context) (string, error) {
+	source, err := b.source()
+	if err != nil {
+		return "", err
 	}
+	return source.Build(ctx)
+}
 
-	return nil
+// source returns the builder of the target kind.
+func (b *ProxyBuilder) source() (SourceBuilder, error) {
+	kind, err := lookupKind(arg.Version(b.spec.Target).Repo().Name())
+	if err != nil {
+		return nil, err
+	}
+	return kind(b), nil
+}
+
+// istioProxyBuilder returns the builder of both istio and tetrateio-proxy targets.
+func (b *ProxyBuilder) istioProxyBuilder() *IstioProxyBuilder {
+	target := arg.Version(b.spec.Target)
+	return &IstioProxyBuilder{
+		Istio:                 target,
+		Version:               target.Version(),
+		Envoy:                 arg.Version(b.spec.OverrideEnvoy),
+		IstioProxy:            arg.Version(b.spec.OverrideIstioProxy),
+		Patch:                 b.patchGetter,
+		FIPSBuild:             b.spec.FIPSBuild,
+		CryptoUpdateStream:    b.spec.CryptoUpdateStream,
+		DynamicModulesBuild:   b.spec.DynamicModulesBuild,
+		Gperftools:            b.spec.Gperftools,
+		Wasm:                  b.spec.Wasm,
+		Debug:                 b.spec.Debug,
+		Prereleases:           b.spec.Prereleases,
+		output:                b.spec.Output,
+		remoteCache:           b.spec.RemoteCache,
+		PatchInfoName:         b.spec.PatchSourceName,
+		PatchSuffix:           b.spec.PatchSuffix,
+		AdditionalPatchDir:    b.spec.AdditionalPatchDir,
+		AdditionalPatchGetter: b.additionalPatchGetter,
+		Context:               b.context,
+		Lock:                  b.lock,
+		WorkDir:               b.workDir,
+		OnPhase:               b.onPhase,
+		refs:                  b.refs,
+	}
 }
@@ -0,0 +1,103 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/dio/leo/arg"
+	"github.com/dio/leo/envoy"
+	"github.com/dio/leo/github"
+)
+
+// envoySource builds the envoy targets from an envoy ref, e.g. envoyproxy/envoy@v1.30.4, in the
+// istio/proxy workspace of the Istio release that uses the same envoy minor version.
+type envoySource struct {
+	b *ProxyBuilder
+}
+
+func envoyKind(b *ProxyBuilder) SourceBuilder {
+	return &envoySource{b: b}
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// envoyRepo returns the repository of an envoy target, envoyproxy/envoy when the owner is omitted.
+func envoyRepo(target arg.Version) string {
+	if len(target.Repo().Owner()) == 0 {
+		return "envoyproxy/" + target.Name()
+	}
+	return target.Name()
+}
+
+// istioProxyBuilder returns the builder of the resolved Istio workspace, with envoy overridden by
+// the target.
+func (s *envoySource) istioProxyBuilder(ctx context.Context) (*IstioProxyBuilder, error) {
+	builder := s.b.istioProxyBuilder()
+	target := arg.Version(s.b.spec.Target)
+	repo := envoyRepo(target)
+
+	if c := s.b.context; c != nil {
+		if c.Envoy.Repo != repo || (commitSHA.MatchString(target.Version()) && c.Envoy.SHA != target.Version()) {
+			return nil, fmt.Errorf("build context was resolved for %s@%s, not %s", c.Envoy.Repo, c.Envoy.SHA, target)
+		}
+		builder.Istio = arg.Version(c.Target)
+		builder.Version = builder.Istio.Version()
+		return builder, nil
+	}
+
+	sha, err := github.ResolveCommitSHA(ctx, repo, target.Version())
+	if err != nil {
+		return nil, err
+	}
+	istioSHA, err := envoy.ResolveWorkspace(ctx, arg.Version(repo+"@"+sha))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the istio workspace of %s: %w", target, err)
+	}
+	builder.Istio = arg.Version("istio@" + istioSHA)
+	builder.Version = istioSHA
+	builder.Envoy = arg.Version(repo + "@" + sha)
+	return builder, nil
+}
+
+func (s *envoySource) Info(ctx context.Context) error {
+	builder, err := s.istioProxyBuilder(ctx)
+	if err != nil {
+		return err
+	}
+	return builder.Info(ctx)
+}
+
+func (s *envoySource) Output(ctx context.Context) error {
+	builder, err := s.istioProxyBuilder(ctx)
+	if err != nil {
+		return err
+	}
+	return builder.Output(ctx)
+}
+
+func (s *envoySource) Describe(ctx context.Context) (*Description, error) {
+	builder, err := s.istioProxyBuilder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return builder.Describe(ctx)
+}
+
+func (s *envoySource) Build(ctx context.Context) (string, error) {
+	// Resolving the istio workspace of envoy is the longest part of resolving.
+	s.b.phase(PhaseResolve)
+	builder, err := s.istioProxyBuilder(ctx)
+	if err != nil {
+		return "", err
+	}
+	return builder.build(ctx)
+}
+
+func (s *envoySource) Release(ctx context.Context) error {
+	builder, err := s.istioProxyBuilder(ctx)
+	if err != nil {
+		return err
+	}
+	return builder.Release(ctx)
+}
@@ -0,0 +1,49 @@
+package build
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnvoySourceFromContext(t *testing.T) {
+	c := &BuildContext{
+		Target:  "istio@5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22",
+		Istio:   IstioCoordinates{Ref: "istio@5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22", SHA: "5f6b3bd28ae2aa7fe0c7a54fd4d8a33b4b8b8e22"},
+		Proxy:   SourceCoordinates{Repo: "istio/proxy", SHA: "757b63df346fc8bea3740cb44a75db9576e0d378"},
+		Envoy:   EnvoyCoordinates{Repo: "envoyproxy/envoy", SHA: "88a80e6bbbee56de8c3899c75eaf36c46fad1aa7", Version: "1.30.4"},
+		Flavors: Flavors{PatchSourceName: "envoy"},
+	}
+
+	builder, err := New(Spec{Target: "envoy@88a80e6bbbee56de8c3899c75eaf36c46fad1aa7", Output: &Output{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builder.Spec().Output.Target != "envoy" {
+		t.Fatalf("output target = %s, want envoy", builder.Spec().Output.Target)
+	}
+	builder.UseContext(c)
+	source, err := builder.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	istioProxyBuilder, err := source.(*envoySource).istioProxyBuilder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyRef, envoyVersion, err := istioProxyBuilder.info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyRef != c.Proxy.SHA || envoyVersion != "1.30.4" || istioProxyBuilder.Envoy.Version() != c.Envoy.SHA {
+		t.Fatalf("info() = %s, %s, envoy %s", proxyRef, envoyVersion, istioProxyBuilder.Envoy)
+	}
+
+	builder, err = New(Spec{Target: "tetratelabs/envoy@88a80e6bbbee56de8c3899c75eaf36c46fad1aa7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.UseContext(c)
+	if err := builder.Info(context.Background()); err == nil {
+		t.Fatal("Info() should fail on a context of another envoy repository")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dio/leo/arg"
 	"github.com/dio/leo/env"
@@ -32,15 +33,41 @@ type IstioProxyBuilder struct {
 	PatchInfoName       string
 	Gperftools          bool
 
+	// Prereleases allows a shorthand ref, e.g. istio@1.22, to resolve to a prerelease tag.
+	Prereleases bool
+	// Tag is the release tag a shorthand ref resolved to.
+	Tag string
+
 	PatchSuffix           string
 	AdditionalPatchDir    string
 	AdditionalPatchGetter patch.Getter
 
+	// WorkDir is where the sources are extracted to, defaults to "work".
+	WorkDir string
+	// Context, when set, provides the resolved refs.
+	Context *BuildContext
+	// Lock, when set, makes Build record (or enforce) the resolved inputs.
+	Lock *LockOptions
+	// OnPhase, when set, is called when a build or release phase starts.
+	OnPhase func(Phase)
+
 	remoteCache string
 	output      *Output
+	refs        *sharedRefs
 }
 
 func (b *IstioProxyBuilder) info(ctx context.Context) (string, string, error) {
+	if b.Context != nil {
+		return b.fromContext()
+	}
+	if b.refs != nil {
+		return b.refs.resolve(ctx, b)
+	}
+	return b.resolve(ctx)
+}
+
+// resolve resolves the istio, proxy and envoy refs to commit SHAs, and reads the envoy version.
+func (b *IstioProxyBuilder) resolve(ctx context.Context) (string, string, error) {
 	if b.Istio.Name() == "tetrateio-proxy" {
 		b.Version = b.Istio.Version()
 		b.IstioProxy = arg.Version(fmt.Sprintf("istio/proxy@%s", b.Istio.Version()))
@@ -51,7 +78,13 @@ func (b *IstioProxyBuilder) info(ctx context.Context) (string, string, error) {
 
 		}
 
-		istioRef, err := github.ResolveCommitSHA(ctx, istioRepo, b.Version)
+		ref, tag, err := resolveShorthand(ctx, istioRepo, b.Istio, b.Prereleases)
+		if err != nil {
+			return "", "", err
+		}
+		b.Tag = tag
+
+		istioRef, err := github.ResolveCommitSHA(ctx, istioRepo, ref)
 		if err != nil {
 			return "", "", err
 		}
@@ -105,6 +138,11 @@ func (b *IstioProxyBuilder) Info(ctx context.Context) error {
 		b.IstioProxy = arg.Version(fmt.Sprintf("istio/proxy@%s", istioProxyRef))
 	}
 
+	istioRef := string(b.Istio)
+	if len(b.Tag) > 0 {
+		istioRef += " (" + b.Tag + ")"
+	}
+
 	fmt.Fprintf(os.Stderr, `build info:
   istio: %s
   workspace: %s
@@ -113,7 +151,7 @@ func (b *IstioProxyBuilder) Info(ctx context.Context) error {
   fips: %v
   dynamic-modules: %v
   debug: %v
-`, b.Istio, b.IstioProxy, b.Envoy, envoyVersion, b.FIPSBuild, b.DynamicModulesBuild, b.Debug)
+`, istioRef, b.IstioProxy, b.Envoy, envoyVersion, b.FIPSBuild, b.DynamicModulesBuild, b.Debug)
 	return nil
 }
 
@@ -123,7 +161,7 @@ func (b *IstioProxyBuilder) Output(ctx context.Context) error {
 		return err
 	}
 
-	out := path.Join("work", "proxy-"+istioProxyRef, "out", "*")
+	out := path.Join(b.workDir(), "proxy-"+istioProxyRef, "out", "*")
 	fmt.Print(out)
 
 	return nil
@@ -168,20 +206,10 @@ func (b *IstioProxyBuilder) getRemoteProxyDir() string {
 	return remoteProxyDir
 }
 
-func (b *IstioProxyBuilder) Release(ctx context.Context) error {
-	istioProxyRef, _, err := b.info(ctx)
-	if err != nil {
-		return err
-	}
-
-	var (
-		tag            string
-		title          string
-		remoteProxyDir string
-		remoteProxyRef string
-		debug          string
-	)
-
+// releaseCoordinates returns the GitHub release tag and title, and the name (without the file
+// suffix) of the tarball uploaded to GCS for the current output target.
+func (b *IstioProxyBuilder) releaseCoordinates(istioProxyRef string) (tag, title, remoteProxyRef string, err error) {
+	var debug string
 	if b.Debug {
 		debug = "-debug"
 	}
@@ -190,7 +218,6 @@ func (b *IstioProxyBuilder) Release(ctx context.Context) error {
 	case "istio-proxy":
 		tag = path.Join("istio", b.Version[0:7], "proxy", istioProxyRef[0:7], b.Envoy.Name(), b.Envoy.Version()[0:7])
 		title = "istio-proxy@" + istioProxyRef[0:7]
-		remoteProxyDir = "proxy"
 		remoteProxyRef = "alpha-" + istioProxyRef + debug
 		if b.Istio.Name() == "tetrateio-proxy" {
 			tag = path.Join("tetrateio-proxy", istioProxyRef[0:7], b.Envoy.Name(), b.Envoy.Version()[0:7])
@@ -219,35 +246,52 @@ func (b *IstioProxyBuilder) Release(ctx context.Context) error {
 		remoteProxyRef = "centos-" + b.Envoy.Version()
 	}
 
-	out := path.Join(b.output.Dir, "*.tar.gz")
-	files, err := filepath.Glob(out)
-	if err != nil {
-		return err
-	}
-
 	if len(b.DynamicModulesBuild) > 0 {
 		parsed, err := parseRepoRef(b.DynamicModulesBuild)
 		if err != nil {
-			return err
+			return "", "", "", err
 		}
 		// For example: dynamic-modules/b4c09ad/envoyproxy/envoy/7b8baff
 		tag = path.Join("dynamic-modules", parsed.Ref[0:7], tag)
 		title += "-dynamic-modules"
 	}
+	return tag, title, remoteProxyRef, nil
+}
 
-	remoteProxyDir = b.getRemoteProxyDir()
+// remoteFile returns the GCS object (without the "gs://" scheme) a built tarball is uploaded to.
+func (b *IstioProxyBuilder) remoteFile(remoteProxyRef string) string {
 	suffix := b.PatchSuffix + ".tar.gz"
 	if b.output.Arch != "amd64" {
 		suffix = "-" + b.output.Arch + b.PatchSuffix + ".tar.gz"
 	}
+	return path.Join(env.GCS_BUCKET, b.getRemoteProxyDir(), "envoy-"+remoteProxyRef+suffix)
+}
+
+func (b *IstioProxyBuilder) Release(ctx context.Context) error {
+	b.phase(PhaseRelease)
+	istioProxyRef, _, err := b.info(ctx)
+	if err != nil {
+		return err
+	}
+
+	tag, title, remoteProxyRef, err := b.releaseCoordinates(istioProxyRef)
+	if err != nil {
+		return err
+	}
 
+	out := path.Join(b.output.Dir, "*.tar.gz")
+	files, err := filepath.Glob(out)
+	if err != nil {
+		return err
+	}
+
+	remoteProxyDir := b.getRemoteProxyDir()
 	for _, file := range files {
 		if !strings.HasSuffix(file, ".tar.gz") {
 			continue
 		}
 		// Upload to GCS.
-		remoteFile := path.Join(env.GCS_BUCKET, remoteProxyDir, "envoy-"+remoteProxyRef+suffix)
-		if err := sh.RunV(ctx, "gsutil", "cp", file, "gs://"+remoteFile); err != nil {
+		if err := sh.RunV(ctx, "gsutil", "cp", file, "gs://"+b.remoteFile(remoteProxyRef)); err != nil {
 			return err
 		}
 	}
@@ -290,21 +334,40 @@ func (b *IstioProxyBuilder) Release(ctx context.Context) error {
 		notes += fmt.Sprintf("- https://github.com/" + strings.Replace(b.DynamicModulesBuild, "@", "/commits/", 1) + "\n")
 	}
 
-	if err := sh.RunV(ctx, "gh", "release", "view", tag, "-R", b.output.Repo); err != nil {
-		if err := sh.RunV(ctx, "gh", append([]string{"release", "create", tag, "-n", notes, "-t", title, "-R", b.output.Repo}, files...)...); err == nil {
-			return err
-		}
-	} else {
-		return sh.RunV(ctx, "gh", append([]string{"release", "upload", tag, "--clobber", "-R", b.output.Repo}, files...)...)
+	return publishRelease(ctx, b.output.Repo, tag, title, notes, files)
+}
+
+// publishRelease uploads files to a GitHub release, creating it when it does not exist.
+func publishRelease(ctx context.Context, repo, tag, title, notes string, files []string) error {
+	if err := sh.RunV(ctx, "gh", "release", "view", tag, "-R", repo); err != nil {
+		return sh.RunV(ctx, "gh", append([]string{"release", "create", tag, "-n", notes, "-t", title, "-R", repo}, files...)...)
 	}
-	return nil
+	return sh.RunV(ctx, "gh", append([]string{"release", "upload", tag, "--clobber", "-R", repo}, files...)...)
 }
 
 func (b *IstioProxyBuilder) Build(ctx context.Context) error {
-	istioProxyRef, envoyVersion, err := b.info(ctx)
+	istioProxyDir, err := b.build(ctx)
 	if err != nil {
 		return err
 	}
+	fmt.Print(istioProxyDir)
+	return nil
+}
+
+// phase reports the start of a phase to OnPhase.
+func (b *IstioProxyBuilder) phase(p Phase) {
+	if b.OnPhase != nil {
+		b.OnPhase(p)
+	}
+}
+
+// build prepares the patched sources and the make targets, and returns the proxy directory.
+func (b *IstioProxyBuilder) build(ctx context.Context) (string, error) {
+	b.phase(PhaseResolve)
+	istioProxyRef, envoyVersion, err := b.info(ctx)
+	if err != nil {
+		return "", err
+	}
 
 	fmt.Fprintf(os.Stderr, `build info:
   istio: %s
@@ -316,95 +379,109 @@ func (b *IstioProxyBuilder) Build(ctx context.Context) error {
   debug: %v
 `, b.Istio, b.IstioProxy, b.Envoy, envoyVersion, b.FIPSBuild, b.DynamicModulesBuild, b.Debug)
 
-	istioProxyDir, err := utils.GetTarballAndExtract(ctx, b.IstioProxy.Name(), istioProxyRef, "work")
+	var (
+		lock   *Lock
+		locked *Lock
+	)
+	if b.Lock != nil && len(b.Lock.File) > 0 {
+		if lock, err = b.resolveLock(ctx, istioProxyRef, envoyVersion); err != nil {
+			return "", err
+		}
+		if b.Lock.Frozen {
+			if locked, err = ReadLock(b.Lock.File); err != nil {
+				return "", err
+			}
+			if err := locked.CheckRefs(lock); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	b.phase(PhaseFetch)
+	istioProxyDir, err := utils.GetTarballAndExtract(ctx, b.IstioProxy.Name(), istioProxyRef, b.workDir())
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	envoyDir, err := utils.GetTarballAndExtract(ctx, b.Envoy.Name(), b.Envoy.Version(), istioProxyDir)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	var suffix string
+	b.phase(PhasePatch)
+	suffix := b.patchInfoSuffix()
 	if len(b.DynamicModulesBuild) > 0 {
-		suffix = "-dynamic-modules"
 		// When we have DynamicModulesBuild, we need to add the dynamic modules to the workspace.
 		// This is a hack since we use istio/proxy workspace vs. envoy workspace.
 		istioProxyWorkspace, err := github.GetRaw(ctx, b.IstioProxy.Name(), "WORKSPACE", b.IstioProxy.Version())
 		if err != nil {
-			return err
+			return "", err
 		}
 		parsed, err := parseRepoRef(b.DynamicModulesBuild)
 		if err != nil {
-			return err
+			return "", err
 		}
 		modifiedIstioProxyWorkspace := istioproxy.AddDynamicModules(istioProxyWorkspace, parsed.Repo, parsed.Ref)
 		if err := os.WriteFile(filepath.Join(istioProxyDir, "WORKSPACE"), []byte(modifiedIstioProxyWorkspace), os.ModePerm); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	if b.FIPSBuild && b.CryptoUpdateStream {
-		suffix = "" // no precompiled BCM patch for crypto update stream
-	} else if b.FIPSBuild {
-		suffix = "-fips"
-	}
-
-	if len(b.PatchInfoName) == 0 {
-		b.PatchInfoName = "envoy"
-	}
-
 	// Patch envoy
-	err = patch.Apply(ctx, patch.Info{
-		Name: b.PatchInfoName,
-		// Always trim -dev. But this probably misleading since the patch will be valid for envoyVersion.patch+1.
-		// For example: A patch that valid 1.24.10-dev, probably invalid for 1.24.10.
-		Ref:    strings.TrimSuffix(envoyVersion, "-dev"),
-		Suffix: suffix,
-	}, b.Patch, envoyDir)
+	var patches []LockedPatch
+	applied, err := patch.Apply(ctx, b.patchInfo(envoyVersion, suffix), b.Patch, envoyDir)
 
 	if err != nil {
 		// When we have no suffix, no fallback.
 		if len(suffix) == 0 {
-			return err
+			return "", err
 		}
 		_ = os.RemoveAll(envoyDir)
 		envoyDir, err = utils.GetTarballAndExtract(ctx, b.Envoy.Name(), b.Envoy.Version(), istioProxyDir)
 		if err != nil {
-			return err
+			return "", err
 		}
-		if err = patch.Apply(ctx, patch.Info{
-			Name: b.PatchInfoName,
-			// Always trim -dev. But this probably misleading since the patch will be valid for envoyVersion.patch+1.
-			// For example: A patch that valid 1.24.10-dev, probably invalid for 1.24.10.
-			Ref: strings.TrimSuffix(envoyVersion, "-dev"),
-		}, b.Patch, envoyDir); err != nil {
-			return err
+		if applied, err = patch.Apply(ctx, b.patchInfo(envoyVersion, ""), b.Patch, envoyDir); err != nil {
+			return "", err
 		}
 	}
+	patches = append(patches, lockedPatches("envoy", applied)...)
 
 	// When patch dir is specified, we apply patches from the directory to the envoy and istio-proxy sources.
 	// The patch files are prefixed with "envoy" and "proxy" respectively and we apply one by one into
 	// the envoy and istio-proxy directories.
 	if len(b.AdditionalPatchDir) > 0 {
-		err = patch.ApplyDir(ctx, b.AdditionalPatchGetter, b.AdditionalPatchDir, "proxy", istioProxyDir)
+		proxyPatches, err := patch.ApplyDir(ctx, b.AdditionalPatchGetter, b.AdditionalPatchDir, "proxy", istioProxyDir)
 		if err != nil {
-			return err
+			return "", err
 		}
+		patches = append(patches, lockedPatches("proxy", proxyPatches...)...)
 
-		err = patch.ApplyDir(ctx, b.AdditionalPatchGetter, b.AdditionalPatchDir, "envoy", envoyDir)
+		envoyPatches, err := patch.ApplyDir(ctx, b.AdditionalPatchGetter, b.AdditionalPatchDir, "envoy", envoyDir)
 		if err != nil {
-			return err
+			return "", err
 		}
+		patches = append(patches, lockedPatches("envoy", envoyPatches...)...)
 	}
 
+	if lock != nil {
+		lock.Patches = patches
+		if locked != nil {
+			if err := locked.CheckPatches(patches); err != nil {
+				return "", err
+			}
+		} else if err := lock.Write(b.Lock.File); err != nil {
+			return "", err
+		}
+	}
+
+	b.phase(PhaseGenerate)
 	status := "istio/proxy"
 	if b.Istio.Name() == "tetrateio-proxy" {
 		status = "tetrateio/proxy"
 	}
 	if err := istioproxy.WriteWorkspaceStatus(istioProxyDir, status, b.Envoy.Name(), b.Envoy.Version()); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := istioproxy.AddMakeTargets(istioproxy.TargetOptions{
@@ -423,16 +500,75 @@ func (b *IstioProxyBuilder) Build(ctx context.Context) error {
 		Debug:               b.Debug,
 		RemoteCache:         b.remoteCache,
 	}); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := istioproxy.PrepareBuilder(istioProxyDir, b.remoteCache); err != nil {
-		return err
+		return "", err
+	}
+
+	buildContext := &BuildContext{
+		Target: string(b.Istio),
+		Istio: IstioCoordinates{
+			Ref: string(b.Istio),
+			Tag: b.Tag,
+			SHA: b.Version,
+		},
+		Proxy: SourceCoordinates{
+			Repo: b.IstioProxy.Name(),
+			SHA:  istioProxyRef,
+		},
+		Envoy: EnvoyCoordinates{
+			Repo:    b.Envoy.Name(),
+			SHA:     b.Envoy.Version(),
+			Version: envoyVersion,
+		},
+		Flavors:   b.flavors(envoyVersion),
+		Dir:       istioProxyDir,
+		CreatedAt: time.Now(),
+	}
+	contextFile := filepath.Join(istioProxyDir, ContextFileName)
+	if err := buildContext.Write(contextFile); err != nil {
+		return "", err
+	}
+	fmt.Fprintln(os.Stderr, "build context:", contextFile)
+
+	return istioProxyDir, nil
+}
+
+func (b *IstioProxyBuilder) workDir() string {
+	if len(b.WorkDir) == 0 {
+		return "work"
 	}
+	return b.WorkDir
+}
 
-	fmt.Print(istioProxyDir)
+// patchInfoSuffix returns the suffix of the envoy patch to look for first, e.g. 1.29-fips.patch.
+func (b *IstioProxyBuilder) patchInfoSuffix() string {
+	var suffix string
+	if len(b.DynamicModulesBuild) > 0 {
+		suffix = "-dynamic-modules"
+	}
+	if b.FIPSBuild && b.CryptoUpdateStream {
+		suffix = "" // no precompiled BCM patch for crypto update stream
+	} else if b.FIPSBuild {
+		suffix = "-fips"
+	}
+	return suffix
+}
 
-	return nil
+func (b *IstioProxyBuilder) patchInfo(envoyVersion, suffix string) patch.Info {
+	name := b.PatchInfoName
+	if len(name) == 0 {
+		name = "envoy"
+	}
+	return patch.Info{
+		Name: name,
+		// Always trim -dev. But this probably misleading since the patch will be valid for envoyVersion.patch+1.
+		// For example: A patch that valid 1.24.10-dev, probably invalid for 1.24.10.
+		Ref:    strings.TrimSuffix(envoyVersion, "-dev"),
+		Suffix: suffix,
+	}
 }
 
 type RepoRef struct {
@@ -451,3 +587,17 @@ func parseRepoRef(input string) (RepoRef, error) {
 		Ref:  parts[1],
 	}, nil
 }
+
+// resolveShorthand resolves a minor shorthand, e.g. istio@1.22 or istio@1.22.x, to the newest
+// patch release tag. Other refs are returned as they are, with an empty tag.
+func resolveShorthand(ctx context.Context, repo string, v arg.Version, prereleases bool) (string, string, error) {
+	minor, ok := v.Minor()
+	if !ok {
+		return v.Version(), "", nil
+	}
+	tag, err := github.LatestPatchRelease(ctx, repo, minor, prereleases)
+	if err != nil {
+		return "", "", err
+	}
+	return tag, tag, nil
+}
@@ -1,6 +1,10 @@
 package build
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/dio/leo/arg"
@@ -134,3 +138,43 @@ func TestGetRemoteProxyDir(t *testing.T) {
 		})
 	}
 }
+
+func TestPublishRelease(t *testing.T) {
+	// A fake gh records its calls, and fails the commands listed in $GH_FAIL.
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$2\" >> " + calls + "\ncase \" $GH_FAIL \" in *\" $2 \"*) exit 1;; esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "gh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name  string
+		fail  string
+		calls string
+		err   bool
+	}{
+		{name: "upload", calls: "view upload"},
+		{name: "create", fail: "view", calls: "view create"},
+		{name: "create fails", fail: "view create", calls: "view create", err: true},
+		{name: "upload fails", fail: "upload", calls: "view upload", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GH_FAIL", tt.fail)
+			_ = os.Remove(calls)
+			err := publishRelease(context.Background(), "tetrateio/proxy-archives", "istio/e2c3d8f", "title", "notes", []string{"envoy.tar.gz"})
+			if (err != nil) != tt.err {
+				t.Fatalf("publishRelease() error = %v, want error %v", err, tt.err)
+			}
+			data, err := os.ReadFile(calls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(strings.Fields(string(data)), " "); got != tt.calls {
+				t.Errorf("gh calls = %s, want %s", got, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dio/leo/arg"
+)
+
+// sharedRefs memoizes the refs resolved by IstioProxyBuilder.resolve, so builders of the same
+// sources (e.g. matrix entries with different flavors) resolve them only once.
+type sharedRefs struct {
+	mu   sync.Mutex
+	refs map[string]resolvedRefs
+}
+
+type resolvedRefs struct {
+	version       string
+	tag           string
+	istioProxy    arg.Version
+	envoy         arg.Version
+	istioProxyRef string
+	envoyVersion  string
+}
+
+func newSharedRefs() *sharedRefs {
+	return &sharedRefs{refs: make(map[string]resolvedRefs)}
+}
+
+func (s *sharedRefs) resolve(ctx context.Context, b *IstioProxyBuilder) (string, string, error) {
+	key := fmt.Sprint(string(b.Istio), "|", b.Prereleases, "|") + string(b.IstioProxy) + "|" + string(b.Envoy)
+
+	// Holding the lock while resolving makes concurrent builders wait for the first one.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.refs[key]; ok {
+		b.Version = r.version
+		b.Tag = r.tag
+		b.IstioProxy = r.istioProxy
+		b.Envoy = r.envoy
+		return r.istioProxyRef, r.envoyVersion, nil
+	}
+
+	istioProxyRef, envoyVersion, err := b.resolve(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	s.refs[key] = resolvedRefs{
+		version:       b.Version,
+		tag:           b.Tag,
+		istioProxy:    b.IstioProxy,
+		envoy:         b.Envoy,
+		istioProxyRef: istioProxyRef,
+		envoyVersion:  envoyVersion,
+	}
+	return istioProxyRef, envoyVersion, nil
+}
@@ -0,0 +1,147 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dio/leo/arg"
+)
+
+// Spec describes a proxy build. It mirrors the "proxy" command flags.
+type Spec struct {
+	// Target is what to build. For example: istio@1.22.3, tetrateio-proxy@<sha>,
+	// envoyproxy/envoy@<sha>.
+	Target string
+	// OverrideIstioProxy and OverrideEnvoy replace the resolved repositories. For example:
+	// tetratelabs/envoy@88a80e6bbbee56de8c3899c75eaf36c46fad1aa7.
+	OverrideIstioProxy string
+	OverrideEnvoy      string
+	// PatchSource is where the patches are fetched from, defaults to github://dio/leo. For example:
+	// file://patches.
+	PatchSource string
+	// PatchSourceName is the patches directory name, defaults to envoy.
+	PatchSourceName string
+	PatchSuffix     string
+	// AdditionalPatchDir holds patches applied after the main patch. AdditionalPatchSource
+	// defaults to PatchSource.
+	AdditionalPatchDir    string
+	AdditionalPatchSource string
+	DynamicModulesBuild   string
+	RemoteCache           string
+
+	// Prereleases allows a shorthand target, e.g. istio@1.22, to resolve to a prerelease tag.
+	Prereleases bool
+
+	FIPSBuild          bool
+	CryptoUpdateStream bool
+	Wasm               bool
+	Gperftools         bool
+	Debug              bool
+
+	// Output is required by Info, Output, Describe and Release. Its target defaults to
+	// istio-proxy, or envoy for envoy targets.
+	Output *Output
+}
+
+// Validate returns an error when the spec cannot be built, including the conflicting flavors
+// which are not only warnings.
+func (s *Spec) Validate() error {
+	var errs []error
+	if err := validateRepoRef("target", s.Target); err != nil {
+		errs = append(errs, err)
+	} else if _, err := lookupKind(arg.Version(s.Target).Repo().Name()); err != nil {
+		errs = append(errs, err)
+	}
+	for _, o := range []struct{ name, value string }{
+		{"override-istio-proxy", s.OverrideIstioProxy},
+		{"override-envoy", s.OverrideEnvoy},
+		{"dynamic-modules-build", s.DynamicModulesBuild},
+	} {
+		if len(o.value) == 0 {
+			continue
+		}
+		if err := validateRepoRef(o.name, o.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(s.AdditionalPatchSource) > 0 && len(s.AdditionalPatchDir) == 0 {
+		errs = append(errs, errors.New("additional-patch-source requires additional-patch-dir"))
+	}
+	if s.Output != nil && len(s.Output.Target) > 0 && !validOutputTarget(s.Output.Target) {
+		errs = append(errs, fmt.Errorf("unsupported output target %q, supported targets: %s",
+			s.Output.Target, strings.Join(outputTargets, ", ")))
+	}
+	for _, c := range s.Conflicts() {
+		if !c.Warning {
+			errs = append(errs, errors.New(c.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateRepoRef(name, value string) error {
+	parts := strings.Split(value, "@")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("invalid %s %q, expecting <repo>@<ref>", name, value)
+	}
+	return nil
+}
+
+func (s Spec) withDefaults() Spec {
+	if len(s.PatchSource) == 0 {
+		s.PatchSource = "github://dio/leo"
+	}
+	if len(s.PatchSourceName) == 0 {
+		s.PatchSourceName = "envoy"
+	}
+	if s.Output != nil && len(s.Output.Target) == 0 {
+		output := *s.Output
+		output.Target = "istio-proxy"
+		if isEnvoyTarget(s.Target) {
+			output.Target = "envoy"
+		}
+		s.Output = &output
+	}
+	return s
+}
+
+// Arguments returns the "proxy build" command arguments building this spec, the target first.
+func (s Spec) Arguments() []string {
+	args := []string{s.Target}
+	for _, f := range []struct{ name, value string }{
+		{"override-istio-proxy", s.OverrideIstioProxy},
+		{"override-envoy", s.OverrideEnvoy},
+		{"patch-source", s.PatchSource},
+		{"patch-source-name", s.PatchSourceName},
+		{"patch-suffix", s.PatchSuffix},
+		{"additional-patch-dir", s.AdditionalPatchDir},
+		{"additional-patch-source", s.AdditionalPatchSource},
+		{"dynamic-modules-build", s.DynamicModulesBuild},
+		{"remote-cache", s.RemoteCache},
+	} {
+		if len(f.value) > 0 {
+			args = append(args, "--"+f.name+"="+f.value)
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value bool
+	}{
+		{"prereleases", s.Prereleases},
+		{"fips-build", s.FIPSBuild},
+		{"crypto-updatestream", s.CryptoUpdateStream},
+		{"gperftools", s.Gperftools},
+		{"debug", s.Debug},
+	} {
+		if f.value {
+			args = append(args, "--"+f.name)
+		}
+	}
+	// The default of --wasm depends on the architecture, it is always set.
+	return append(args, fmt.Sprintf("--wasm=%v", s.Wasm))
+}
+
+func isEnvoyTarget(target string) bool {
+	return arg.Version(target).Repo().Name() == "envoy"
+}
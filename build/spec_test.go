@@ -0,0 +1,82 @@
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSpecValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Spec
+		err  string
+	}{
+		{name: "istio", spec: Spec{Target: "istio@1.22.3"}},
+		{name: "tetrateio-proxy", spec: Spec{Target: "tetrateio-proxy@757b63df346fc8bea3740cb44a75db9576e0d378"}},
+		{name: "fork", spec: Spec{Target: "tetrateio/istio@release-1.22", OverrideEnvoy: "tetratelabs/envoy@main"}},
+		{name: "missing target", spec: Spec{}, err: "invalid target"},
+		{name: "missing ref", spec: Spec{Target: "istio"}, err: "invalid target"},
+		{name: "unsupported target", spec: Spec{Target: "isito@1.22.0"}, err: `unsupported target kind "isito", supported kinds: envoy, istio, tetrateio-proxy`},
+		{name: "override", spec: Spec{Target: "istio@1.22.3", OverrideEnvoy: "tetratelabs/envoy"}, err: "invalid override-envoy"},
+		{
+			name: "additional patch source",
+			spec: Spec{Target: "istio@1.22.3", AdditionalPatchSource: "file://patches"},
+			err:  "additional-patch-source requires additional-patch-dir",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	builder, err := New(Spec{Target: "istio@1.22.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := builder.Spec()
+	if spec.PatchSource != "github://dio/leo" || spec.PatchSourceName != "envoy" {
+		t.Fatalf("Spec() = %+v", spec)
+	}
+}
+
+func TestSpecArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Spec
+		want string
+	}{
+		{name: "istio", spec: Spec{Target: "istio@1.22.3"}, want: "istio@1.22.3 --wasm=false"},
+		{
+			name: "flavors",
+			spec: Spec{
+				Target:          "istio@1.22",
+				PatchSource:     "github://dio/leo",
+				PatchSourceName: "envoy",
+				Prereleases:     true,
+				FIPSBuild:       true,
+				Wasm:            true,
+				RemoteCache:     "us-central1",
+			},
+			want: "istio@1.22 --patch-source=github://dio/leo --patch-source-name=envoy --remote-cache=us-central1 --prereleases --fips-build --wasm=true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(tt.spec.Arguments(), " "); got != tt.want {
+				t.Errorf("Arguments() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dio/leo/env"
+)
+
+const (
+	// KindRaw is for files fetched through the GitHub contents API.
+	KindRaw = "raw"
+	// KindTarball is for source archives.
+	KindTarball = "tarball"
+
+	// DefaultTTL is how long entries keyed by a mutable ref (branch or tag) stay fresh.
+	DefaultTTL = 10 * time.Minute
+
+	metaSuffix = ".json"
+)
+
+var shaRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// IsImmutable tells whether the content of ref never changes, i.e. it is a full commit SHA.
+func IsImmutable(ref string) bool {
+	return shaRe.MatchString(ref)
+}
+
+// Entry describes a cached file.
+type Entry struct {
+	Key       string    `json:"key"`
+	Kind      string    `json:"kind"`
+	Repo      string    `json:"repo"`
+	Name      string    `json:"name"`
+	Ref       string    `json:"ref"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	Immutable bool      `json:"immutable"`
+}
+
+// Expired reports whether the entry should be refetched.
+func (e Entry) Expired(ttl time.Duration, now time.Time) bool {
+	if e.Immutable {
+		return false
+	}
+	return now.Sub(e.CreatedAt) > ttl
+}
+
+// Cache is an on-disk cache. Entries are keyed by a hash of their kind, repo, name and ref. Since
+// the content behind a commit SHA never changes, those entries never expire. Other refs are
+// refetched after TTL.
+type Cache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// Default returns the cache in LEO_CACHE_DIR, defaults to ~/.cache/leo.
+func Default() *Cache {
+	return &Cache{
+		Dir: env.LEO_CACHE_DIR,
+		TTL: DefaultTTL,
+	}
+}
+
+// Key returns the content address of a cached file.
+func Key(kind, repo, name, ref string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{kind, repo, name, ref}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key[0:2], key)
+}
+
+func (c *Cache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultTTL
+	}
+	return c.TTL
+}
+
+// Get returns the path of a fresh cached file.
+func (c *Cache) Get(kind, repo, name, ref string) (string, bool) {
+	if c == nil || len(c.Dir) == 0 {
+		return "", false
+	}
+	key := Key(kind, repo, name, ref)
+	entry, err := c.readEntry(c.path(key) + metaSuffix)
+	if err != nil || entry.Expired(c.ttl(), time.Now()) {
+		return "", false
+	}
+	p := c.path(key)
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// Put stores the content read from r and returns the path to the cached file.
+func (c *Cache) Put(kind, repo, name, ref string, r io.Reader) (string, error) {
+	if c == nil || len(c.Dir) == 0 {
+		return "", errors.New("cache: no directory")
+	}
+	key := Key(kind, repo, name, ref)
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first, so concurrent readers never see a partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(p), key+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		_ = tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return "", err
+	}
+
+	meta, err := json.Marshal(Entry{
+		Key:       key,
+		Kind:      kind,
+		Repo:      repo,
+		Name:      name,
+		Ref:       ref,
+		Size:      size,
+		CreatedAt: time.Now(),
+		Immutable: IsImmutable(ref),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p+metaSuffix, meta, 0o644); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// List returns all entries, sorted by creation time (newest first).
+func (c *Cache) List() ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(c.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, metaSuffix) {
+			return nil
+		}
+		entry, err := c.readEntry(p)
+		if err != nil {
+			return nil // Skip broken entries, prune takes care of them.
+		}
+		entries = append(entries, *entry)
+		return nil
+	})
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return entries, err
+}
+
+// PruneOptions selects entries to evict. Expired entries are always evicted.
+type PruneOptions struct {
+	// All evicts every entry.
+	All bool
+	// OlderThan evicts entries (including immutable ones) created before now-OlderThan.
+	OlderThan time.Duration
+	// Repo limits the eviction to entries of a repository.
+	Repo string
+}
+
+// Prune evicts entries and returns what was removed.
+func (c *Cache) Prune(opts PruneOptions) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var removed []Entry
+	for _, entry := range entries {
+		if len(opts.Repo) > 0 && entry.Repo != opts.Repo {
+			continue
+		}
+		evict := opts.All || entry.Expired(c.ttl(), now) ||
+			(opts.OlderThan > 0 && now.Sub(entry.CreatedAt) > opts.OlderThan)
+		if !evict {
+			continue
+		}
+		p := c.path(entry.Key)
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		if err := os.Remove(p + metaSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+func (c *Cache) readEntry(p string) (*Entry, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
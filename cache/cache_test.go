@@ -0,0 +1,74 @@
+package cache_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/cache"
+)
+
+const sha = "2e4228b0ee73ae640c92e0974c91e251997a3d2f"
+
+func TestGetPut(t *testing.T) {
+	c := &cache.Cache{Dir: t.TempDir(), TTL: time.Hour}
+
+	if _, ok := c.Get(cache.KindRaw, "envoyproxy/envoy", "VERSION.txt", sha); ok {
+		t.Fatal("unexpected hit on empty cache")
+	}
+
+	if _, err := c.Put(cache.KindRaw, "envoyproxy/envoy", "VERSION.txt", sha, strings.NewReader("1.29.1")); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := c.Get(cache.KindRaw, "envoyproxy/envoy", "VERSION.txt", sha)
+	if !ok {
+		t.Fatal("expected hit")
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1.29.1" {
+		t.Fatalf("cached content = %q", data)
+	}
+
+	if _, ok := c.Get(cache.KindRaw, "envoyproxy/envoy", "VERSION.txt", "main"); ok {
+		t.Fatal("unexpected hit for another ref")
+	}
+}
+
+func TestExpiryAndPrune(t *testing.T) {
+	c := &cache.Cache{Dir: t.TempDir(), TTL: time.Nanosecond}
+
+	for _, ref := range []string{sha, "master"} {
+		if _, err := c.Put(cache.KindRaw, "istio/istio", "istio.deps", ref, strings.NewReader("[]")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	if _, ok := c.Get(cache.KindRaw, "istio/istio", "istio.deps", "master"); ok {
+		t.Fatal("branch entry should have expired")
+	}
+	if _, ok := c.Get(cache.KindRaw, "istio/istio", "istio.deps", sha); !ok {
+		t.Fatal("SHA entry should never expire")
+	}
+
+	removed, err := c.Prune(cache.PruneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Ref != "master" {
+		t.Fatalf("Prune() removed %v", removed)
+	}
+
+	removed, err = c.Prune(cache.PruneOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := c.List()
+	if len(removed) != 1 || len(entries) != 0 {
+		t.Fatalf("Prune(All) removed %v, left %v", removed, entries)
+	}
+}
@@ -0,0 +1,251 @@
+package compat
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/istio"
+	"github.com/dio/leo/istioproxy"
+	"golang.org/x/sync/errgroup"
+)
+
+// Row tells which proxy and envoy an Istio release ships with.
+type Row struct {
+	Istio        string `json:"istio"`
+	ProxySHA     string `json:"proxySHA"`
+	EnvoyRepo    string `json:"envoyRepo"`
+	EnvoySHA     string `json:"envoySHA"`
+	EnvoyVersion string `json:"envoyVersion"`
+}
+
+var header = []string{"Istio", "Proxy SHA", "Envoy repo", "Envoy SHA", "Envoy version"}
+
+func (r Row) fields() []string {
+	return []string{r.Istio, r.ProxySHA, r.EnvoyRepo, r.EnvoySHA, r.EnvoyVersion}
+}
+
+func rowOf(fields []string) (Row, error) {
+	if len(fields) != len(header) {
+		return Row{}, fmt.Errorf("expecting %d columns, got %d", len(header), len(fields))
+	}
+	return Row{Istio: fields[0], ProxySHA: fields[1], EnvoyRepo: fields[2], EnvoySHA: fields[3], EnvoyVersion: fields[4]}, nil
+}
+
+// Options tells Generate which releases to list.
+type Options struct {
+	// Since is the oldest Istio minor version to list, e.g. 1.20. Empty lists every release.
+	Since string
+	// Existing rows are kept as they are, since a release tag does not move.
+	Existing []Row
+	// Concurrency is the number of releases resolved at once, defaults to 8.
+	Concurrency int
+}
+
+// Generate returns one row per stable Istio release, newest first. Only the releases missing from
+// opts.Existing are resolved, the ones without istio.deps are left out.
+func Generate(ctx context.Context, opts Options) ([]Row, error) {
+	var since *semver.Version
+	if len(opts.Since) > 0 {
+		var err error
+		if since, err = semver.NewVersion(opts.Since); err != nil {
+			return nil, fmt.Errorf("invalid --since %q: %w", opts.Since, err)
+		}
+	}
+
+	releases, err := github.ListReleases(ctx, "istio/istio")
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]Row, len(opts.Existing))
+	for _, row := range opts.Existing {
+		existing[row.Istio] = row
+	}
+
+	var rows []Row
+	var missing []int
+	for _, release := range releases {
+		if release.Draft || release.Prerelease {
+			continue
+		}
+		v, err := semver.NewVersion(release.TagName)
+		if err != nil || len(v.Prerelease()) > 0 {
+			continue
+		}
+		if since != nil && v.LessThan(since) {
+			continue
+		}
+		if row, ok := existing[release.TagName]; ok {
+			rows = append(rows, row)
+			continue
+		}
+		missing = append(missing, len(rows))
+		rows = append(rows, Row{Istio: release.TagName})
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	unresolved := make([]bool, len(rows))
+	for _, i := range missing {
+		i, row := i, &rows[i]
+		g.Go(func() error {
+			ok, err := resolve(gctx, row)
+			unresolved[i] = !ok
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	resolved := rows[:0]
+	for i, row := range rows {
+		if !unresolved[i] {
+			resolved = append(resolved, row)
+		}
+	}
+	rows = resolved
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return semver.MustParse(rows[i].Istio).GreaterThan(semver.MustParse(rows[j].Istio))
+	})
+	return rows, nil
+}
+
+// resolve fills in the row of a release. It returns false for a release without istio.deps, very
+// old releases do not have it.
+func resolve(ctx context.Context, row *Row) (bool, error) {
+	deps, err := istio.GetDeps(ctx, "istio/istio", row.Istio)
+	if errors.Is(err, github.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", row.Istio, err)
+	}
+	row.ProxySHA = deps.Get("proxy").SHA
+
+	workspace, err := github.GetRaw(ctx, "istio/proxy", "WORKSPACE", row.ProxySHA)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", row.Istio, err)
+	}
+	e, err := istioproxy.EnvoyFromWorkspace(workspace)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", row.Istio, err)
+	}
+	row.EnvoyRepo = e.Org + "/" + e.Repo
+	row.EnvoySHA = e.SHA
+
+	version, err := github.GetRaw(ctx, row.EnvoyRepo, "VERSION.txt", e.SHA)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", row.Istio, err)
+	}
+	row.EnvoyVersion = strings.TrimSpace(version)
+	return true, nil
+}
+
+// FormatOf returns the format of a file name from its extension, defaults to markdown.
+func FormatOf(name string) string {
+	switch filepath.Ext(name) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	return "markdown"
+}
+
+// Write writes the rows as markdown, csv or json.
+func Write(w io.Writer, rows []Row, format string) error {
+	switch format {
+	case "markdown":
+		bw := bufio.NewWriter(w)
+		fmt.Fprintln(bw, "| "+strings.Join(header, " | ")+" |")
+		fmt.Fprintln(bw, strings.Repeat("| --- ", len(header))+"|")
+		for _, row := range rows {
+			fmt.Fprintln(bw, "| "+strings.Join(row.fields(), " | ")+" |")
+		}
+		return bw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := cw.Write(row.fields()); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+	return fmt.Errorf("unsupported format %q, supported formats: markdown, csv, json", format)
+}
+
+// Read reads rows written by Write.
+func Read(r io.Reader, format string) ([]Row, error) {
+	var rows []Row
+	switch format {
+	case "markdown":
+		scanner := bufio.NewScanner(r)
+		line := 0
+		for scanner.Scan() {
+			text := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(text, "|") {
+				continue
+			}
+			// Skip the header and the separator.
+			if line++; line <= 2 {
+				continue
+			}
+			var fields []string
+			for _, field := range strings.Split(strings.Trim(text, "|"), "|") {
+				fields = append(fields, strings.TrimSpace(field))
+			}
+			row, err := rowOf(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %q: %w", text, err)
+			}
+			rows = append(rows, row)
+		}
+		return rows, scanner.Err()
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if i == 0 {
+				continue
+			}
+			row, err := rowOf(record)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	case "json":
+		if err := json.NewDecoder(r).Decode(&rows); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported format %q, supported formats: markdown, csv, json", format)
+}
@@ -0,0 +1,95 @@
+package compat_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dio/leo/compat"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/github/githubtest"
+)
+
+func TestGenerate(t *testing.T) {
+	var depsRequests int64
+	githubtest.Use(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("ref")
+		switch r.URL.Path {
+		case "/repos/istio/istio/releases":
+			_ = json.NewEncoder(w).Encode([]github.Release{
+				{TagName: "1.22.3"}, {TagName: "1.23.0-beta.1", Prerelease: true}, {TagName: "1.21.5"}, {TagName: "1.19.10"}, {TagName: "1.0.0"},
+			})
+		case "/repos/istio/istio/contents/istio.deps":
+			atomic.AddInt64(&depsRequests, 1)
+			if ref == "1.0.0" {
+				// Very old releases do not have istio.deps.
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, `[{"repoName": "proxy", "lastStableSHA": "proxy-%s"}]`, ref)
+		case "/repos/istio/proxy/contents/WORKSPACE":
+			fmt.Fprintf(w, "ENVOY_SHA = \"envoy-%s\"\nENVOY_ORG = \"envoyproxy\"\nENVOY_REPO = \"envoy\"\n", strings.TrimPrefix(ref, "proxy-"))
+		case "/repos/envoyproxy/envoy/contents/VERSION.txt":
+			fmt.Fprintf(w, "version-of-%s\n", ref)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	existing := []compat.Row{{Istio: "1.21.5", ProxySHA: "a", EnvoyRepo: "envoyproxy/envoy", EnvoySHA: "b", EnvoyVersion: "1.29.7"}}
+	rows, err := compat.Generate(context.Background(), compat.Options{Since: "1.20", Existing: existing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []compat.Row{
+		{Istio: "1.22.3", ProxySHA: "proxy-1.22.3", EnvoyRepo: "envoyproxy/envoy", EnvoySHA: "envoy-1.22.3", EnvoyVersion: "version-of-envoy-1.22.3"},
+		existing[0],
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("Generate() = %+v, want %+v", rows, want)
+	}
+	if depsRequests != 1 {
+		t.Fatalf("istio.deps requests = %d, want 1", depsRequests)
+	}
+
+	// Without --since, the releases without istio.deps are left out.
+	rows, err = compat.Generate(context.Background(), compat.Options{Existing: existing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var istio []string
+	for _, row := range rows {
+		istio = append(istio, row.Istio)
+	}
+	if want := []string{"1.22.3", "1.21.5", "1.19.10"}; !reflect.DeepEqual(istio, want) {
+		t.Fatalf("Generate() = %v, want %v", istio, want)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	rows := []compat.Row{
+		{Istio: "1.22.3", ProxySHA: "757b63d", EnvoyRepo: "envoyproxy/envoy", EnvoySHA: "88a80e6", EnvoyVersion: "1.30.4"},
+		{Istio: "1.21.5", ProxySHA: "2e4228b", EnvoyRepo: "envoyproxy/envoy", EnvoySHA: "f34db71", EnvoyVersion: "1.29.7"},
+	}
+	for _, format := range []string{"markdown", "csv", "json"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := compat.Write(&buf, rows, format); err != nil {
+				t.Fatal(err)
+			}
+			got, err := compat.Read(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, rows) {
+				t.Fatalf("Read() = %+v, want %+v", got, rows)
+			}
+		})
+	}
+}
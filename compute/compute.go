@@ -3,16 +3,22 @@ package compute
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"time"
 
 	compute "cloud.google.com/go/compute/apiv1"
 	"cloud.google.com/go/compute/apiv1/computepb"
 	backoff "github.com/cenkalti/backoff/v4"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/protobuf/proto"
 )
 
+// ErrAlreadyExists is returned by Create when an instance with the same name exists.
+var ErrAlreadyExists = errors.New("instance already exists")
+
 type Instance struct {
 	ProjectID          string
 	ServiceAccountName string
@@ -122,6 +128,10 @@ func (i *Instance) Create(ctx context.Context, machineType, machineImage string,
 	}
 
 	op, err := instance.Insert(ctx, req)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return fmt.Errorf("%w: %s", ErrAlreadyExists, i.Name)
+	}
 	if err != nil {
 		return err
 	}
@@ -14,6 +14,10 @@ var GH_TOKEN = Var("GH_TOKEN").GetOr(fromNetrc())
 var GCLOUD_TOKEN = Var("GCLOUD_TOKEN").GetOr(fromGcloudPrintToken())
 var GCLOUD_SKIP = Var("GCLOUD_SKIP").Get()
 var GCS_BUCKET = Var("GCS_BUCKET").GetOr("tetrate-istio-subscription-build")
+var LEO_CACHE_DIR = Var("LEO_CACHE_DIR").GetOr(defaultCacheDir())
+var LEO_QUEUE = Var("LEO_QUEUE").GetOr("pubsub://")
+var LEO_SERVE_TOKEN = Var("LEO_SERVE_TOKEN").Get()
+var LEO_STORE = Var("LEO_STORE").GetOr("file://" + defaultStoreDir())
 
 type Var string
 
@@ -53,3 +57,25 @@ func fromGcloudPrintToken() string {
 	}
 	return token
 }
+
+func defaultCacheDir() string {
+	if dir := Var("XDG_CACHE_HOME").Get(); len(dir) > 0 {
+		return filepath.Join(dir, "leo")
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "leo-cache")
+	}
+	return filepath.Join(home, ".cache", "leo")
+}
+
+func defaultStoreDir() string {
+	if dir := Var("XDG_STATE_HOME").Get(); len(dir) > 0 {
+		return filepath.Join(dir, "leo", "builds")
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "leo-builds")
+	}
+	return filepath.Join(home, ".local", "state", "leo", "builds")
+}
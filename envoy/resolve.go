@@ -3,23 +3,53 @@ package envoy
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/Masterminds/semver"
 	"github.com/dio/leo/arg"
 	"github.com/dio/leo/github"
 	"github.com/dio/leo/istio"
 	"github.com/dio/leo/istioproxy"
+	"golang.org/x/sync/errgroup"
 )
 
+// Resolver finds the Istio releases whose proxy workspace uses a given envoy minor version. It
+// remembers the envoy minor version referenced by every scanned Istio ref.
+type Resolver struct {
+	// Concurrency is the number of Istio releases scanned at once, defaults to 8.
+	Concurrency int
+
+	mu         sync.Mutex
+	referenced map[string]string
+}
+
+// DefaultResolver is used by the package-level functions.
+var DefaultResolver = &Resolver{}
+
 // ResolveWorkspace returns istio version that can serve building an envoy version.
 func ResolveWorkspace(ctx context.Context, v arg.Version) (string, error) {
+	return DefaultResolver.ResolveWorkspace(ctx, v)
+}
+
+// CompatibleReleases returns every Istio release that can serve building an envoy version, newest
+// first.
+func CompatibleReleases(ctx context.Context, v arg.Version) ([]string, error) {
+	return DefaultResolver.CompatibleReleases(ctx, v)
+}
+
+// ResolveWorkspace returns the commit SHA of istio master when it uses the envoy minor version of
+// v, otherwise of the newest Istio release using it.
+func (r *Resolver) ResolveWorkspace(ctx context.Context, v arg.Version) (string, error) {
 	target, err := getVersion(ctx, v)
 	if err != nil {
 		return "", err
 	}
 
 	// Firstly, check if master can serve us.
-	master, err := getReferencedVersion(ctx, "master")
+	master, err := r.getReferencedVersion(ctx, "master")
 	if err != nil {
 		return "", err
 	}
@@ -27,29 +57,101 @@ func ResolveWorkspace(ctx context.Context, v arg.Version) (string, error) {
 		return github.ResolveCommitSHA(ctx, "istio/istio", "master")
 	}
 
-	lastPage, err := github.GetLastReleasePageNumber(ctx, "istio/istio")
+	tags, err := r.scan(ctx, target, true)
 	if err != nil {
 		return "", err
 	}
+	if len(tags) == 0 {
+		return "", fmt.Errorf("cannot resolve: no istio release uses envoy %s", target)
+	}
+	return github.ResolveCommitSHA(ctx, "istio/istio", tags[0])
+}
+
+// CompatibleReleases returns the tags of every Istio release whose proxy workspace uses the envoy
+// minor version of v, newest first.
+func (r *Resolver) CompatibleReleases(ctx context.Context, v arg.Version) ([]string, error) {
+	target, err := getVersion(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return r.scan(ctx, target, false)
+}
+
+// scan checks the Istio releases newest first, concurrently, and returns the tags referencing the
+// target envoy minor version. When first is set, it stops at the first batch having a match.
+func (r *Resolver) scan(ctx context.Context, target string, first bool) ([]string, error) {
+	tags, err := istioReleaseTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
 
-	// If not, we need to scan all releases.
-	for page := 1; page <= lastPage; page++ {
-		releases, err := github.GetReleases(ctx, "istio/istio", page)
-		if err != nil {
-			return "", err
+	var matches []string
+	for start := 0; start < len(tags); start += concurrency {
+		batch := tags[start:min(start+concurrency, len(tags))]
+		referenced := make([]string, len(batch))
+		g, gctx := errgroup.WithContext(ctx)
+		for i, tag := range batch {
+			i, tag := i, tag
+			g.Go(func() error {
+				ref, err := r.getReferencedVersion(gctx, tag)
+				if errors.Is(err, github.ErrNotFound) {
+					// Very old releases do not have istio.deps.
+					return nil
+				}
+				referenced[i] = ref
+				return err
+			})
 		}
-		for _, release := range releases {
-			ref, err := getReferencedVersion(ctx, release.TagName)
-			if err != nil {
-				return "", err
-			}
-			if target == ref {
-				return github.ResolveCommitSHA(ctx, "istio/istio", release.TagName)
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		for i, ref := range referenced {
+			if ref == target {
+				matches = append(matches, batch[i])
 			}
 		}
+		if first && len(matches) > 0 {
+			return matches[:1], nil
+		}
 	}
+	return matches, nil
+}
 
-	return "", errors.New("cannot resolve")
+// istioReleaseTags returns the istio/istio release tags, sorted by semver, newest first. Drafts and
+// prereleases, e.g. 1.22.0-rc.1, are left out.
+func istioReleaseTags(ctx context.Context) ([]string, error) {
+	releases, err := github.ListReleases(ctx, "istio/istio")
+	if err != nil {
+		return nil, err
+	}
+	type tagged struct {
+		tag     string
+		version *semver.Version
+	}
+	versions := make([]tagged, 0, len(releases))
+	for _, release := range releases {
+		if release.Draft || release.Prerelease {
+			continue
+		}
+		v, err := semver.NewVersion(release.TagName)
+		if err != nil || len(v.Prerelease()) > 0 {
+			continue
+		}
+		versions = append(versions, tagged{tag: release.TagName, version: v})
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].version.GreaterThan(versions[j].version)
+	})
+	tags := make([]string, 0, len(versions))
+	for _, v := range versions {
+		tags = append(tags, v.tag)
+	}
+	return tags, nil
 }
 
 func getVersion(ctx context.Context, v arg.Version) (string, error) {
@@ -64,7 +166,19 @@ func getVersion(ctx context.Context, v arg.Version) (string, error) {
 	return target[0:strings.LastIndex(target, ".")], nil
 }
 
-func getReferencedVersion(ctx context.Context, istioRef string) (string, error) {
+// getReferencedVersion returns the envoy minor version used by an istio ref. Tags are memoized,
+// master moves so it is not.
+func (r *Resolver) getReferencedVersion(ctx context.Context, istioRef string) (string, error) {
+	memoize := istioRef != "master"
+	if memoize {
+		r.mu.Lock()
+		ref, ok := r.referenced[istioRef]
+		r.mu.Unlock()
+		if ok {
+			return ref, nil
+		}
+	}
+
 	deps, err := istio.GetDeps(ctx, "istio/istio", istioRef)
 	if err != nil {
 		return "", err
@@ -79,5 +193,18 @@ func getReferencedVersion(ctx context.Context, istioRef string) (string, error)
 	if err != nil {
 		return "", err
 	}
-	return getVersion(ctx, arg.Version(e.Org+"/"+e.Repo+"@"+e.SHA))
+	ref, err := getVersion(ctx, arg.Version(e.Org+"/"+e.Repo+"@"+e.SHA))
+	if err != nil {
+		return "", err
+	}
+
+	if memoize {
+		r.mu.Lock()
+		if r.referenced == nil {
+			r.referenced = make(map[string]string)
+		}
+		r.referenced[istioRef] = ref
+		r.mu.Unlock()
+	}
+	return ref, nil
 }
@@ -0,0 +1,87 @@
+package envoy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dio/leo/arg"
+	"github.com/dio/leo/envoy"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/github/githubtest"
+)
+
+// envoyMinors maps an istio ref to the envoy minor version of its proxy workspace.
+var envoyMinors = map[string]string{
+	"master":      "1.31",
+	"1.22.3":      "1.30",
+	"1.22.1":      "1.30",
+	"1.22.0-rc.1": "1.30",
+	"1.21.5":      "1.29",
+	"1.20.0":      "1.28",
+}
+
+func fakeGitHub(t *testing.T) *int64 {
+	var depsRequests int64
+	githubtest.Use(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("ref")
+		switch {
+		case r.URL.Path == "/repos/istio/istio/releases":
+			var releases []github.Release
+			for _, tag := range []string{"1.21.5", "1.22.1", "1.20.0", "1.22.3", "1.22.0-rc.1"} {
+				releases = append(releases, github.Release{TagName: tag, Prerelease: strings.Contains(tag, "-")})
+			}
+			_ = json.NewEncoder(w).Encode(releases)
+		case r.URL.Path == "/repos/istio/istio/contents/istio.deps":
+			atomic.AddInt64(&depsRequests, 1)
+			fmt.Fprintf(w, `[{"repoName": "proxy", "lastStableSHA": "proxy-%s"}]`, ref)
+		case r.URL.Path == "/repos/istio/proxy/contents/WORKSPACE":
+			fmt.Fprintf(w, "ENVOY_SHA = \"envoy-%s\"\nENVOY_ORG = \"envoyproxy\"\nENVOY_REPO = \"envoy\"\n",
+				envoyMinors[strings.TrimPrefix(ref, "proxy-")])
+		case r.URL.Path == "/repos/envoyproxy/envoy/contents/VERSION.txt":
+			if ref == "wanted" {
+				fmt.Fprintln(w, "1.30.2")
+				return
+			}
+			fmt.Fprintln(w, strings.TrimPrefix(ref, "envoy-")+".0-dev")
+		case strings.HasPrefix(r.URL.Path, "/repos/istio/istio/commits/"):
+			fmt.Fprintf(w, `{"sha": "sha-%s"}`, strings.TrimPrefix(r.URL.Path, "/repos/istio/istio/commits/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return &depsRequests
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	depsRequests := fakeGitHub(t)
+	r := &envoy.Resolver{Concurrency: 2}
+
+	sha, err := r.ResolveWorkspace(context.Background(), arg.Version("envoyproxy/envoy@wanted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The newest patch of the matching minor wins.
+	if sha != "sha-1.22.3" {
+		t.Fatalf("ResolveWorkspace() = %s, want sha-1.22.3", sha)
+	}
+
+	tags, err := r.CompatibleReleases(context.Background(), arg.Version("envoyproxy/envoy@wanted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Prereleases are never a workspace.
+	if want := []string{"1.22.3", "1.22.1"}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("CompatibleReleases() = %v, want %v", tags, want)
+	}
+
+	// master is checked once by ResolveWorkspace, every release once thanks to memoization.
+	if got := atomic.LoadInt64(depsRequests); got != 5 {
+		t.Fatalf("istio.deps requests = %d, want 5", got)
+	}
+}
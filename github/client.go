@@ -0,0 +1,258 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dio/leo/cache"
+	"github.com/dio/leo/env"
+)
+
+const (
+	DefaultBaseURL = "https://api.github.com"
+	DefaultWebURL  = "https://github.com"
+
+	mediaTypeJSON = "application/vnd.github.v3.json"
+	mediaTypeRaw  = "application/vnd.github.v3.raw"
+)
+
+var (
+	// ErrNotFound is returned when GitHub responds with 404.
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when GitHub responds with 401 or 403 that is not caused by rate limiting.
+	ErrForbidden = errors.New("forbidden")
+	// ErrRateLimited is returned when GitHub rejects a request because of (primary or secondary) rate limits.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// Error is returned for every non-2xx response from GitHub.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+	// RetryAfter is the wait time suggested by GitHub through the Retry-After or
+	// X-RateLimit-Reset headers.
+	RetryAfter time.Duration
+
+	kind error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("github: %s %s: %d", e.Method, e.URL, e.StatusCode)
+	if len(e.Message) > 0 {
+		msg += " " + e.Message
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is(err, ErrNotFound) and friends.
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Client talks to the GitHub REST API over net/http. The token is only sent as a request header.
+type Client struct {
+	// BaseURL is the REST API endpoint, e.g. https://api.github.com.
+	BaseURL string
+	// WebURL is used for downloading source archives, e.g. https://github.com.
+	WebURL     string
+	Token      string
+	HTTPClient *http.Client
+	// Cache keeps raw files and source archives on disk. Nil disables caching.
+	Cache *cache.Cache
+
+	// MaxRetries is the number of retries for rate-limited, 5xx and network failures.
+	MaxRetries int
+	// RetryInterval is the initial backoff interval between retries.
+	RetryInterval time.Duration
+	// MaxRetryWait caps how long we are willing to wait for a rate limit to reset. When GitHub asks
+	// us to wait longer than this, we give up right away.
+	MaxRetryWait time.Duration
+	// MaxConcurrentRequests caps in-flight requests made by this client. Zero means unlimited.
+	MaxConcurrentRequests int
+
+	semOnce sync.Once
+	sem     chan struct{}
+}
+
+// NewClient returns a client for github.com authenticated with GH_TOKEN (when set).
+func NewClient() *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		WebURL:     DefaultWebURL,
+		Token:      env.GH_TOKEN,
+		HTTPClient: http.DefaultClient,
+		Cache:      cache.Default(),
+
+		MaxRetries:            5,
+		RetryInterval:         time.Second,
+		MaxRetryWait:          5 * time.Minute,
+		MaxConcurrentRequests: 8,
+	}
+}
+
+// DefaultClient is used by the package-level functions. Since every package in leo goes through
+// it, its MaxConcurrentRequests caps GitHub requests across the whole process.
+var DefaultClient = NewClient()
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) apiURL(p string, query url.Values) string {
+	base := c.BaseURL
+	if len(base) == 0 {
+		base = DefaultBaseURL
+	}
+	u := strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(p, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (c *Client) webURL(p string) string {
+	base := c.WebURL
+	if len(base) == 0 {
+		base = DefaultWebURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(p, "/")
+}
+
+func (c *Client) newRequest(ctx context.Context, method, u, accept string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	if len(c.Token) > 0 {
+		// Reference: https://github.com/octokit/auth-token.js/blob/902a172693d08de998250bf4d8acb1fdb22377a4/src/with-authorization-prefix.ts#L6-L12
+		req.Header.Set("Authorization", "token "+c.Token)
+	}
+	return req, nil
+}
+
+// try sends the request once and returns the response when the status code is 2xx. Otherwise, the
+// response body is consumed and a typed *Error is returned.
+func (c *Client) try(req *http.Request) (*http.Response, error) {
+	release, err := c.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		// The slot is held until the body is consumed, e.g. while downloading a tarball.
+		res.Body = &releaseOnClose{ReadCloser: res.Body, release: release}
+		return res, nil
+	}
+	defer release()
+	defer res.Body.Close()
+	return nil, newError(req, res)
+}
+
+func newError(req *http.Request, res *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	var payload struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	e := &Error{
+		Method:     req.Method,
+		URL:        req.URL.Redacted(),
+		StatusCode: res.StatusCode,
+		Message:    payload.Message,
+		RetryAfter: retryAfter(res.Header),
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		e.kind = ErrNotFound
+	case isRateLimited(res, payload.Message):
+		e.kind = ErrRateLimited
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		e.kind = ErrForbidden
+	}
+	return e
+}
+
+func isRateLimited(res *http.Response, message string) bool {
+	if res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if res.StatusCode != http.StatusForbidden {
+		return false
+	}
+	if res.Header.Get("X-RateLimit-Remaining") == "0" || len(res.Header.Get("Retry-After")) > 0 {
+		return true
+	}
+	return strings.Contains(strings.ToLower(message), "rate limit")
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, v any) (http.Header, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, u, mediaTypeJSON)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("github: failed to decode %s: %w", req.URL.Redacted(), err)
+	}
+	return res.Header, nil
+}
+
+func (c *Client) getBytes(ctx context.Context, u, accept string) ([]byte, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, u, accept)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+var linkRe = regexp.MustCompile(`<([^>]+)>;\s*rel="([^"]+)"`)
+
+// parseLink parses the "Link" response header into a map of rel to URL.
+func parseLink(header string) map[string]string {
+	links := make(map[string]string)
+	for _, match := range linkRe.FindAllStringSubmatch(header, -1) {
+		links[match[2]] = match[1]
+	}
+	return links
+}
+
+func pageOf(link string) (int, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Query().Get("page"))
+}
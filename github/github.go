@@ -1,105 +1,159 @@
 package github
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/Masterminds/semver"
-	"github.com/dio/leo/env"
-	"github.com/dio/sh"
+	"github.com/dio/leo/cache"
 )
 
 type Release struct {
-	TagName string `json:"tag_name"`
+	TagName    string `json:"tag_name"`
+	Prerelease bool   `json:"prerelease"`
+	Draft      bool   `json:"draft"`
 }
 
 func GetReleases(ctx context.Context, repo string, page int) ([]Release, error) {
-	// https://api.github.com/repos/istio/istio/releases?page=1
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/releases?page=%d", repo, page),
-	}
-	args = append(args, token()...)
-
-	out, err := sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return nil, err
-	}
+	return DefaultClient.GetReleases(ctx, repo, page)
+}
 
+func (c *Client) GetReleases(ctx context.Context, repo string, page int) ([]Release, error) {
+	// https://api.github.com/repos/istio/istio/releases?page=1
 	releases := make([]Release, 0)
-	if err := json.Unmarshal([]byte(out), &releases); err != nil {
+	_, err := c.getJSON(ctx, c.apiURL("repos/"+repo+"/releases", url.Values{
+		"page": []string{strconv.Itoa(page)},
+	}), &releases)
+	if err != nil {
 		return nil, err
 	}
 	return releases, nil
 }
 
-var (
-	pagePattern = `page=(\d+)`
-	pageRe      = regexp.MustCompile(pagePattern)
-)
+// ListReleases returns releases of all pages by following the "next" links.
+func ListReleases(ctx context.Context, repo string) ([]Release, error) {
+	return DefaultClient.ListReleases(ctx, repo)
+}
 
-func GetLastReleasePageNumber(ctx context.Context, repo string) (int, error) {
-	args := []string{
-		"-fsSLI",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/releases", repo),
+func (c *Client) ListReleases(ctx context.Context, repo string) ([]Release, error) {
+	var all []Release
+	next := c.apiURL("repos/"+repo+"/releases", url.Values{"per_page": []string{"100"}})
+	for len(next) > 0 {
+		var releases []Release
+		header, err := c.getJSON(ctx, next, &releases)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, releases...)
+		next = parseLink(header.Get("Link"))["next"]
 	}
-	args = append(args, token()...)
+	return all, nil
+}
 
-	out, err := sh.Output(ctx, "curl", args...)
+func GetLastReleasePageNumber(ctx context.Context, repo string) (int, error) {
+	return DefaultClient.GetLastReleasePageNumber(ctx, repo)
+}
+
+func (c *Client) GetLastReleasePageNumber(ctx context.Context, repo string) (int, error) {
+	var releases []Release
+	header, err := c.getJSON(ctx, c.apiURL("repos/"+repo+"/releases", nil), &releases)
 	if err != nil {
 		return 0, err
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(out))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "link:") {
-			matches := pageRe.FindAllStringSubmatch(line, -1)
-			page := matches[len(matches)-1][1]
-			return strconv.Atoi(page)
-		}
+	last, ok := parseLink(header.Get("Link"))["last"]
+	if !ok {
+		return 0, nil
 	}
-
-	return 0, nil
+	return pageOf(last)
 }
 
 func GetRaw(ctx context.Context, repo, file, ref string) (string, error) {
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.raw",
-		fmt.Sprintf("https://api.github.com/repos/%s/contents/%s?ref=%s", repo, file, ref),
+	return DefaultClient.GetRaw(ctx, repo, file, ref)
+}
+
+func (c *Client) GetRaw(ctx context.Context, repo, file, ref string) (string, error) {
+	if cached, ok := c.Cache.Get(cache.KindRaw, repo, file, ref); ok {
+		if data, err := os.ReadFile(cached); err == nil {
+			return string(data), nil
+		}
 	}
-	args = append(args, token()...)
 
-	return sh.Output(ctx, "curl", args...)
+	data, err := c.getBytes(ctx, c.apiURL("repos/"+repo+"/contents/"+file, url.Values{
+		"ref": []string{ref},
+	}), mediaTypeRaw)
+	if err != nil {
+		return "", err
+	}
+	// Match what we used to get from "curl" through sh.Output, i.e. without the trailing newline.
+	content := strings.TrimSuffix(string(data), "\n")
+	if c.Cache != nil {
+		_, _ = c.Cache.Put(cache.KindRaw, repo, file, ref, strings.NewReader(content))
+	}
+	return content, nil
 }
 
+// GetTarball downloads the source archive of repo at ref into dir. When caching is enabled, the
+// returned path points to the cached archive instead, unless it fails to be cached.
 func GetTarball(ctx context.Context, repo, ref, dir string) (string, error) {
-	_ = os.MkdirAll(dir, os.ModePerm)
-	targz := filepath.Join(dir, ref+".tar.gz")
-	args := []string{
-		"-fsSL",
-		"-o",
-		targz,
-		fmt.Sprintf("https://github.com/%s/archive/%s.tar.gz", repo, ref),
+	return DefaultClient.GetTarball(ctx, repo, ref, dir)
+}
+
+func (c *Client) GetTarball(ctx context.Context, repo, ref, dir string) (string, error) {
+	name := ref + ".tar.gz"
+	if cached, ok := c.Cache.Get(cache.KindTarball, repo, name, ref); ok {
+		return cached, nil
 	}
-	args = append(args, user()...)
 
-	if err := sh.Run(ctx, "curl", args...); err != nil {
+	res, err := c.getTarball(ctx, repo, name)
+	if err != nil {
 		return "", err
 	}
-	return targz, nil
+	if c.Cache != nil {
+		cached, err := c.Cache.Put(cache.KindTarball, repo, name, ref, res.Body)
+		_ = res.Body.Close()
+		if err == nil {
+			return cached, nil
+		}
+		// Like GetRaw, the cache is best effort, e.g. a full or read-only cache directory. The
+		// body is partially consumed, it is downloaded again into dir.
+		if res, err = c.getTarball(ctx, repo, name); err != nil {
+			return "", err
+		}
+	}
+	defer res.Body.Close()
+
+	_ = os.MkdirAll(dir, os.ModePerm)
+	targz := filepath.Join(dir, name)
+	f, err := os.Create(targz)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return targz, f.Close()
+}
+
+func (c *Client) getTarball(ctx context.Context, repo, name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.webURL(repo+"/archive/"+name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Token) > 0 {
+		req.SetBasicAuth("", c.Token)
+	}
+	return c.do(req)
 }
 
 type Ref struct {
@@ -134,36 +188,42 @@ type PathContents struct {
 type PathContentsList []PathContents
 
 func WorkflowRuns(ctx context.Context, repo, status string) (int, error) {
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/actions/runs?status=%s", repo, status),
-	}
-	args = append(args, token()...)
+	return DefaultClient.WorkflowRuns(ctx, repo, status)
+}
 
-	out, err := sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return 0, err
-	}
+func (c *Client) WorkflowRuns(ctx context.Context, repo, status string) (int, error) {
 	var r Runs
-	if err := json.Unmarshal([]byte(out), &r); err != nil {
+	if _, err := c.getJSON(ctx, c.apiURL("repos/"+repo+"/actions/runs", url.Values{
+		"status": []string{status},
+	}), &r); err != nil {
 		return 0, err
 	}
 	return r.Count, nil
 }
 
 func ResolveCommitSHA(ctx context.Context, repo, ref string) (string, error) {
+	return DefaultClient.ResolveCommitSHA(ctx, repo, ref)
+}
+
+func (c *Client) ResolveCommitSHA(ctx context.Context, repo, ref string) (string, error) {
 	// Check if the given ref is from commits
-	sha, err := getCommit(ctx, repo, ref)
+	sha, err := c.getCommit(ctx, repo, ref)
 	if err == nil {
 		return sha, nil
 	}
+	// Only a missing ref is worth another lookup, e.g. a rate limit fails the resolution.
+	if !isNotFound(err) {
+		return "", err
+	}
 
 	// Check if the given ref is a "head" (i.e. branch).
-	sha, err = GetRefSHA(ctx, repo, ref, "heads")
+	sha, err = c.GetRefSHA(ctx, repo, ref, "heads")
 	if err == nil {
 		return sha, nil
 	}
+	if !isNotFound(err) {
+		return "", err
+	}
 
 	// If not, we check if it is a commit SHA.
 	// TODO(dio): Validate commit SHA.
@@ -172,42 +232,32 @@ func ResolveCommitSHA(ctx context.Context, repo, ref string) (string, error) {
 	}
 
 	// Since this is a valid semver, we check it as a tag.
-	return GetRefSHA(ctx, repo, ref, "tags")
+	return c.GetRefSHA(ctx, repo, ref, "tags")
 }
 
-func getCommit(ctx context.Context, repo, ref string) (string, error) {
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/commits/%s", repo, ref),
-	}
-	args = append(args, token()...)
+// isNotFound tells whether a lookup failed because the ref does not exist. GitHub responds to an
+// unknown commit with 422 instead of 404.
+func isNotFound(err error) bool {
+	var ghErr *Error
+	return errors.Is(err, ErrNotFound) ||
+		(errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnprocessableEntity)
+}
 
-	out, err := sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return "", err
-	}
+func (c *Client) getCommit(ctx context.Context, repo, ref string) (string, error) {
 	var r RefObject
-	if err := json.Unmarshal([]byte(out), &r); err != nil {
+	if _, err := c.getJSON(ctx, c.apiURL("repos/"+repo+"/commits/"+ref, nil), &r); err != nil {
 		return "", err
 	}
 	return r.SHA, nil
 }
 
 func GetRefSHA(ctx context.Context, repo, ref, refType string) (string, error) {
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/git/ref/%s/%s", repo, refType, ref),
-	}
-	args = append(args, token()...)
+	return DefaultClient.GetRefSHA(ctx, repo, ref, refType)
+}
 
-	out, err := sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return "", err
-	}
+func (c *Client) GetRefSHA(ctx context.Context, repo, ref, refType string) (string, error) {
 	var r Ref
-	if err := json.Unmarshal([]byte(out), &r); err != nil {
+	if _, err := c.getJSON(ctx, c.apiURL(fmt.Sprintf("repos/%s/git/ref/%s/%s", repo, refType, ref), nil), &r); err != nil {
 		return "", err
 	}
 
@@ -216,68 +266,46 @@ func GetRefSHA(ctx context.Context, repo, ref, refType string) (string, error) {
 	}
 
 	// When the refType is tags, we need to resolve it once again IF it is not a commit.
-	args = []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/commits/%s", repo, r.Object.SHA),
-	}
-	args = append(args, token()...)
-	out, err = sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return "", err
-	}
-	if err := json.Unmarshal([]byte(out), &r); err == nil {
-		return r.Object.SHA, err
-	}
-
-	args = []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/git/tags/%s", repo, r.Object.SHA),
-	}
-	args = append(args, token()...)
-
-	out, err = sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return "", err
+	if _, err := c.getCommit(ctx, repo, r.Object.SHA); err == nil {
+		return r.Object.SHA, nil
 	}
 
-	if err := json.Unmarshal([]byte(out), &r); err != nil {
+	// An annotated tag, the tag object points to the commit.
+	var tag Ref
+	if _, err := c.getJSON(ctx, c.apiURL(fmt.Sprintf("repos/%s/git/tags/%s", repo, r.Object.SHA), nil), &tag); err != nil {
 		return "", err
 	}
-	return r.Object.SHA, nil
+	return tag.Object.SHA, nil
 }
 
 // GetNewerRelease gets release newer than version (patch, minor, or major).
 func GetNewerMinorRelease(ctx context.Context, version string) (string, error) {
+	return DefaultClient.GetNewerMinorRelease(ctx, version)
+}
+
+func (c *Client) GetNewerMinorRelease(ctx context.Context, version string) (string, error) {
 	v, err := semver.NewVersion(version)
 	if err != nil {
 		return "", err
 	}
 
-	lastPage, err := GetLastReleasePageNumber(ctx, "istio/istio")
+	releases, err := c.ListReleases(ctx, "istio/istio")
 	if err != nil {
 		return "", err
 	}
 
-	for page := 1; page <= lastPage; page++ {
-		releases, err := GetReleases(ctx, "istio/istio", page)
+	for _, release := range releases {
+		if strings.Contains(release.TagName, "-") {
+			continue
+		}
+
+		r, err := semver.NewVersion(release.TagName)
 		if err != nil {
 			return "", err
 		}
-		for _, release := range releases {
-			if strings.Contains(release.TagName, "-") {
-				continue
-			}
-
-			r, err := semver.NewVersion(release.TagName)
-			if err != nil {
-				return "", err
-			}
-
-			if r.Minor() > v.Minor() {
-				return release.TagName, nil
-			}
+
+		if r.Minor() > v.Minor() {
+			return release.TagName, nil
 		}
 	}
 	return "", errors.New("not found")
@@ -285,64 +313,96 @@ func GetNewerMinorRelease(ctx context.Context, version string) (string, error) {
 
 // GetNewerRelease gets release newer than version (patch, minor, or major).
 func GetNewerPatchRelease(ctx context.Context, version string) (string, error) {
+	return DefaultClient.GetNewerPatchRelease(ctx, version)
+}
+
+func (c *Client) GetNewerPatchRelease(ctx context.Context, version string) (string, error) {
 	v, err := semver.NewVersion(version)
 	if err != nil {
 		return "", err
 	}
 	majorMinor := fmt.Sprintf("%d.%d", v.Major(), v.Minor())
 
-	lastPage, err := GetLastReleasePageNumber(ctx, "istio/istio")
+	releases, err := c.ListReleases(ctx, "istio/istio")
 	if err != nil {
 		return "", err
 	}
 
-	for page := 1; page <= lastPage; page++ {
-		releases, err := GetReleases(ctx, "istio/istio", page)
+	for _, release := range releases {
+		if strings.Contains(release.TagName, "-") {
+			continue
+		}
+
+		if !strings.HasPrefix(release.TagName, majorMinor) {
+			continue
+		}
+
+		r, err := semver.NewVersion(release.TagName)
 		if err != nil {
 			return "", err
 		}
-		for _, release := range releases {
-			if strings.Contains(release.TagName, "-") {
-				continue
-			}
-
-			if !strings.HasPrefix(release.TagName, majorMinor) {
-				continue
-			}
-
-			r, err := semver.NewVersion(release.TagName)
-			if err != nil {
-				return "", err
-			}
-
-			if r.Patch() > v.Patch() {
-				return release.TagName, nil
-			}
+
+		if r.Patch() > v.Patch() {
+			return release.TagName, nil
 		}
 	}
 	return "", errors.New("not found")
 }
 
+// LatestPatchRelease returns the newest release tag of a minor version, e.g. 1.22.3 for 1.22.
+// Prereleases are only considered when prereleases is set.
+func LatestPatchRelease(ctx context.Context, repo, minor string, prereleases bool) (string, error) {
+	return DefaultClient.LatestPatchRelease(ctx, repo, minor, prereleases)
+}
+
+func (c *Client) LatestPatchRelease(ctx context.Context, repo, minor string, prereleases bool) (string, error) {
+	m, err := semver.NewVersion(minor)
+	if err != nil {
+		return "", err
+	}
+
+	releases, err := c.ListReleases(ctx, repo)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *semver.Version
+	var tag string
+	for _, release := range releases {
+		if release.Draft || (release.Prerelease && !prereleases) {
+			continue
+		}
+		r, err := semver.NewVersion(release.TagName)
+		if err != nil || r.Major() != m.Major() || r.Minor() != m.Minor() {
+			continue
+		}
+		if len(r.Prerelease()) > 0 && !prereleases {
+			continue
+		}
+		if latest == nil || r.GreaterThan(latest) {
+			latest, tag = r, release.TagName
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("no %s release of %s: %w", repo, minor, ErrNotFound)
+	}
+	return tag, nil
+}
+
 func GetPatchList(ctx context.Context, repo, ref, patchDir, prefix string) ([]string, error) {
-	refQuery := ""
+	return DefaultClient.GetPatchList(ctx, repo, ref, patchDir, prefix)
+}
+
+func (c *Client) GetPatchList(ctx context.Context, repo, ref, patchDir, prefix string) ([]string, error) {
+	query := url.Values{}
 	if len(ref) > 0 {
-		refQuery = fmt.Sprintf("ref=%s", ref)
+		query.Set("ref", ref)
 	}
-	args := []string{
-		"-fsSL",
-		"-H", "Accept: application/vnd.github.v3.json",
-		fmt.Sprintf("https://api.github.com/repos/%s/contents/%s?%s", repo, patchDir, refQuery),
-	}
-	args = append(args, token()...)
 
 	var r []string
 
-	out, err := sh.Output(ctx, "curl", args...)
-	if err != nil {
-		return r, err
-	}
 	var list PathContentsList
-	if err := json.Unmarshal([]byte(out), &list); err != nil {
+	if _, err := c.getJSON(ctx, c.apiURL("repos/"+repo+"/contents/"+patchDir, query), &list); err != nil {
 		return r, err
 	}
 
@@ -359,26 +419,3 @@ func GetPatchList(ctx context.Context, repo, ref, patchDir, prefix string) ([]st
 
 	return r, nil
 }
-
-func token() []string {
-	val := env.GH_TOKEN
-	if len(val) > 0 {
-		return []string{
-			"-H",
-			// Reference: https://github.com/octokit/auth-token.js/blob/902a172693d08de998250bf4d8acb1fdb22377a4/src/with-authorization-prefix.ts#L6-L12
-			fmt.Sprintf("Authorization: token %s", val),
-		}
-	}
-	return []string{}
-}
-
-func user() []string {
-	val := env.GH_TOKEN
-	if len(val) > 0 {
-		return []string{
-			"-u",
-			fmt.Sprintf(":%s", val),
-		}
-	}
-	return []string{}
-}
@@ -0,0 +1,306 @@
+package github_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/cache"
+	"github.com/dio/leo/github"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *github.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &github.Client{
+		BaseURL:    srv.URL,
+		WebURL:     srv.URL,
+		Token:      "secret",
+		HTTPClient: srv.Client(),
+
+		MaxRetries:            2,
+		RetryInterval:         time.Millisecond,
+		MaxConcurrentRequests: 1,
+	}
+}
+
+func TestGetRaw(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/envoyproxy/envoy/contents/VERSION.txt" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("ref") != "abc" {
+			t.Errorf("unexpected ref %s", r.URL.Query().Get("ref"))
+		}
+		if r.Header.Get("Authorization") != "token secret" {
+			t.Errorf("unexpected authorization header %q", r.Header.Get("Authorization"))
+		}
+		fmt.Fprintln(w, "1.29.1-dev")
+	})
+
+	got, err := c.GetRaw(context.Background(), "envoyproxy/envoy", "VERSION.txt", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1.29.1-dev" {
+		t.Fatalf("GetRaw() = %q", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    error
+	}{
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			},
+			want: github.ErrNotFound,
+		},
+		{
+			name: "forbidden",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message":"Resource not accessible"}`, http.StatusForbidden)
+			},
+			want: github.ErrForbidden,
+		},
+		{
+			name: "rate limited",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusForbidden)
+			},
+			want: github.ErrRateLimited,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.handler)
+			_, err := c.GetRaw(context.Background(), "istio/istio", "istio.deps", "master")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("GetRaw() error = %v, want %v", err, tt.want)
+			}
+			var ghErr *github.Error
+			if !errors.As(err, &ghErr) {
+				t.Fatalf("GetRaw() error is not *github.Error")
+			}
+		})
+	}
+}
+
+func TestListReleases(t *testing.T) {
+	var c *github.Client
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/istio/istio/releases?page=2>; rel="next", <%s/repos/istio/istio/releases?page=2>; rel="last"`, c.BaseURL, c.BaseURL))
+			fmt.Fprint(w, `[{"tag_name":"1.22.1"},{"tag_name":"1.22.0"}]`)
+		case "2":
+			fmt.Fprint(w, `[{"tag_name":"1.21.3"}]`)
+		}
+	})
+
+	releases, err := c.ListReleases(context.Background(), "istio/istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 3 || releases[2].TagName != "1.21.3" {
+		t.Fatalf("ListReleases() = %v", releases)
+	}
+
+	last, err := c.GetLastReleasePageNumber(context.Background(), "istio/istio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 2 {
+		t.Fatalf("GetLastReleasePageNumber() = %d", last)
+	}
+}
+
+func TestLatestPatchRelease(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"tag_name":"1.23.0"},{"tag_name":"1.22.4-rc.0","prerelease":true},{"tag_name":"1.22.3"},{"tag_name":"1.22.10"},{"tag_name":"1.22.11","draft":true},{"tag_name":"1.24.0-beta.1","prerelease":true}]`)
+	})
+
+	tests := []struct {
+		minor       string
+		prereleases bool
+		want        string
+	}{
+		{minor: "1.22", want: "1.22.10"},
+		{minor: "1.22", prereleases: true, want: "1.22.10"},
+		{minor: "1.23", want: "1.23.0"},
+		{minor: "1.24", prereleases: true, want: "1.24.0-beta.1"},
+	}
+	for _, tt := range tests {
+		got, err := c.LatestPatchRelease(context.Background(), "istio/istio", tt.minor, tt.prereleases)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("LatestPatchRelease(%s, %v) = %s, want %s", tt.minor, tt.prereleases, got, tt.want)
+		}
+	}
+	if _, err := c.LatestPatchRelease(context.Background(), "istio/istio", "1.24", false); !errors.Is(err, github.ErrNotFound) {
+		t.Fatalf("LatestPatchRelease() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestResolveCommitSHAAnnotatedTag(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/istio/istio/git/ref/tags/1.22.0":
+			fmt.Fprint(w, `{"object":{"sha":"tagobject"}}`)
+		case "/repos/istio/istio/git/tags/tagobject":
+			fmt.Fprint(w, `{"object":{"sha":"commitsha"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	sha, err := c.ResolveCommitSHA(context.Background(), "istio/istio", "1.22.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != "commitsha" {
+		t.Fatalf("ResolveCommitSHA() = %s", sha)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"message":"You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	got, err := c.GetRaw(context.Background(), "istio/istio", "istio.deps", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ok" || calls.Load() != 3 {
+		t.Fatalf("GetRaw() = %q after %d calls", got, calls.Load())
+	}
+}
+
+func TestRetryGiveUp(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, `{"message":"Server Error"}`, http.StatusBadGateway)
+	})
+
+	_, err := c.GetRaw(context.Background(), "istio/istio", "istio.deps", "master")
+	var retryErr *github.RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("GetRaw() error = %v, want *github.RetryError", err)
+	}
+	if retryErr.Attempts != 3 || calls.Load() != 3 {
+		t.Fatalf("attempts = %d, calls = %d", retryErr.Attempts, calls.Load())
+	}
+}
+
+func TestResolveCommitSHAErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+		// err checks the error, a nil err expects none.
+		err func(error) bool
+	}{
+		{
+			name: "branch",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/repos/istio/istio/git/ref/heads/master" {
+					fmt.Fprint(w, `{"object":{"sha":"branchsha"}}`)
+					return
+				}
+				http.Error(w, `{"message":"No commit found for SHA: master"}`, http.StatusUnprocessableEntity)
+			},
+			want: "branchsha",
+		},
+		{
+			name:    "commit sha",
+			handler: http.NotFound,
+			want:    "master",
+		},
+		{
+			name: "rate limited",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message":"API rate limit exceeded"}`, http.StatusTooManyRequests)
+			},
+			err: func(err error) bool { return errors.Is(err, github.ErrRateLimited) },
+		},
+		{
+			name: "server error on heads",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/repos/istio/istio/git/ref/heads/master" {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				http.NotFound(w, r)
+			},
+			err: func(err error) bool {
+				var retryErr *github.RetryError
+				return errors.As(err, &retryErr)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.handler)
+			sha, err := c.ResolveCommitSHA(context.Background(), "istio/istio", "master")
+			if tt.err == nil {
+				if err != nil || sha != tt.want {
+					t.Fatalf("ResolveCommitSHA() = %q, %v, want %q", sha, err, tt.want)
+				}
+				return
+			}
+			if !tt.err(err) {
+				t.Fatalf("ResolveCommitSHA() = %q, unexpected error %v", sha, err)
+			}
+		})
+	}
+}
+
+func TestGetTarballCacheFailure(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprint(w, "tarball")
+	})
+	// A file as the cache directory makes every Put fail.
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.Cache = &cache.Cache{Dir: notDir, TTL: time.Hour}
+
+	dir := t.TempDir()
+	got, err := c.GetTarball(context.Background(), "envoyproxy/envoy", "abc", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(got) != dir || string(data) != "tarball" || calls.Load() != 2 {
+		t.Fatalf("GetTarball() = %s with %q after %d calls", got, data, calls.Load())
+	}
+}
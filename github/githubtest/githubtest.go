@@ -0,0 +1,27 @@
+package githubtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/github"
+)
+
+// Use makes github.DefaultClient talk to handler, for both the API and the web URLs, until t ends.
+func Use(t testing.TB, handler http.Handler) *github.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	defaultClient := github.DefaultClient
+	github.DefaultClient = &github.Client{
+		BaseURL:       srv.URL,
+		WebURL:        srv.URL,
+		HTTPClient:    srv.Client(),
+		RetryInterval: time.Millisecond,
+	}
+	t.Cleanup(func() { github.DefaultClient = defaultClient })
+	return github.DefaultClient
+}
@@ -0,0 +1,139 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// RetryError is returned when a request still fails after all retries.
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("github: giving up after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// do sends the request, retrying with backoff on rate limits, 5xx and network failures. When GitHub
+// tells us how long to wait (Retry-After or X-RateLimit-Reset), we wait at least that long.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	b := backoff.WithContext(backoff.WithMaxRetries(c.backOff(), uint64(max(c.MaxRetries, 0))), ctx)
+
+	for attempt := 1; ; attempt++ {
+		res, err := c.try(req)
+		if err == nil {
+			return res, nil
+		}
+		if !retryable(err) {
+			return nil, err
+		}
+
+		wait := b.NextBackOff()
+		if wait == backoff.Stop {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, &RetryError{Attempts: attempt, Err: err}
+		}
+		var ghErr *Error
+		if errors.As(err, &ghErr) && ghErr.RetryAfter > wait {
+			if c.MaxRetryWait > 0 && ghErr.RetryAfter > c.MaxRetryWait {
+				return nil, &RetryError{Attempts: attempt, Err: err}
+			}
+			wait = ghErr.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) backOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	if c.RetryInterval > 0 {
+		b.InitialInterval = c.RetryInterval
+	}
+	// The number of retries is bounded by MaxRetries instead.
+	b.MaxElapsedTime = 0
+	b.Reset()
+	return b
+}
+
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ghErr *Error
+	if errors.As(err, &ghErr) {
+		return errors.Is(err, ErrRateLimited) || ghErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryAfter(header http.Header) time.Duration {
+	if val := header.Get("Retry-After"); len(val) > 0 {
+		if secs, err := strconv.Atoi(val); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if at, err := http.ParseTime(val); err == nil {
+			return time.Until(at)
+		}
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0))
+		}
+	}
+	return 0
+}
+
+// acquire takes a slot from the client-wide semaphore, the returned func gives it back.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	if c.MaxConcurrentRequests <= 0 {
+		return func() {}, nil
+	}
+	c.semOnce.Do(func() {
+		c.sem = make(chan struct{}, c.MaxConcurrentRequests)
+	})
+	select {
+	case c.sem <- struct{}{}:
+		return func() { <-c.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    bool
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	if !r.once {
+		r.once = true
+		r.release()
+	}
+	return err
+}
@@ -278,6 +278,27 @@ func buildConfigFlags(proxyDir string, gperftools, debug bool) (string, error) {
 	return "--config=release --config=libc++" + setHostActionEnvCompiler, nil
 }
 
+// TarballName returns the name of the tarball produced by a make target.
+func TarballName(target, arch string, fipsBuild, cryptoUpdateStream, debug bool) string {
+	var targzSuffix string
+	if fipsBuild && cryptoUpdateStream {
+		targzSuffix = "-crypto-updatestream"
+	} else if fipsBuild {
+		targzSuffix = "-fips"
+	}
+
+	switch target {
+	case "istio-proxy":
+		if debug {
+			return "istio-proxy-debug-" + arch + ".tar.gz"
+		}
+	case "envoy-centos7":
+		// envoy-centos7 produces the same tarball name as envoy.
+		target = "envoy"
+	}
+	return target + targzSuffix + "-" + arch + ".tar.gz"
+}
+
 func IstioProxyCentos7Target(opts TargetOptions) (string, error) {
 	target, binaryPath, err := istioProxyEnvoyBinaryTarget(opts.ProxyDir)
 	if err != nil {
@@ -305,13 +326,7 @@ func IstioProxyCentos7Target(opts TargetOptions) (string, error) {
 		ldLibraryPath = "--action_env=LD_LIBRARY_PATH=/opt/llvm/lib/x86_64-unknown-linux-gnu --host_action_env=LD_LIBRARY_PATH=/opt/llvm/lib/x86_64-unknown-linux-gnu"
 	}
 
-	var targzSuffix string
-	if opts.FIPSBuild && opts.CryptoUpdateStream {
-		targzSuffix = "-crypto-updatestream"
-	} else if opts.FIPSBuild {
-		targzSuffix = "-fips"
-	}
-	targz := "istio-proxy-centos7" + targzSuffix + "-" + runtime.GOARCH + ".tar.gz"
+	targz := TarballName("istio-proxy-centos7", runtime.GOARCH, opts.FIPSBuild, opts.CryptoUpdateStream, opts.Debug)
 	content := `
 istio-proxy-centos7-status:
 	cp -f bazel/bazel_get_workspace_status_istio-proxy bazel/bazel_get_workspace_status
@@ -370,13 +385,7 @@ func IstioProxyTarget(opts TargetOptions) (string, error) {
 `
 	}
 
-	var targzSuffix string
-	if opts.FIPSBuild && opts.CryptoUpdateStream {
-		targzSuffix = "-crypto-updatestream"
-	} else if opts.FIPSBuild {
-		targzSuffix = "-fips"
-	}
-	targz := "istio-proxy" + targzSuffix + "-" + runtime.GOARCH + ".tar.gz"
+	targz := TarballName("istio-proxy", runtime.GOARCH, opts.FIPSBuild, opts.CryptoUpdateStream, opts.Debug)
 	content := `
 istio-proxy-status:
 	cp -f bazel/bazel_get_workspace_status_istio-proxy bazel/bazel_get_workspace_status
@@ -389,10 +398,6 @@ istio-proxy: istio-proxy-status %s
 	rm -fr /work/out/usr
 %s
 `
-	if opts.Debug {
-		targz = "istio-proxy-debug-" + runtime.GOARCH + ".tar.gz"
-	}
-
 	if opts.Wasm && len(wasmTarget) > 0 {
 		content += buildWasmTarget(filepath.Join(opts.ProxyDir, "Makefile.core.mk"), strings.Replace(opts.EnvoyDir, opts.ProxyDir, "", 1))
 	}
@@ -438,13 +443,7 @@ func EnvoyTarget(opts TargetOptions) (string, error) {
 		ldLibraryPath = "--action_env=LD_LIBRARY_PATH=/usr/lib/llvm/lib/x86_64-unknown-linux-gnu --host_action_env=LD_LIBRARY_PATH=/usr/lib/llvm/lib/x86_64-unknown-linux-gnu"
 	}
 
-	var targzSuffix string
-	if opts.FIPSBuild && opts.CryptoUpdateStream {
-		targzSuffix = "-crypto-updatestream"
-	} else if opts.FIPSBuild {
-		targzSuffix = "-fips"
-	}
-	targz := "envoy" + targzSuffix + "-" + runtime.GOARCH + ".tar.gz"
+	targz := TarballName("envoy", runtime.GOARCH, opts.FIPSBuild, opts.CryptoUpdateStream, opts.Debug)
 	content := `
 envoy-status:
 	cp -f bazel/bazel_get_workspace_status_envoy bazel/bazel_get_workspace_status
@@ -500,13 +499,7 @@ func EnvoyCentos7Target(opts TargetOptions) (string, error) {
 		ldLibraryPath = "--action_env=LD_LIBRARY_PATH=/usr/lib/llvm/lib/x86_64-unknown-linux-gnu --host_action_env=LD_LIBRARY_PATH=/usr/lib/llvm/lib/x86_64-unknown-linux-gnu"
 	}
 
-	var targzSuffix string
-	if opts.FIPSBuild && opts.CryptoUpdateStream {
-		targzSuffix = "-crypto-updatestream"
-	} else if opts.FIPSBuild {
-		targzSuffix = "-fips"
-	}
-	targz := "envoy" + targzSuffix + "-" + runtime.GOARCH + ".tar.gz"
+	targz := TarballName("envoy-centos7", runtime.GOARCH, opts.FIPSBuild, opts.CryptoUpdateStream, opts.Debug)
 	content := `
 envoy-centos7-status:
 	cp -f bazel/bazel_get_workspace_status_envoy bazel/bazel_get_workspace_status
@@ -560,13 +553,7 @@ func EnvoyContribTarget(opts TargetOptions) (string, error) {
 
 	// TODO(dio): Allow to disable some contrib extenstions, since it is problematic with clang-12.
 
-	var targzSuffix string
-	if opts.FIPSBuild && opts.CryptoUpdateStream {
-		targzSuffix = "-crypto-updatestream"
-	} else if opts.FIPSBuild {
-		targzSuffix = "-fips"
-	}
-	targz := "envoy-contrib" + targzSuffix + "-" + runtime.GOARCH + ".tar.gz"
+	targz := TarballName("envoy-contrib", runtime.GOARCH, opts.FIPSBuild, opts.CryptoUpdateStream, opts.Debug)
 	content := `
 envoy-contrib-status:
 	cp -f bazel/bazel_get_workspace_status_envoy-contrib bazel/bazel_get_workspace_status
@@ -6,6 +6,8 @@ import (
 	"os"
 	"strings"
 	"testing"
+
+	"github.com/dio/leo/istioproxy"
 )
 
 func TestExtractBuildWasm(t *testing.T) {
@@ -29,3 +31,26 @@ func TestExtractBuildWasm(t *testing.T) {
 	target = strings.ReplaceAll(target, "$(BAZEL_BUILD_ARGS)", "$(BAZEL_BUILD_ARGS) --override_repository=envoy=/work/envoy-2e4228b0ee73ae640c92e0974c91e251997a3d2f")
 	fmt.Println(target)
 }
+
+func TestTarballName(t *testing.T) {
+	tests := []struct {
+		target                        string
+		fips, cryptoUpdateStream, dbg bool
+		expected                      string
+	}{
+		{target: "istio-proxy", expected: "istio-proxy-arm64.tar.gz"},
+		{target: "istio-proxy", fips: true, expected: "istio-proxy-fips-arm64.tar.gz"},
+		{target: "istio-proxy", fips: true, cryptoUpdateStream: true, expected: "istio-proxy-crypto-updatestream-arm64.tar.gz"},
+		{target: "istio-proxy", fips: true, dbg: true, expected: "istio-proxy-debug-arm64.tar.gz"},
+		{target: "istio-proxy-centos7", fips: true, expected: "istio-proxy-centos7-fips-arm64.tar.gz"},
+		{target: "envoy", dbg: true, expected: "envoy-arm64.tar.gz"},
+		{target: "envoy-centos7", fips: true, expected: "envoy-fips-arm64.tar.gz"},
+		{target: "envoy-contrib", expected: "envoy-contrib-arm64.tar.gz"},
+	}
+
+	for _, tt := range tests {
+		if got := istioproxy.TarballName(tt.target, "arm64", tt.fips, tt.cryptoUpdateStream, tt.dbg); got != tt.expected {
+			t.Errorf("TarballName(%s) = %v, want %v", tt.target, got, tt.expected)
+		}
+	}
+}
@@ -2,25 +2,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/dio/leo/arg"
 	"github.com/dio/leo/build"
+	"github.com/dio/leo/cache"
+	"github.com/dio/leo/compat"
 	"github.com/dio/leo/compute"
+	"github.com/dio/leo/env"
 	"github.com/dio/leo/envoy"
+	"github.com/dio/leo/pipeline"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/server"
+	"github.com/dio/leo/store"
+	"github.com/dio/leo/watch"
+	"github.com/dio/leo/worker"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 var (
+	queueURL string
+	storeURL string
+
 	rootCmd = &cobra.Command{
 		Use:   "leo <command> [flags]",
 		Short: "Your artifacts builder",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			q, err := queue.Open(queueURL)
+			if err != nil {
+				return err
+			}
+			queue.Default = q
+			return nil
+		},
 	}
 
 	zone               string
@@ -101,20 +126,44 @@ var (
 		},
 	}
 
+	resolveAll  bool
+	prereleases bool
+
 	resolveCmd = &cobra.Command{
 		Use:   "resolve [flags]",
-		Short: "Resolve workspace from a reference",
+		Short: "Resolve the dependency chain of istio and istio/proxy references, or the workspace of an envoy reference",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			v := arg.Version(args[0])
 			r := arg.Repo(v.Name())
 			switch r.Name() {
+			case "istio", "proxy", "tetrateio-proxy":
+				chain, err := build.ResolveChain(cmd.Context(), args[0], prereleases)
+				if err != nil {
+					return err
+				}
+				if format == "text" {
+					return chain.WriteText(os.Stdout)
+				}
+				return printFormatted(chain, format)
 			case "envoy":
+				if resolveAll {
+					tags, err := envoy.CompatibleReleases(cmd.Context(), v)
+					if err != nil {
+						return err
+					}
+					for _, tag := range tags {
+						fmt.Println(tag)
+					}
+					return nil
+				}
 				target, err := envoy.ResolveWorkspace(cmd.Context(), v)
 				if err != nil {
 					return err
 				}
 				fmt.Print(target)
+			default:
+				return fmt.Errorf("unsupported reference %q, supported references: istio@<ref>, istio/proxy@<ref>, tetrateio-proxy@<ref>, envoyproxy/envoy@<ref>", args[0])
 			}
 			return nil
 		},
@@ -139,6 +188,10 @@ var (
 	repo                     string
 	dir                      string
 	patchSuffix              string
+	format                   string
+	contextFile              string
+	lockFile                 string
+	frozen                   bool
 
 	proxyCmd = &cobra.Command{
 		Use:   "proxy <command> [flags]",
@@ -150,16 +203,23 @@ var (
 		Short: "Proxy build info",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			builder, err := build.NewProxyBuilder(args[0],
-				overrideIstioProxy, overrideEnvoy,
-				patchSource, patchSourceName,
-				remoteCache, patchSuffix, dynamicModulesBuild,
-				additionalPatchDir, additionalPatchDirSource,
-				fipsBuild, cryptoUpdateStream, wasm, gperftools, debug, nil)
+			builder, err := build.New(proxySpec(args[0], &build.Output{
+				Target: target,
+				Arch:   arch,
+				Repo:   repo,
+				Debug:  debug,
+			}))
+			if err != nil {
+				return err
+			}
+			if format == "text" {
+				return builder.Info(cmd.Context())
+			}
+			desc, err := builder.Describe(cmd.Context())
 			if err != nil {
 				return err
 			}
-			return builder.Info(cmd.Context())
+			return printFormatted(desc, format)
 		},
 	}
 
@@ -168,19 +228,26 @@ var (
 		Short: "Proxy build output",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			builder, err := build.NewProxyBuilder(args[0],
-				overrideIstioProxy, overrideEnvoy,
-				patchSource, patchSourceName,
-				remoteCache, patchSuffix, dynamicModulesBuild,
-				additionalPatchDir, additionalPatchDirSource,
-				fipsBuild, cryptoUpdateStream, wasm, gperftools, debug, &build.Output{
-					Target: target,
-					Arch:   arch,
-				})
+			builder, err := build.New(proxySpec(args[0], &build.Output{
+				Target: target,
+				Arch:   arch,
+				Repo:   repo,
+				Debug:  debug,
+			}))
 			if err != nil {
 				return err
 			}
-			return builder.Output(cmd.Context())
+			if err := useContext(builder); err != nil {
+				return err
+			}
+			if format == "text" {
+				return builder.Output(cmd.Context())
+			}
+			desc, err := builder.Describe(cmd.Context())
+			if err != nil {
+				return err
+			}
+			return printFormatted(desc, format)
 		},
 	}
 
@@ -189,21 +256,19 @@ var (
 		Short: "Proxy release",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			builder, err := build.NewProxyBuilder(args[0],
-				overrideIstioProxy, overrideEnvoy,
-				patchSource, patchSourceName,
-				remoteCache, patchSuffix, dynamicModulesBuild,
-				additionalPatchDir, additionalPatchDirSource,
-				fipsBuild, cryptoUpdateStream, wasm, gperftools, debug, &build.Output{
-					Target: target,
-					Arch:   arch,
-					Repo:   repo,
-					Dir:    dir,
-					Debug:  debug,
-				})
+			builder, err := build.New(proxySpec(args[0], &build.Output{
+				Target: target,
+				Arch:   arch,
+				Repo:   repo,
+				Dir:    dir,
+				Debug:  debug,
+			}))
 			if err != nil {
 				return err
 			}
+			if err := useContext(builder); err != nil {
+				return err
+			}
 			return builder.Release(cmd.Context())
 		},
 	}
@@ -213,16 +278,441 @@ var (
 		Short: "Build proxy based-on flavors",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			builder, err := build.NewProxyBuilder(args[0],
-				overrideIstioProxy, overrideEnvoy,
-				patchSource, patchSourceName,
-				remoteCache, patchSuffix, dynamicModulesBuild,
-				additionalPatchDir, additionalPatchDirSource,
-				fipsBuild, cryptoUpdateStream, wasm, gperftools, debug, nil)
+			builder, err := build.New(proxySpec(args[0], nil))
+			if err != nil {
+				return err
+			}
+			if frozen && len(lockFile) == 0 {
+				return errors.New("--frozen requires --lock")
+			}
+			if len(lockFile) > 0 {
+				builder.UseLock(&build.LockOptions{File: lockFile, Frozen: frozen})
+			}
+			return recordBuild(cmd.Context(), "", builder.Spec(), func(phases func(build.Phase)) error {
+				builder.UsePhases(phases)
+				return builder.Build(cmd.Context())
+			})
+		},
+	}
+
+	matrixFile string
+	matrixOnly []string
+	matrixWork string
+
+	proxyMatrixCmd = &cobra.Command{
+		Use:   "matrix <command> [flags]",
+		Short: "Build and release every flavor listed in a matrix file",
+	}
+
+	proxyMatrixBuildCmd = &cobra.Command{
+		Use:   "build [flags]",
+		Short: "Build every matrix entry",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := matrixEntries()
+			if err != nil {
+				return err
+			}
+			runner := &build.MatrixRunner{WorkDir: matrixWork, Wrap: recordMatrixEntry(cmd.Context())}
+			return printMatrixResults(runner.Build(cmd.Context(), entries))
+		},
+	}
+
+	proxyMatrixReleaseCmd = &cobra.Command{
+		Use:   "release [flags]",
+		Short: "Release every matrix entry built by 'proxy matrix build'",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := matrixEntries()
+			if err != nil {
+				return err
+			}
+			runner := &build.MatrixRunner{WorkDir: matrixWork, Wrap: recordMatrixEntry(cmd.Context())}
+			return printMatrixResults(runner.Release(cmd.Context(), entries))
+		},
+	}
+
+	compatSince  string
+	compatFormat string
+	compatFile   string
+
+	matrixCmd = &cobra.Command{
+		Use:   "matrix <command> [flags]",
+		Short: "Istio, proxy and Envoy compatibility matrix",
+	}
+
+	matrixGenerateCmd = &cobra.Command{
+		Use:   "generate [flags]",
+		Short: "Generate the compatibility matrix, one row per Istio release",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format := compatFormat
+			if len(format) == 0 {
+				format = compat.FormatOf(compatFile)
+			}
+
+			var existing []compat.Row
+			if len(compatFile) > 0 {
+				f, err := os.Open(compatFile)
+				if err == nil {
+					existing, err = compat.Read(f, format)
+					_ = f.Close()
+					if err != nil {
+						return fmt.Errorf("failed to read %s: %w", compatFile, err)
+					}
+				} else if !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+
+			rows, err := compat.Generate(cmd.Context(), compat.Options{Since: compatSince, Existing: existing})
+			if err != nil {
+				return err
+			}
+			if len(compatFile) == 0 {
+				return compat.Write(os.Stdout, rows, format)
+			}
+
+			tmp := compatFile + ".tmp"
+			f, err := os.Create(tmp)
+			if err != nil {
+				return err
+			}
+			if err := compat.Write(f, rows, format); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "wrote %d rows to %s\n", len(rows), compatFile)
+			return os.Rename(tmp, compatFile)
+		},
+	}
+
+	watchFile     string
+	watchInterval time.Duration
+	watchDryRun   bool
+
+	watchCmd = &cobra.Command{
+		Use:   "watch [flags]",
+		Short: "Request builds of new istio and envoy releases",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := watch.ReadConfig(watchFile)
+			if err != nil {
+				return err
+			}
+			w := &watch.Watcher{Config: config, Publish: queue.Publish, DryRun: watchDryRun}
+			if watchDryRun {
+				w.Publish = func(ctx context.Context, topic string, msg []byte) (string, error) {
+					fmt.Println(topic, string(msg))
+					return "", nil
+				}
+			}
+			for {
+				requests, err := w.Poll(cmd.Context())
+				for _, r := range requests {
+					if len(r.ID) > 0 {
+						fmt.Println("published", r.Key, r.ID)
+					}
+				}
+				fmt.Fprintf(os.Stderr, "requested %d builds\n", len(requests))
+				if err != nil {
+					return err
+				}
+				if watchInterval <= 0 {
+					return nil
+				}
+				select {
+				case <-cmd.Context().Done():
+					return nil
+				case <-time.After(watchInterval):
+				}
+			}
+		},
+	}
+
+	publishTopic   string
+	publishName    string
+	publishTarget  string
+	publishIstio   string
+	publishEnvoy   string
+	publishDryRun  bool
+	publishFlavors queue.Flavors
+
+	queueCmd = &cobra.Command{
+		Use:   "queue <command> [flags]",
+		Short: "Build request queue",
+	}
+
+	queuePublishCmd = &cobra.Command{
+		Use:   "publish <command> [flags]",
+		Short: "Publish a build request",
+	}
+
+	queuePublishBuildCmd = &cobra.Command{
+		Use:   "build [flags]",
+		Short: "Publish a request to build istio",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target := publishTarget
+			if len(target) == 0 {
+				target = "istio-proxy"
+			}
+			msg, err := queue.NewBuildRequest(publishName, target, "istio@"+publishIstio, publishFlavors)
+			if err != nil {
+				return err
+			}
+			return publish(cmd.Context(), msg)
+		},
+	}
+
+	queuePublishBuildEnvoyCmd = &cobra.Command{
+		Use:   "build-envoy [flags]",
+		Short: "Publish a request to build envoy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target := publishTarget
+			if len(target) == 0 {
+				target = "envoy"
+			}
+			msg, err := queue.NewBuildRequest(publishName, target, publishEnvoy, publishFlavors)
+			if err != nil {
+				return err
+			}
+			return publish(cmd.Context(), msg)
+		},
+	}
+
+	queueSchemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print the JSON schema of the build requests",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := os.Stdout.Write(queue.BuildRequestSchema)
+			return err
+		},
+	}
+
+	workerOptions = &worker.Worker{}
+
+	workerCmd = &cobra.Command{
+		Use:   "worker [flags]",
+		Short: "Build and release the requests of a queue subscription",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(workerOptions.Subscription) == 0 {
+				return errors.New("--subscription is required")
+			}
+			if len(storeURL) > 0 {
+				s, err := store.Open(storeURL)
+				if err != nil {
+					return err
+				}
+				workerOptions.Store = s
+			}
+			return workerOptions.Start(cmd.Context())
+		},
+	}
+
+	pipelineNonSpot bool
+	pipelineLeo     string
+	pipelineArch    string
+	pipelineDir     string
+
+	pipelineCmd = &cobra.Command{
+		Use:   "pipeline <command> [flags]",
+		Short: "Build and release on a compute created for the build",
+	}
+
+	pipelineRunCmd = &cobra.Command{
+		Use:   "run [flags]",
+		Short: "Create a compute, build on it, fetch and release the artifacts, then delete the compute",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(zone) == 0 {
+				return errors.New("--zone is required")
+			}
+			name := instanceName
+			if len(name) == 0 {
+				name = "builder-" + uuid.NewString()
+			}
+			p := &pipeline.Pipeline{
+				Instance: &compute.Instance{
+					ProjectID:          os.Getenv("GCLOUD_PROJECT"),
+					ServiceAccountName: serviceAccountName,
+					Zone:               zone,
+					Name:               name,
+				},
+				MachineType:  machineType,
+				MachineImage: machineImage,
+				NonSpot:      pipelineNonSpot,
+				Spec: proxySpec(args[0], &build.Output{
+					Target: target,
+					Arch:   pipelineArch,
+					Repo:   repo,
+					Debug:  debug,
+				}),
+				Leo: pipelineLeo,
+				Dir: pipelineDir,
+			}
+			// The default of --wasm follows the architecture of this machine, not the one of the compute.
+			if !cmd.Flags().Changed("wasm") {
+				p.Spec.Wasm = pipelineArch == "amd64"
+			}
+			fmt.Fprintln(os.Stderr, "pipeline compute:", name)
+			builder, err := build.New(p.Spec)
+			if err != nil {
+				return err
+			}
+			var results []pipeline.Result
+			err = recordBuild(cmd.Context(), "", builder.Spec(), func(phases func(build.Phase)) (err error) {
+				p.Phases = phases
+				results, err = p.Run(cmd.Context())
+				return err
+			})
+			if printErr := printPipelineResults(results); printErr != nil && err == nil {
+				err = printErr
+			}
+			return err
+		},
+	}
+
+	serveAddr     string
+	serveInsecure bool
+	serveOptions  = &server.Server{}
+
+	serveCmd = &cobra.Command{
+		Use:   "serve [flags]",
+		Short: "Serve an HTTP API to submit builds to the queue, inspect them and resolve references",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(serveOptions.Topic) == 0 {
+				return errors.New("--topic is required")
+			}
+			if len(serveOptions.Token) == 0 && !serveInsecure {
+				return errors.New("--token is required, pass --insecure to serve without authentication")
+			}
+			s, err := store.Open(storeURL)
+			if err != nil {
+				return err
+			}
+			serveOptions.Queue = queue.Default
+			serveOptions.Store = s
+			fmt.Fprintln(os.Stderr, "serving on", serveAddr)
+			return serveOptions.Serve(cmd.Context(), serveAddr)
+		},
+	}
+
+	buildsFilter store.Filter
+	buildsFIPS   bool
+	buildsFormat string
+
+	buildsCmd = &cobra.Command{
+		Use:   "builds <command> [flags]",
+		Short: "Inspect the builds recorded by the worker",
+	}
+
+	buildsListCmd = &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List builds, most recent first",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := store.Open(storeURL)
+			if err != nil {
+				return err
+			}
+			filter := buildsFilter
+			if cmd.Flags().Changed("fips") {
+				filter.FIPS = &buildsFIPS
+			}
+			records, err := s.List(cmd.Context(), filter)
+			if err != nil {
+				return err
+			}
+			switch buildsFormat {
+			case "text":
+				return printBuilds(records)
+			case "json":
+				return printFormatted(records, buildsFormat)
+			}
+			return fmt.Errorf("unsupported format %q, supported formats: text, json", buildsFormat)
+		},
+	}
+
+	buildsShowCmd = &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a build and its phases",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, err := store.Open(storeURL)
 			if err != nil {
 				return err
 			}
-			return builder.Build(cmd.Context())
+			r, err := s.Get(cmd.Context(), args[0])
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+			switch buildsFormat {
+			case "text":
+				return printBuild(r)
+			case "json":
+				return printFormatted(r, buildsFormat)
+			}
+			return fmt.Errorf("unsupported format %q, supported formats: text, json", buildsFormat)
+		},
+	}
+
+	pruneAll       bool
+	pruneOlderThan time.Duration
+	pruneRepo      string
+
+	cacheCmd = &cobra.Command{
+		Use:   "cache <command> [flags]",
+		Short: "Inspect and evict cached GitHub files and tarballs",
+	}
+
+	cacheListCmd = &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List cache entries",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := cache.Default()
+			entries, err := c.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tREPO\tNAME\tREF\tSIZE\tAGE\tEXPIRED")
+			now := time.Now()
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%v\n",
+					e.Kind, e.Repo, e.Name, e.Ref, e.Size,
+					now.Sub(e.CreatedAt).Round(time.Second), e.Expired(c.TTL, now))
+			}
+			return w.Flush()
+		},
+	}
+
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune [flags]",
+		Short: "Evict expired cache entries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			removed, err := cache.Default().Prune(cache.PruneOptions{
+				All:       pruneAll,
+				OlderThan: pruneOlderThan,
+				Repo:      pruneRepo,
+			})
+			var size int64
+			for _, e := range removed {
+				size += e.Size
+			}
+			fmt.Fprintf(os.Stderr, "removed %d entries (%d bytes)\n", len(removed), size)
+			return err
 		},
 	}
 
@@ -247,7 +737,285 @@ func main() {
 	}
 }
 
+// proxySpec returns the spec of the "proxy" command flags.
+func proxySpec(target string, output *build.Output) build.Spec {
+	return build.Spec{
+		Target:                target,
+		OverrideIstioProxy:    overrideIstioProxy,
+		OverrideEnvoy:         overrideEnvoy,
+		PatchSource:           patchSource,
+		PatchSourceName:       patchSourceName,
+		PatchSuffix:           patchSuffix,
+		AdditionalPatchDir:    additionalPatchDir,
+		AdditionalPatchSource: additionalPatchDirSource,
+		DynamicModulesBuild:   dynamicModulesBuild,
+		RemoteCache:           remoteCache,
+		FIPSBuild:             fipsBuild,
+		CryptoUpdateStream:    cryptoUpdateStream,
+		Wasm:                  wasm,
+		Gperftools:            gperftools,
+		Debug:                 debug,
+		Prereleases:           prereleases,
+		Output:                output,
+	}
+}
+
+// useContext makes the builder use the refs resolved by a previous build when --context is set.
+func useContext(builder *build.ProxyBuilder) error {
+	if len(contextFile) == 0 {
+		return nil
+	}
+	c, err := build.ReadContext(contextFile)
+	if err != nil {
+		return err
+	}
+	builder.UseContext(c)
+	return nil
+}
+
+// recordBuild runs a build of a spec and keeps its record in --store, when set. The failure of a
+// failed build is the one of its last phase.
+func recordBuild(ctx context.Context, name string, spec build.Spec, run func(phases func(build.Phase)) error) (err error) {
+	var s store.Store
+	if len(storeURL) > 0 {
+		if s, err = store.Open(storeURL); err != nil {
+			return err
+		}
+	}
+	if len(name) == 0 {
+		name = spec.Target
+	}
+	result := &queue.BuildResult{
+		Version:   queue.BuildResultVersion,
+		RequestID: uuid.NewString(),
+		Name:      name,
+		Target:    spec.Target,
+		StartedAt: time.Now(),
+	}
+	rec := store.NewRecorder(ctx, s, result)
+	rec.Update(func(r *store.Record) {
+		if spec.Output != nil {
+			r.OutputTarget = spec.Output.Target
+			r.Arch = spec.Output.Arch
+		}
+		r.Flavors = &build.Flavors{
+			FIPSBuild:           spec.FIPSBuild,
+			CryptoUpdateStream:  spec.CryptoUpdateStream,
+			DynamicModulesBuild: spec.DynamicModulesBuild,
+			Wasm:                spec.Wasm,
+			Gperftools:          spec.Gperftools,
+			Debug:               spec.Debug,
+			PatchSourceName:     spec.PatchSourceName,
+			PatchSuffix:         spec.PatchSuffix,
+			RemoteCache:         spec.RemoteCache,
+		}
+	})
+
+	var last build.Phase
+	defer func() {
+		result.DurationSeconds = time.Since(result.StartedAt).Seconds()
+		result.Status = queue.StatusSucceeded
+		if err != nil {
+			result.Status = queue.StatusFailed
+			result.Error = err.Error()
+			switch {
+			case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+				result.Failure = queue.FailureCanceled
+			case last == build.PhaseCompile:
+				result.Failure = queue.FailureCompile
+			case last == build.PhaseRelease:
+				result.Failure = queue.FailureRelease
+			default:
+				result.Failure = queue.FailurePrepare
+			}
+		}
+		rec.Finish()
+	}()
+	return run(func(p build.Phase) {
+		last = p
+		rec.Phase(p)
+	})
+}
+
+// recordMatrixEntry records the build or the release of every matrix entry.
+func recordMatrixEntry(ctx context.Context) func(build.MatrixEntry, *build.ProxyBuilder, func() error) error {
+	return func(entry build.MatrixEntry, builder *build.ProxyBuilder, run func() error) error {
+		return recordBuild(ctx, entry.Name, builder.Spec(), func(phases func(build.Phase)) error {
+			builder.UsePhases(phases)
+			return run()
+		})
+	}
+}
+
+// matrixEntries returns the expanded entries of --file, filtered by --only.
+func matrixEntries() ([]build.MatrixEntry, error) {
+	m, err := build.ReadMatrix(matrixFile)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := m.Expand()
+	if err != nil {
+		return nil, err
+	}
+	if len(matrixOnly) == 0 {
+		return entries, nil
+	}
+	var selected []build.MatrixEntry
+	for _, name := range matrixOnly {
+		found := false
+		for _, entry := range entries {
+			if entry.Name == name {
+				selected = append(selected, entry)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no matrix entry named %s", name)
+		}
+	}
+	return selected, nil
+}
+
+// printMatrixResults prints a summary of the matrix run and returns an error when an entry failed.
+func printMatrixResults(results []build.MatrixResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tDURATION\tDIR\tERROR")
+	failed := 0
+	for _, r := range results {
+		status, errMessage := "ok", ""
+		if r.Err != nil {
+			status, errMessage = "failed", r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Name, status, r.Duration.Round(time.Second), r.Dir, errMessage)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d matrix entries failed", failed, len(results))
+	}
+	return nil
+}
+
+// printPipelineResults prints a summary of the phases of a pipeline run.
+func printPipelineResults(results []pipeline.Result) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tSTATUS\tDURATION\tERROR")
+	for _, r := range results {
+		status, errMessage := "ok", ""
+		if r.Err != nil {
+			status, errMessage = "failed", r.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Phase, status, r.Duration.Round(time.Second), errMessage)
+	}
+	return w.Flush()
+}
+
+// publish publishes a build request to --topic and prints its message ID, or prints the request
+// with --dry-run.
+func publish(ctx context.Context, msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if publishDryRun {
+		fmt.Println(string(data))
+		return nil
+	}
+	if len(publishTopic) == 0 {
+		return errors.New("--topic is required")
+	}
+	id, err := queue.Publish(ctx, publishTopic, data)
+	if err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+// printBuilds prints a table of build records.
+func printBuilds(records []*store.Record) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTARGET\tOUTPUT\tARCH\tFIPS\tSTATUS\tPHASE\tSTARTED\tDURATION")
+	for _, r := range records {
+		fips := false
+		if r.Flavors != nil {
+			fips = r.Flavors.FIPSBuild
+		}
+		duration := time.Since(r.StartedAt)
+		if r.FinishedAt != nil {
+			duration = r.FinishedAt.Sub(r.StartedAt)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\t%s\n",
+			r.RequestID, r.Name, r.Target, r.OutputTarget, r.Arch, fips, r.Status, r.Phase(),
+			r.StartedAt.Local().Format(time.DateTime), duration.Round(time.Second))
+	}
+	return w.Flush()
+}
+
+// printBuild prints a build record and its phases.
+func printBuild(r *store.Record) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "id:\t%s\n", r.RequestID)
+	fmt.Fprintf(w, "name:\t%s\n", r.Name)
+	fmt.Fprintf(w, "target:\t%s\n", r.Target)
+	fmt.Fprintf(w, "output:\t%s %s\n", r.OutputTarget, r.Arch)
+	fmt.Fprintf(w, "status:\t%s\n", r.Status)
+	if len(r.Failure) > 0 {
+		fmt.Fprintf(w, "failure:\t%s: %s\n", r.Failure, r.Error)
+	}
+	fmt.Fprintf(w, "attempt:\t%d\n", r.Attempt)
+	if c := r.Coordinates; c != nil {
+		fmt.Fprintf(w, "istio:\t%s %s\n", c.Istio.Ref, c.Istio.SHA)
+		fmt.Fprintf(w, "proxy:\t%s@%s\n", c.Proxy.Repo, c.Proxy.SHA)
+		fmt.Fprintf(w, "envoy:\t%s@%s (%s)\n", c.Envoy.Repo, c.Envoy.SHA, c.Envoy.Version)
+	}
+	if a := r.Artifacts; a != nil {
+		fmt.Fprintf(w, "gcs:\t%s\n", a.GCS)
+		fmt.Fprintf(w, "release:\t%s\n", a.ReleaseURL)
+	}
+	if len(r.CoalescedWith) > 0 {
+		fmt.Fprintf(w, "coalesced with:\t%s\n", r.CoalescedWith)
+	}
+	if r.AlreadyReleased {
+		fmt.Fprintln(w, "already released:\ttrue")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "PHASE\tSTARTED\tDURATION")
+	for _, p := range r.Phases {
+		duration := "-"
+		if p.FinishedAt != nil {
+			duration = p.FinishedAt.Sub(p.StartedAt).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.Phase, p.StartedAt.Local().Format(time.DateTime), duration)
+	}
+	return w.Flush()
+}
+
+// printFormatted writes v to stdout as JSON or YAML.
+func printFormatted(v any, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return fmt.Errorf("unsupported format %q, supported formats: text, json, yaml", format)
+}
+
 func init() {
+	rootCmd.PersistentFlags().StringVar(&storeURL, "store", env.LEO_STORE, "Build records store: file://<dir>. Defaults to $LEO_STORE, builds are not recorded when empty")
+	rootCmd.PersistentFlags().StringVar(&queueURL, "queue", env.LEO_QUEUE, "Build request queue: pubsub://<project>, defaults to $GCLOUD_PROJECT and honors $PUBSUB_EMULATOR_HOST, or file://<dir>. Defaults to $LEO_QUEUE")
+
 	computeCmd.PersistentFlags().StringVar(&zone, "zone", "", "Zone")
 	computeCmd.PersistentFlags().StringVar(&instanceName, "instance", "", "Instance name")
 	computeCmd.PersistentFlags().StringVar(&machineType, "machine-type", "n2-standard-8", "Machine type")
@@ -264,6 +1032,7 @@ func init() {
 	proxyCmd.PersistentFlags().StringVar(&patchSource, "patch-source", "github://dio/leo", "Patch source. For example: file://patches")
 	proxyCmd.PersistentFlags().StringVar(&patchSourceName, "patch-source-name", "envoy", "Patch source name. For example: envoy, envoy-no-tls-chacha20-poly1305-sha256")
 	proxyCmd.PersistentFlags().StringVar(&patchSuffix, "patch-suffix", "", "Patch suffix, for example: -tlsnist-preview-") // The "-" prefix is important.
+	proxyCmd.PersistentFlags().BoolVar(&prereleases, "prereleases", false, "Let an istio minor shorthand target, e.g. istio@1.22, resolve to a prerelease")
 	proxyCmd.PersistentFlags().BoolVar(&fipsBuild, "fips-build", false, "FIPS build")
 	proxyCmd.PersistentFlags().BoolVar(&cryptoUpdateStream, "crypto-updatestream", false, "FIPS build without precompiled BoringSSL BCM (crypto update stream)")
 	proxyCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Debug build")
@@ -274,20 +1043,125 @@ func init() {
 	proxyCmd.PersistentFlags().StringVar(&additionalPatchDir, "additional-patch-dir", "", "Additional patches directory")
 	proxyCmd.PersistentFlags().StringVar(&additionalPatchDirSource, "additional-patch-source", "", "Additional patches directory source, default to same source as 'patch-source' value")
 
-	proxyOutputCmd.Flags().StringVar(&target, "target", "istio-proxy", "Build target, i.e. envoy, istio-proxy")
+	proxyInfoCmd.Flags().StringVar(&target, "target", "", "Build target, i.e. envoy, istio-proxy. Defaults to istio-proxy, or envoy for envoy targets")
+	proxyInfoCmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "Builder architecture")
+	proxyInfoCmd.Flags().StringVar(&repo, "repo", "tetrateio/proxy-archives", "Archives repo")
+	proxyInfoCmd.Flags().StringVar(&format, "format", "text", "Output format: text, json or yaml")
+	proxyOutputCmd.Flags().StringVar(&target, "target", "", "Build target, i.e. envoy, istio-proxy. Defaults to istio-proxy, or envoy for envoy targets")
 	proxyOutputCmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "Builder architecture")
-	proxyReleaseCmd.Flags().StringVar(&target, "target", "istio-proxy", "Build target, i.e. envoy, istio-proxy")
+	proxyOutputCmd.Flags().StringVar(&repo, "repo", "tetrateio/proxy-archives", "Archives repo")
+	proxyOutputCmd.Flags().StringVar(&format, "format", "text", "Output format: text, json or yaml")
+	proxyOutputCmd.Flags().StringVar(&contextFile, "context", "", "Build context file written by 'proxy build', e.g. work/proxy-<sha>/"+build.ContextFileName)
+	proxyReleaseCmd.Flags().StringVar(&contextFile, "context", "", "Build context file written by 'proxy build', e.g. work/proxy-<sha>/"+build.ContextFileName)
+	proxyReleaseCmd.Flags().StringVar(&target, "target", "", "Build target, i.e. envoy, istio-proxy. Defaults to istio-proxy, or envoy for envoy targets")
 	proxyReleaseCmd.Flags().StringVar(&repo, "repo", "tetrateio/proxy-archives", "Archives repo")
 	proxyReleaseCmd.Flags().StringVar(&dir, "dir", "./out", "Assets directory")
 	proxyReleaseCmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "Builder architecture")
 
+	proxyBuildCmd.Flags().StringVar(&lockFile, "lock", "", "Record every resolved input into this lock file, e.g. leo.lock")
+	proxyBuildCmd.Flags().BoolVar(&frozen, "frozen", false, "Refuse to build when anything resolves differently from the lock file")
+
 	proxyCmd.AddCommand(proxyInfoCmd)
 	proxyCmd.AddCommand(proxyOutputCmd)
 	proxyCmd.AddCommand(proxyBuildCmd)
 	proxyCmd.AddCommand(proxyReleaseCmd)
 
+	proxyMatrixCmd.PersistentFlags().StringVarP(&matrixFile, "file", "f", "leo.yaml", "Matrix file")
+	proxyMatrixCmd.PersistentFlags().StringSliceVar(&matrixOnly, "only", nil, "Only run these entries. For example: istio-1.22.3-fips")
+	proxyMatrixCmd.PersistentFlags().StringVar(&matrixWork, "work-dir", "work", "Parent of the per-entry work directories")
+	proxyMatrixCmd.AddCommand(proxyMatrixBuildCmd)
+	proxyMatrixCmd.AddCommand(proxyMatrixReleaseCmd)
+	proxyCmd.AddCommand(proxyMatrixCmd)
+
+	cachePruneCmd.Flags().BoolVar(&pruneAll, "all", false, "Evict all entries")
+	cachePruneCmd.Flags().DurationVar(&pruneOlderThan, "older-than", 0, "Also evict entries older than this, including entries keyed by commit SHA. For example: 720h")
+	cachePruneCmd.Flags().StringVar(&pruneRepo, "repo", "", "Only evict entries of this repository. For example: envoyproxy/envoy")
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+
 	rootCmd.AddCommand(computeCmd)
 	rootCmd.AddCommand(proxyCmd)
+	resolveCmd.Flags().BoolVar(&resolveAll, "all", false, "List every Istio release compatible with the envoy version, newest first")
+	resolveCmd.Flags().BoolVar(&prereleases, "prereleases", false, "Let an istio minor shorthand, e.g. istio@1.22, resolve to a prerelease")
+	resolveCmd.Flags().StringVar(&format, "format", "text", "Output format of istio and istio/proxy chains: text, json or yaml")
 	rootCmd.AddCommand(resolveCmd)
+	matrixGenerateCmd.Flags().StringVar(&compatSince, "since", "", "Oldest Istio minor version to list. For example: 1.20")
+	matrixGenerateCmd.Flags().StringVar(&compatFormat, "format", "", "Output format: markdown, csv or json. Defaults to the --file extension, or markdown")
+	matrixGenerateCmd.Flags().StringVar(&compatFile, "file", "", "File to update incrementally, only the missing releases are resolved. Defaults to stdout")
+	matrixCmd.AddCommand(matrixGenerateCmd)
+
+	rootCmd.AddCommand(cacheCmd)
+	rootCmd.AddCommand(matrixCmd)
+
+	watchCmd.Flags().StringVarP(&watchFile, "file", "f", "leo-watch.yaml", "Watch file")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 0, "Poll interval, polls once when zero. For example: 30m")
+	watchCmd.Flags().BoolVar(&watchDryRun, "dry-run", false, "Print the build requests instead of publishing them, and leave the state file untouched")
+	rootCmd.AddCommand(watchCmd)
+
+	queuePublishCmd.PersistentFlags().StringVar(&publishTopic, "topic", "", "Queue topic")
+	queuePublishCmd.PersistentFlags().StringVar(&publishName, "name", "", "Build name, defaults to the target, version and flavors. For example: istio-proxy-1.22.3-fips")
+	queuePublishCmd.PersistentFlags().StringVar(&publishTarget, "target", "", "Build target, i.e. envoy, istio-proxy. Defaults to istio-proxy, or envoy for build-envoy")
+	queuePublishCmd.PersistentFlags().BoolVar(&publishDryRun, "dry-run", false, "Print the request instead of publishing it")
+	queuePublishCmd.PersistentFlags().BoolVar(&publishFlavors.FIPSBuild, "fips", false, "FIPS build")
+	queuePublishCmd.PersistentFlags().BoolVar(&publishFlavors.CryptoUpdateStream, "crypto-updatestream", false, "FIPS build without precompiled BoringSSL BCM (crypto update stream)")
+	queuePublishCmd.PersistentFlags().BoolVar(&publishFlavors.Debug, "debug", false, "Debug build")
+	queuePublishCmd.PersistentFlags().StringVar(&publishFlavors.DynamicModulesBuild, "dynamic-modules-build", "", "Dynamic modules build")
+	queuePublishCmd.PersistentFlags().StringVar(&publishFlavors.PatchSourceName, "patch-source-name", "", "Patch source name. For example: envoy, envoy-no-tls-chacha20-poly1305-sha256")
+	queuePublishBuildCmd.Flags().StringVar(&publishIstio, "istio", "", "Istio version. For example: 1.22.3")
+	_ = queuePublishBuildCmd.MarkFlagRequired("istio")
+	queuePublishBuildEnvoyCmd.Flags().StringVar(&publishEnvoy, "envoy", "", "Envoy reference. For example: envoyproxy/envoy@v1.30.4")
+	_ = queuePublishBuildEnvoyCmd.MarkFlagRequired("envoy")
+	queuePublishCmd.AddCommand(queuePublishBuildCmd)
+	queuePublishCmd.AddCommand(queuePublishBuildEnvoyCmd)
+	queueCmd.AddCommand(queuePublishCmd)
+	queueCmd.AddCommand(queueSchemaCmd)
+	rootCmd.AddCommand(queueCmd)
+
+	workerCmd.Flags().StringVar(&workerOptions.Subscription, "subscription", "", "Queue subscription. A file:// queue subscription is the topic name")
+	workerCmd.Flags().StringVar(&workerOptions.DeadLetterTopic, "dead-letter-topic", "", "Topic receiving the failed requests. Failed requests are redelivered when unset")
+	workerCmd.Flags().StringVar(&workerOptions.ResultTopic, "result-topic", "", "Topic receiving the result of every handled request")
+	workerCmd.Flags().BoolVar(&workerOptions.Rebuild, "rebuild", false, "Build the requests whose artifacts are already released")
+	workerCmd.Flags().IntVar(&workerOptions.Concurrency, "concurrency", 1, "Number of requests built at once")
+	workerCmd.Flags().DurationVar(&workerOptions.MaxExtension, "max-extension", 24*time.Hour, "How long the lease of a request keeps being extended while it is built")
+	workerCmd.Flags().DurationVar(&workerOptions.DrainTimeout, "drain-timeout", 0, "How long in-flight builds may take on SIGTERM, waits for them when zero")
+	workerCmd.Flags().StringVar(&workerOptions.WorkDir, "work-dir", "work", "Parent of the per-request work directories")
+	workerCmd.Flags().StringVar(&workerOptions.Arch, "arch", runtime.GOARCH, "Builder architecture")
+	workerCmd.Flags().StringVar(&workerOptions.Repo, "repo", "tetrateio/proxy-archives", "Archives repo")
+	rootCmd.AddCommand(workerCmd)
+
+	pipelineRunCmd.Flags().AddFlagSet(proxyCmd.PersistentFlags())
+	pipelineRunCmd.Flags().StringVar(&zone, "zone", "", "Zone")
+	pipelineRunCmd.Flags().StringVar(&instanceName, "instance", "", "Instance name, defaults to builder-<uuid>")
+	pipelineRunCmd.Flags().StringVar(&machineType, "machine-type", "n2-standard-8", "Machine type")
+	pipelineRunCmd.Flags().StringVar(&serviceAccountName, "service-account-name", "tetrateio", "Service account name")
+	pipelineRunCmd.Flags().StringVar(&machineImage, "machine-image", "builder-amd64", "Machine image")
+	pipelineRunCmd.Flags().BoolVar(&pipelineNonSpot, "non-spot", false, "Create a standard compute instead of a spot one")
+	pipelineRunCmd.Flags().StringVar(&pipelineLeo, "leo", "leo", "leo binary on the compute")
+	pipelineRunCmd.Flags().StringVar(&target, "target", "", "Build target, i.e. envoy, istio-proxy. Defaults to istio-proxy, or envoy for envoy targets")
+	pipelineRunCmd.Flags().StringVar(&pipelineArch, "arch", "amd64", "Architecture of the machine image")
+	pipelineRunCmd.Flags().StringVar(&repo, "repo", "tetrateio/proxy-archives", "Archives repo")
+	pipelineRunCmd.Flags().StringVar(&pipelineDir, "dir", "pipeline", "Directory the artifacts are fetched to")
+	pipelineCmd.AddCommand(pipelineRunCmd)
+	rootCmd.AddCommand(pipelineCmd)
+
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "Address to listen on")
+	serveCmd.Flags().StringVar(&serveOptions.Topic, "topic", "", "Queue topic receiving the submitted builds")
+	serveCmd.Flags().StringVar(&serveOptions.Token, "token", env.LEO_SERVE_TOKEN, "Bearer token required by every request. Defaults to $LEO_SERVE_TOKEN")
+	serveCmd.Flags().BoolVar(&serveInsecure, "insecure", false, "Serve without authentication when no token is set")
+	serveCmd.Flags().StringVar(&serveOptions.Arch, "arch", runtime.GOARCH, "Architecture of the submitted builds leaving it out")
+	serveCmd.Flags().StringVar(&serveOptions.Repo, "repo", "tetrateio/proxy-archives", "Archives repo of the submitted builds leaving it out")
+	rootCmd.AddCommand(serveCmd)
+
+	buildsCmd.PersistentFlags().StringVar(&buildsFormat, "format", "text", "Output format: text or json")
+	buildsListCmd.Flags().StringVar(&buildsFilter.Name, "name", "", "Only list the builds which name contains this")
+	buildsListCmd.Flags().StringVar(&buildsFilter.Istio, "istio", "", "Only list the builds of an Istio version or minor version. For example: 1.21")
+	buildsListCmd.Flags().StringVar(&buildsFilter.OutputTarget, "target", "", "Only list the builds of an output target. For example: istio-proxy")
+	buildsListCmd.Flags().StringVar(&buildsFilter.Arch, "arch", "", "Only list the builds of an architecture")
+	buildsListCmd.Flags().BoolVar(&buildsFIPS, "fips", false, "Only list the FIPS builds, or the non-FIPS ones with --fips=false")
+	buildsListCmd.Flags().StringVar((*string)(&buildsFilter.Status), "status", "", "Only list the builds with this status: queued, running, succeeded or failed")
+	buildsListCmd.Flags().IntVar(&buildsFilter.Limit, "limit", 0, "Maximum number of builds listed")
+	buildsCmd.AddCommand(buildsListCmd)
+	buildsCmd.AddCommand(buildsShowCmd)
+	rootCmd.AddCommand(buildsCmd)
 	rootCmd.AddCommand(versionCmd)
 }
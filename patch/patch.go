@@ -2,6 +2,8 @@ package patch
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -27,6 +29,18 @@ type Getter interface {
 	List(context.Context, string, string) ([]Info, error)
 }
 
+// Locator is implemented by getters that can tell which patch file Get returns, without fetching
+// it for applying.
+type Locator interface {
+	Locate(context.Context, Info) (string, error)
+}
+
+// Fetcher is implemented by getters that can tell which patch file Get returns, along with its
+// content, in a single fetch.
+type Fetcher interface {
+	Fetch(context.Context, Info) (string, []byte, error)
+}
+
 func Get(ctx context.Context, info Info, getter Getter) ([]byte, error) {
 	return getter.Get(ctx, info)
 }
@@ -37,7 +51,22 @@ type GitHubGetter struct {
 }
 
 func (g GitHubGetter) Get(ctx context.Context, info Info) ([]byte, error) {
+	_, content, err := g.locate(ctx, info)
+	return content, err
+}
 
+// Locate returns the path in the repository of the patch file Get returns.
+func (g GitHubGetter) Locate(ctx context.Context, info Info) (string, error) {
+	name, _, err := g.locate(ctx, info)
+	return name, err
+}
+
+// Fetch returns the path in the repository and the content of the patch file Get returns.
+func (g GitHubGetter) Fetch(ctx context.Context, info Info) (string, []byte, error) {
+	return g.locate(ctx, info)
+}
+
+func (g GitHubGetter) locate(ctx context.Context, info Info) (string, []byte, error) {
 	ref := g.Ref
 	if ref == "" {
 		ref = "main"
@@ -48,41 +77,30 @@ func (g GitHubGetter) Get(ctx context.Context, info Info) ([]byte, error) {
 	// Try getting the file from the ref branch first
 	content, err := github.GetRaw(ctx, g.Repo, info.Name, ref)
 	if err == nil {
-		return []byte(content + "\n"), nil
+		return info.Name, []byte(content + "\n"), nil
 	}
 
 	idx := strings.LastIndex(info.Ref, ".")
 	minorName := info.Ref[0:idx]
 
-	// E.g. 1.29.0-fips.patch.
-	patchFile := info.Ref + info.Suffix + ".patch"
-	content, err = github.GetRaw(ctx, g.Repo, path.Join("patches", info.Name, patchFile), ref)
-	if err == nil {
-		return []byte(content + "\n"), nil
-	}
-
-	// We search for minor with suffix. E.g. 1.29-fips.patch.
-	patchFile = minorName + info.Suffix + ".patch"
-	content, err = github.GetRaw(ctx, g.Repo, path.Join("patches", info.Name, patchFile), ref)
-	if err == nil {
-		return []byte(content + "\n"), nil
-	}
-
-	// E.g. 1.29.0.patch.
-	patchFile = info.Ref + ".patch"
-	content, err = github.GetRaw(ctx, g.Repo, path.Join("patches", info.Name, patchFile), ref)
-	if err == nil {
-		return []byte(content + "\n"), nil
-	}
-
-	// We search for minor. E.g. 1.29.patch.
-	patchFile = minorName + ".patch"
-	content, err = github.GetRaw(ctx, g.Repo, path.Join("patches", info.Name, patchFile), ref)
-	if err == nil {
-		return []byte(content + "\n"), nil
+	for _, patchFile := range []string{
+		// E.g. 1.29.0-fips.patch.
+		info.Ref + info.Suffix + ".patch",
+		// We search for minor with suffix. E.g. 1.29-fips.patch.
+		minorName + info.Suffix + ".patch",
+		// E.g. 1.29.0.patch.
+		info.Ref + ".patch",
+		// We search for minor. E.g. 1.29.patch.
+		minorName + ".patch",
+	} {
+		name := path.Join("patches", info.Name, patchFile)
+		content, err = github.GetRaw(ctx, g.Repo, name, ref)
+		if err == nil {
+			return name, []byte(content + "\n"), nil
+		}
 	}
 
-	return []byte{}, errors.New("patch not found")
+	return "", []byte{}, errors.New("patch not found")
 }
 
 func (g GitHubGetter) List(ctx context.Context, path, prefix string) ([]Info, error) {
@@ -108,20 +126,38 @@ type FSGetter struct {
 }
 
 func (g FSGetter) Get(_ context.Context, info Info) ([]byte, error) {
-	var (
-		content []byte
-		err     error
-	)
+	name, err := g.locate(info)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(name)
+}
 
-	content, err = os.ReadFile(filepath.Join(g.Dir, info.Name))
-	if err == nil {
-		return content, nil
+// Locate returns the path of the patch file Get returns.
+func (g FSGetter) Locate(_ context.Context, info Info) (string, error) {
+	return g.locate(info)
+}
+
+// Fetch returns the path and the content of the patch file Get returns.
+func (g FSGetter) Fetch(_ context.Context, info Info) (string, []byte, error) {
+	name, err := g.locate(info)
+	if err != nil {
+		return "", nil, err
+	}
+	content, err := os.ReadFile(name)
+	return name, content, err
+}
+
+func (g FSGetter) locate(info Info) (string, error) {
+	name := filepath.Join(g.Dir, info.Name)
+	if stat, err := os.Stat(name); err == nil && !stat.IsDir() {
+		return name, nil
 	}
 
 	baseDir := filepath.Join(g.Dir, info.Name)
 	entries, err := os.ReadDir(baseDir)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	for _, entry := range entries {
@@ -133,39 +169,27 @@ func (g FSGetter) Get(_ context.Context, info Info) ([]byte, error) {
 
 		patchFile := info.Ref + info.Suffix + ".patch"
 		if entry.Name() == patchFile { // For example -fips.
-			content, err = os.ReadFile(filepath.Join(baseDir, patchFile))
-			if err == nil {
-				return content, nil
-			}
+			return filepath.Join(baseDir, patchFile), nil
 		}
 
 		patchFile = minorName + info.Suffix + ".patch"
 		if entry.Name() == patchFile { // For example -fips.
-			content, err = os.ReadFile(filepath.Join(baseDir, patchFile))
-			if err == nil {
-				return content, nil
-			}
+			return filepath.Join(baseDir, patchFile), nil
 		}
 
 		patchFile = info.Ref + ".patch"
 		if entry.Name() == patchFile {
-			content, err = os.ReadFile(filepath.Join(baseDir, patchFile))
-			if err == nil {
-				return content, nil
-			}
+			return filepath.Join(baseDir, patchFile), nil
 		}
 
 		// We search for minor.
 		patchFile = minorName + ".patch"
 		if entry.Name() == patchFile {
-			content, err = os.ReadFile(filepath.Join(baseDir, patchFile))
-			if err == nil {
-				return content, nil
-			}
+			return filepath.Join(baseDir, patchFile), nil
 		}
 	}
 
-	return []byte{}, errors.New("patch not found")
+	return "", errors.New("patch not found")
 }
 
 func (f FSGetter) List(ctx context.Context, patchPath, prefix string) ([]Info, error) {
@@ -194,15 +218,33 @@ func (f FSGetter) List(ctx context.Context, patchPath, prefix string) ([]Info, e
 	return list, nil
 }
 
-func Apply(ctx context.Context, info Info, patchGetter Getter, dst string) error {
-	patchData, err := patchGetter.Get(ctx, info)
+// Applied describes an applied patch file.
+type Applied struct {
+	// Name is the path of the patch file in its source.
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Apply applies a patch into the dst directory. The applied patch is named after the file it was
+// fetched from when the getter is a Fetcher, otherwise after info.
+func Apply(ctx context.Context, info Info, patchGetter Getter, dst string) (Applied, error) {
+	name := info.Name
+	var (
+		patchData []byte
+		err       error
+	)
+	if fetcher, ok := patchGetter.(Fetcher); ok {
+		name, patchData, err = fetcher.Fetch(ctx, info)
+	} else {
+		patchData, err = patchGetter.Get(ctx, info)
+	}
 	if err != nil {
-		return err
+		return Applied{}, err
 	}
 
 	patchFile, err := os.CreateTemp(os.TempDir(), "*.leo.patch")
 	if err != nil {
-		return err
+		return Applied{}, err
 	}
 	defer func() {
 		_ = patchFile.Close()
@@ -211,27 +253,38 @@ func Apply(ctx context.Context, info Info, patchGetter Getter, dst string) error
 
 	_, err = patchFile.Write(patchData)
 	if err != nil {
-		return err
+		return Applied{}, err
 	}
 	fmt.Fprintln(os.Stderr, "patching", info.Name, "with", patchFile.Name())
-	return sh.Run(ctx, "patch", "-p1", "-i", patchFile.Name(), "-d", dst)
+	if err := sh.Run(ctx, "patch", "-p1", "-i", patchFile.Name(), "-d", dst); err != nil {
+		return Applied{}, err
+	}
+
+	sum := sha256.Sum256(patchData)
+	return Applied{
+		Name:   name,
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
 }
 
 // ApplyDir applies all patches in the patchDir directory with the given prefix into the dst directory.
-func ApplyDir(ctx context.Context, patchGetter Getter, patchDir, prefix, dst string) error {
+func ApplyDir(ctx context.Context, patchGetter Getter, patchDir, prefix, dst string) ([]Applied, error) {
 
 	infos, err := patchGetter.List(ctx, patchDir, prefix)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var applied []Applied
 	for _, info := range infos {
-		if err := Apply(ctx, info, patchGetter, dst); err != nil {
-			return err
+		a, err := Apply(ctx, info, patchGetter, dst)
+		if err != nil {
+			return applied, err
 		}
+		applied = append(applied, a)
 	}
 
-	return nil
+	return applied, nil
 }
 
 type Source string
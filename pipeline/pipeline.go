@@ -0,0 +1,235 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/compute"
+	"github.com/dio/sh"
+)
+
+// Phase is a step of a pipeline run.
+type Phase string
+
+const (
+	PhaseCreate  Phase = "create"
+	PhaseBuild   Phase = "build"
+	PhaseFetch   Phase = "fetch"
+	PhaseRelease Phase = "release"
+	PhaseDelete  Phase = "delete"
+)
+
+// artifactsFile is the tarball of the out directory and the build context, made on the instance.
+const artifactsFile = "leo-artifacts.tar.gz"
+
+// Result is the outcome of a phase.
+type Result struct {
+	Phase    Phase
+	Duration time.Duration
+	Err      error
+}
+
+// Pipeline creates a compute instance, builds a spec on it, fetches the artifacts, releases them
+// from here and deletes the instance. The instance is deleted however the run ends, including when
+// its context is canceled.
+type Pipeline struct {
+	Instance     *compute.Instance
+	MachineType  string
+	MachineImage string
+	NonSpot      bool
+	// Spec is what is built on the instance. Its output is used for the release.
+	Spec build.Spec
+	// Leo is the leo binary on the instance, defaults to leo.
+	Leo string
+	// Dir is where the artifacts are fetched to, defaults to "pipeline".
+	Dir string
+	// DeleteTimeout bounds the deletion of the instance, which runs after the run is canceled.
+	// Defaults to 10 minutes.
+	DeleteTimeout time.Duration
+
+	// Create, Delete, Exec and Fetch default to the compute instance, reached with gcloud. Exec runs a
+	// shell script on the instance, Fetch copies a file from the instance.
+	Create func(ctx context.Context) error
+	Delete func(ctx context.Context) error
+	Exec   func(ctx context.Context, script string) error
+	Fetch  func(ctx context.Context, remote, local string) error
+	// Release releases the fetched out directory built with a build context. It defaults to the
+	// builder of the spec.
+	Release func(ctx context.Context, c *build.BuildContext, dir string) error
+	// Phases, when set, is called when a build phase starts. The build on the instance is reported
+	// as compile, the phases of the release as reported by the builder.
+	Phases func(build.Phase)
+}
+
+// Run runs every phase, stopping at the first failure, and deletes the instance. It returns the
+// results of the phases that ran, deletion last, and the first error.
+func (p *Pipeline) Run(ctx context.Context) (results []Result, err error) {
+	builder, err := build.New(p.Spec)
+	if err != nil {
+		return nil, err
+	}
+	spec := builder.Spec()
+	if spec.Output == nil {
+		return nil, errors.New("pipeline spec requires an output")
+	}
+	builder.UsePhases(p.phase)
+
+	phase := func(ph Phase, f func(context.Context) error) error {
+		fmt.Fprintln(os.Stderr, "pipeline phase:", ph)
+		start := time.Now()
+		err := f(ctx)
+		if err == nil {
+			err = ctx.Err()
+		}
+		results = append(results, Result{Phase: ph, Duration: time.Since(start), Err: err})
+		return err
+	}
+
+	// A failed or canceled creation may still leave an instance behind, it is deleted too. An instance
+	// which already existed is not the one of this run, it is left alone.
+	createErr := phase(PhaseCreate, p.create)
+	if errors.Is(createErr, compute.ErrAlreadyExists) {
+		return results, createErr
+	}
+	defer func() {
+		deleteCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.deleteTimeout())
+		defer cancel()
+		start := time.Now()
+		fmt.Fprintln(os.Stderr, "pipeline phase:", PhaseDelete)
+		deleteErr := p.delete(deleteCtx)
+		results = append(results, Result{Phase: PhaseDelete, Duration: time.Since(start), Err: deleteErr})
+		if err == nil {
+			err = deleteErr
+		}
+	}()
+
+	if createErr != nil {
+		return results, createErr
+	}
+	if err := phase(PhaseBuild, func(ctx context.Context) error {
+		p.phase(build.PhaseCompile)
+		return p.exec(ctx, p.script(spec))
+	}); err != nil {
+		return results, err
+	}
+	var c *build.BuildContext
+	if err := phase(PhaseFetch, func(ctx context.Context) (err error) {
+		c, err = p.fetch(ctx)
+		return err
+	}); err != nil {
+		return results, err
+	}
+	if err := phase(PhaseRelease, func(ctx context.Context) error {
+		return p.release(ctx, builder, c)
+	}); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+// script builds the spec on the instance, compiles its output target and packs the artifacts.
+func (p *Pipeline) script(spec build.Spec) string {
+	leo := p.Leo
+	if len(leo) == 0 {
+		leo = "leo"
+	}
+	args := []string{quote(leo), "proxy", "build"}
+	for _, arg := range spec.Arguments() {
+		args = append(args, quote(arg))
+	}
+	return strings.Join([]string{
+		"set -e",
+		"dir=$(" + strings.Join(args, " ") + ")",
+		`BUILD_WITH_CONTAINER=1 make -C "$dir" ` + quote(spec.Output.Target),
+		`tar -czf ` + artifactsFile + ` -C "$dir" out ` + build.ContextFileName,
+	}, "\n")
+}
+
+// fetch copies the artifacts of the instance into Dir and returns their build context.
+func (p *Pipeline) fetch(ctx context.Context) (*build.BuildContext, error) {
+	dir := p.dir()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	local := filepath.Join(dir, artifactsFile)
+	fetch := p.Fetch
+	if fetch == nil {
+		fetch = p.scp
+	}
+	if err := fetch(ctx, artifactsFile, local); err != nil {
+		return nil, err
+	}
+	if err := sh.Run(ctx, "tar", "-xzf", local, "-C", dir); err != nil {
+		return nil, err
+	}
+	return build.ReadContext(filepath.Join(dir, build.ContextFileName))
+}
+
+func (p *Pipeline) phase(ph build.Phase) {
+	if p.Phases != nil {
+		p.Phases(ph)
+	}
+}
+
+func (p *Pipeline) release(ctx context.Context, builder *build.ProxyBuilder, c *build.BuildContext) error {
+	dir := filepath.Join(p.dir(), "out")
+	if p.Release != nil {
+		p.phase(build.PhaseRelease)
+		return p.Release(ctx, c, dir)
+	}
+	builder.UseContext(c)
+	builder.Spec().Output.Dir = dir
+	return builder.Release(ctx)
+}
+
+func (p *Pipeline) create(ctx context.Context) error {
+	if p.Create != nil {
+		return p.Create(ctx)
+	}
+	return p.Instance.Create(ctx, p.MachineType, p.MachineImage, p.NonSpot)
+}
+
+func (p *Pipeline) delete(ctx context.Context) error {
+	if p.Delete != nil {
+		return p.Delete(ctx)
+	}
+	return p.Instance.Delete(ctx)
+}
+
+func (p *Pipeline) exec(ctx context.Context, script string) error {
+	if p.Exec != nil {
+		return p.Exec(ctx, script)
+	}
+	return sh.RunV(ctx, "gcloud", "compute", "ssh", p.Instance.Name,
+		"--project="+p.Instance.ProjectID, "--zone="+p.Instance.Zone, "--command="+script)
+}
+
+func (p *Pipeline) scp(ctx context.Context, remote, local string) error {
+	return sh.RunV(ctx, "gcloud", "compute", "scp",
+		"--project="+p.Instance.ProjectID, "--zone="+p.Instance.Zone, p.Instance.Name+":"+remote, local)
+}
+
+func (p *Pipeline) dir() string {
+	if len(p.Dir) == 0 {
+		return "pipeline"
+	}
+	return p.Dir
+}
+
+func (p *Pipeline) deleteTimeout() time.Duration {
+	if p.DeleteTimeout == 0 {
+		return 10 * time.Minute
+	}
+	return p.DeleteTimeout
+}
+
+// quote quotes a shell word.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,189 @@
+package pipeline_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/compute"
+	"github.com/dio/leo/pipeline"
+)
+
+// fakeInstance builds on the local filesystem instead of a compute instance.
+type fakeInstance struct {
+	dir      string
+	buildErr error
+	// block makes the build wait for its context to be canceled.
+	block   bool
+	started chan struct{}
+
+	created  bool
+	deleted  bool
+	canceled bool
+	script   string
+	released string
+}
+
+func (f *fakeInstance) pipeline(t *testing.T) *pipeline.Pipeline {
+	return &pipeline.Pipeline{
+		Spec: build.Spec{Target: "istio@1.22.3", FIPSBuild: true, Output: &build.Output{Arch: "amd64", Repo: "tetrateio/proxy-archives"}},
+		Dir:  filepath.Join(f.dir, "fetched"),
+		Create: func(ctx context.Context) error {
+			f.created = true
+			return nil
+		},
+		Delete: func(ctx context.Context) error {
+			f.deleted = true
+			f.canceled = ctx.Err() != nil
+			return nil
+		},
+		Exec: func(ctx context.Context, script string) error {
+			f.script = script
+			if f.block {
+				close(f.started)
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			if f.buildErr != nil {
+				return f.buildErr
+			}
+			remote := filepath.Join(f.dir, "remote")
+			if err := os.MkdirAll(filepath.Join(remote, "out"), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(remote, "out", "envoy"), []byte("envoy"), 0o644); err != nil {
+				return err
+			}
+			c := &build.BuildContext{Target: "istio@1.22.3", Dir: remote}
+			if err := c.Write(filepath.Join(remote, build.ContextFileName)); err != nil {
+				return err
+			}
+			return exec.CommandContext(ctx, "tar", "-czf", filepath.Join(f.dir, "artifacts.tar.gz"), "-C", remote, "out", build.ContextFileName).Run()
+		},
+		Fetch: func(ctx context.Context, remote, local string) error {
+			data, err := os.ReadFile(filepath.Join(f.dir, "artifacts.tar.gz"))
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(local, data, 0o644)
+		},
+		Release: func(ctx context.Context, c *build.BuildContext, dir string) error {
+			if c.Target != "istio@1.22.3" {
+				t.Errorf("released context %+v", c)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "envoy")); err != nil {
+				return err
+			}
+			f.released = dir
+			return nil
+		},
+	}
+}
+
+func phases(results []pipeline.Result) []pipeline.Phase {
+	var phases []pipeline.Phase
+	for _, r := range results {
+		phases = append(phases, r.Phase)
+	}
+	return phases
+}
+
+func TestRun(t *testing.T) {
+	f := &fakeInstance{dir: t.TempDir()}
+	p := f.pipeline(t)
+	var buildPhases []build.Phase
+	p.Phases = func(ph build.Phase) { buildPhases = append(buildPhases, ph) }
+	results, err := p.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []build.Phase{build.PhaseCompile, build.PhaseRelease}; !reflect.DeepEqual(buildPhases, want) {
+		t.Errorf("build phases = %v, want %v", buildPhases, want)
+	}
+	want := []pipeline.Phase{pipeline.PhaseCreate, pipeline.PhaseBuild, pipeline.PhaseFetch, pipeline.PhaseRelease, pipeline.PhaseDelete}
+	if got := phases(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("phases = %v, want %v", got, want)
+	}
+	if !f.deleted || len(f.released) == 0 {
+		t.Errorf("deleted = %v, released = %q", f.deleted, f.released)
+	}
+	if !strings.Contains(f.script, `dir=$('leo' proxy build 'istio@1.22.3'`) ||
+		!strings.Contains(f.script, `'--fips-build'`) ||
+		!strings.Contains(f.script, `make -C "$dir" 'istio-proxy'`) {
+		t.Errorf("script = %s", f.script)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	f := &fakeInstance{dir: t.TempDir(), buildErr: errors.New("make failed")}
+	results, err := f.pipeline(t).Run(context.Background())
+	if err == nil || err.Error() != "make failed" {
+		t.Fatalf("err = %v, want make failed", err)
+	}
+	want := []pipeline.Phase{pipeline.PhaseCreate, pipeline.PhaseBuild, pipeline.PhaseDelete}
+	if got := phases(results); !reflect.DeepEqual(got, want) {
+		t.Errorf("phases = %v, want %v", got, want)
+	}
+	if results[1].Err == nil || results[2].Err != nil {
+		t.Errorf("results = %+v", results)
+	}
+	if !f.deleted || len(f.released) > 0 {
+		t.Errorf("deleted = %v, released = %q", f.deleted, f.released)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	f := &fakeInstance{dir: t.TempDir(), block: true, started: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-f.started:
+			cancel()
+		case <-time.After(5 * time.Second):
+		}
+	}()
+	_, err := f.pipeline(t).Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want canceled", err)
+	}
+	// The instance is deleted with a context which is not canceled.
+	if !f.deleted || f.canceled {
+		t.Errorf("deleted = %v, delete canceled = %v", f.deleted, f.canceled)
+	}
+}
+
+func TestRunDeletesFailedCreation(t *testing.T) {
+	f := &fakeInstance{dir: t.TempDir()}
+	p := f.pipeline(t)
+	p.Create = func(ctx context.Context) error { return errors.New("quota exceeded") }
+	results, err := p.Run(context.Background())
+	if err == nil {
+		t.Fatal("expecting an error")
+	}
+	want := []pipeline.Phase{pipeline.PhaseCreate, pipeline.PhaseDelete}
+	if got := phases(results); !reflect.DeepEqual(got, want) || !f.deleted {
+		t.Errorf("phases = %v, deleted = %v", got, f.deleted)
+	}
+}
+
+func TestRunKeepsExistingInstance(t *testing.T) {
+	f := &fakeInstance{dir: t.TempDir()}
+	p := f.pipeline(t)
+	p.Create = func(ctx context.Context) error { return fmt.Errorf("%w: builder", compute.ErrAlreadyExists) }
+	results, err := p.Run(context.Background())
+	if !errors.Is(err, compute.ErrAlreadyExists) {
+		t.Fatalf("err = %v, want ErrAlreadyExists", err)
+	}
+	want := []pipeline.Phase{pipeline.PhaseCreate}
+	if got := phases(results); !reflect.DeepEqual(got, want) || f.deleted {
+		t.Errorf("phases = %v, deleted = %v", got, f.deleted)
+	}
+}
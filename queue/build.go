@@ -0,0 +1,26 @@
+package queue
+
+// Flavors are the flavors of a build request.
+type Flavors struct {
+	FIPSBuild           bool
+	CryptoUpdateStream  bool
+	Debug               bool
+	DynamicModulesBuild string
+	PatchSourceName     string
+}
+
+func (f Flavors) suffix() string {
+	var suffix string
+	if len(f.DynamicModulesBuild) > 0 {
+		suffix += "-dynamic-modules"
+	}
+	if f.FIPSBuild && f.CryptoUpdateStream {
+		suffix += "-crypto-updatestream"
+	} else if f.FIPSBuild {
+		suffix += "-fips"
+	}
+	if f.Debug {
+		suffix += "-debug"
+	}
+	return suffix
+}
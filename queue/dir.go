@@ -0,0 +1,185 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dir is a queue kept in a local directory, for development and tests. A topic is a directory of
+// message files, its only subscription has the same name. Several processes may receive from the
+// same subscription: a message is leased by moving it to the leased directory.
+type Dir struct {
+	Path string
+	// PollInterval is how often an empty subscription is checked, defaults to a second.
+	PollInterval time.Duration
+	// RetryDelay is how long a nacked message waits before it is delivered again, like the minimum
+	// backoff of a Pub/Sub retry policy. Defaults to 10 seconds.
+	RetryDelay time.Duration
+}
+
+const leasedDir = "leased"
+
+// Publish writes a message file and returns its ID. IDs sort in publishing order.
+func (d *Dir) Publish(_ context.Context, topic string, data []byte) (string, error) {
+	dir := filepath.Join(d.Path, topic)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%019d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	// Written through a temporary file, so a receiver never reads a partial message.
+	tmp := filepath.Join(dir, "."+id+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, filepath.Join(dir, id+".json"))
+}
+
+// Receive receives the messages of a topic, oldest first. A nacked message is delivered again after
+// RetryDelay, and a message left unsettled for longer than opts.MaxExtension right away.
+func (d *Dir) Receive(ctx context.Context, subscription string, opts ReceiveOptions, f func(context.Context, *Message)) error {
+	dir := filepath.Join(d.Path, subscription)
+	leased := filepath.Join(dir, leasedDir)
+	if err := os.MkdirAll(leased, 0o755); err != nil {
+		return err
+	}
+	interval := d.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	retryDelay := d.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = 10 * time.Second
+	}
+
+	slots := make(chan struct{}, max(opts.Concurrency, 1))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		if err := expireLeases(dir, leased, opts.maxExtension()); err != nil {
+			return err
+		}
+		names, err := messageFiles(dir)
+		if err != nil {
+			return err
+		}
+		received := false
+		for _, name := range names {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil
+			}
+			msg, err := lease(dir, leased, name, retryDelay)
+			if err != nil || msg == nil {
+				<-slots
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			received = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				f(ctx, msg)
+			}()
+		}
+		if !received {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+// lease moves a message to the leased directory. It returns a nil message when another receiver
+// leased it first, or when it is not to be delivered yet. The modification time of a pending
+// message is when it may be delivered: a nacked message is put back with one in the future.
+func lease(dir, leased, name string, retryDelay time.Duration) (*Message, error) {
+	pending := filepath.Join(dir, name)
+	path := filepath.Join(leased, name)
+	info, err := os.Stat(pending)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().After(time.Now()) {
+		return nil, nil
+	}
+	if err := os.Rename(pending, path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The lease starts now, not when the message was published.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(strings.TrimSuffix(name, ".json"), data, func(ack bool) {
+		if ack {
+			_ = os.Remove(path)
+			return
+		}
+		notBefore := time.Now().Add(retryDelay)
+		_ = os.Chtimes(path, notBefore, notBefore)
+		_ = os.Rename(path, pending)
+	}), nil
+}
+
+// expireLeases moves the messages leased for longer than maxExtension back to dir.
+func expireLeases(dir, leased string, maxExtension time.Duration) error {
+	names, err := messageFiles(leased)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(leased, name))
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > maxExtension {
+			_ = os.Rename(filepath.Join(leased, name), filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// messageFiles returns the message file names of a directory, sorted.
+func messageFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
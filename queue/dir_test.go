@@ -0,0 +1,142 @@
+package queue_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/queue"
+)
+
+func TestDir(t *testing.T) {
+	q := &queue.Dir{Path: t.TempDir(), PollInterval: time.Millisecond, RetryDelay: 50 * time.Millisecond}
+	ctx := context.Background()
+	var ids []string
+	for _, data := range []string{"a", "b", "c"} {
+		id, err := q.Publish(ctx, "builds", []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var received []string
+	var nacked time.Time
+	var retried time.Duration
+	err := q.Receive(ctx, "builds", queue.ReceiveOptions{}, func(_ context.Context, msg *queue.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, string(msg.Data))
+		// The first delivery of b is nacked, it is redelivered after c, once the retry delay passed.
+		if string(msg.Data) == "b" {
+			if nacked.IsZero() {
+				nacked = time.Now()
+				msg.Nack()
+				return
+			}
+			retried = time.Since(nacked)
+		}
+		msg.Ack()
+		if len(received) == 4 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retried < q.RetryDelay {
+		t.Errorf("redelivered after %s, want at least %s", retried, q.RetryDelay)
+	}
+	want := []string{"a", "b", "c", "b"}
+	if len(received) != len(want) {
+		t.Fatalf("got %v, want %v", received, want)
+	}
+	for i := range want {
+		if received[i] != want[i] {
+			t.Fatalf("got %v, want %v", received, want)
+		}
+	}
+	for _, dir := range []string{"builds", "builds/leased"} {
+		entries, err := os.ReadDir(filepath.Join(q.Path, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				t.Errorf("unexpected file %s/%s", dir, entry.Name())
+			}
+		}
+	}
+	if ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Errorf("IDs are not in publishing order: %v", ids)
+	}
+}
+
+func TestDirExpiredLease(t *testing.T) {
+	q := &queue.Dir{Path: t.TempDir(), PollInterval: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := q.Publish(ctx, "builds", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := 0
+	err := q.Receive(ctx, "builds", queue.ReceiveOptions{MaxExtension: time.Millisecond}, func(_ context.Context, msg *queue.Message) {
+		// Left unsettled, the message is delivered again once its lease expires.
+		if deliveries++; deliveries == 2 {
+			msg.Ack()
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries != 2 {
+		t.Errorf("got %d deliveries, want 2", deliveries)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    queue.Queue
+		wantErr bool
+	}{
+		{url: "", want: &queue.PubSub{}},
+		{url: "pubsub://my-project", want: &queue.PubSub{Project: "my-project"}},
+		{url: "file:///tmp/leo-queue", want: &queue.Dir{Path: "/tmp/leo-queue"}},
+		{url: "file://leo-queue", want: &queue.Dir{Path: "leo-queue"}},
+		{url: "sqs://queue", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, err := queue.Open(tt.url)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expecting an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch want := tt.want.(type) {
+			case *queue.PubSub:
+				if g, ok := got.(*queue.PubSub); !ok || *g != *want {
+					t.Errorf("got %#v, want %#v", got, want)
+				}
+			case *queue.Dir:
+				if g, ok := got.(*queue.Dir); !ok || *g != *want {
+					t.Errorf("got %#v, want %#v", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSub is a Google Cloud Pub/Sub queue. With $PUBSUB_EMULATOR_HOST set, it talks to the emulator
+// and creates the missing topics, and the missing subscriptions to the topic of the same name.
+type PubSub struct {
+	// Project defaults to $GCLOUD_PROJECT.
+	Project string
+}
+
+func (p *PubSub) client(ctx context.Context) (*pubsub.Client, error) {
+	project := p.Project
+	if len(project) == 0 {
+		project = os.Getenv("GCLOUD_PROJECT")
+	}
+	if len(project) == 0 && emulated() {
+		project = "leo"
+	}
+	return pubsub.NewClient(ctx, project)
+}
+
+func emulated() bool {
+	return len(os.Getenv("PUBSUB_EMULATOR_HOST")) > 0
+}
+
+// Publish publishes a message and returns its ID.
+func (p *PubSub) Publish(ctx context.Context, topicID string, msg []byte) (string, error) {
+	client, err := p.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	t, err := topic(ctx, client, topicID)
+	if err != nil {
+		return "", err
+	}
+	defer t.Stop()
+	result := t.Publish(ctx, &pubsub.Message{
+		Data: []byte(msg),
+	})
+	return result.Get(ctx)
+}
+
+// Receive receives the messages of a subscription. Leases are extended while f runs.
+func (p *PubSub) Receive(ctx context.Context, subID string, opts ReceiveOptions, f func(context.Context, *Message)) error {
+	client, err := p.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sub := client.Subscription(subID)
+	if emulated() {
+		ok, err := sub.Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			t, err := topic(ctx, client, subID)
+			if err != nil {
+				return err
+			}
+			if sub, err = client.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{Topic: t}); err != nil {
+				return err
+			}
+		}
+	}
+	sub.ReceiveSettings.MaxOutstandingMessages = max(opts.Concurrency, 1)
+	sub.ReceiveSettings.NumGoroutines = 1
+	sub.ReceiveSettings.MaxExtension = opts.maxExtension()
+	return sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		f(ctx, NewMessage(m.ID, m.Data, func(ack bool) {
+			if ack {
+				m.Ack()
+				return
+			}
+			m.Nack()
+		}))
+	})
+}
+
+// topic returns a topic, created when missing from the emulator.
+func topic(ctx context.Context, client *pubsub.Client, topicID string) (*pubsub.Topic, error) {
+	t := client.Topic(topicID)
+	if !emulated() {
+		return t, nil
+	}
+	ok, err := t.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return t, nil
+	}
+	return client.CreateTopic(ctx, topicID)
+}
@@ -3,12 +3,12 @@ package queue
 import (
 	"context"
 	"fmt"
-	"os"
+	"net/url"
+	"sync"
 	"time"
-
-	"cloud.google.com/go/pubsub"
 )
 
+// InputsBuild is the unversioned request to build istio, superseded by BuildRequest.
 type InputsBuild struct {
 	Name         string `json:"name"`
 	Target       string `json:"target"`
@@ -16,6 +16,7 @@ type InputsBuild struct {
 	Arguments    string `json:"arguments"`
 }
 
+// InputsBuildEnvoy is the unversioned request to build envoy, superseded by BuildRequest.
 type InputsBuildEnvoy struct {
 	Name      string `json:"name"`
 	Target    string `json:"target"`
@@ -23,34 +24,95 @@ type InputsBuildEnvoy struct {
 	Arguments string `json:"arguments"`
 }
 
-func Publish(ctx context.Context, topicID string, msg []byte) error {
-	client, err := pubsub.NewClient(ctx, os.Getenv("GCLOUD_PROJECT"))
-	if err != nil {
-		return err
-	}
-	defer client.Close()
+// Queue publishes messages to topics and receives them from subscriptions.
+type Queue interface {
+	// Publish publishes a message and returns its ID.
+	Publish(ctx context.Context, topic string, data []byte) (string, error)
+	// Receive calls f for every message of a subscription until ctx is done, f must ack or nack the
+	// message. It returns once the outstanding calls of f return.
+	Receive(ctx context.Context, subscription string, opts ReceiveOptions, f func(context.Context, *Message)) error
+}
 
-	t := client.Topic(topicID)
-	result := t.Publish(ctx, &pubsub.Message{
-		Data: []byte(msg),
-	})
-	id, err := result.Get(ctx)
+// Default is used by the package-level functions.
+var Default Queue = &PubSub{}
+
+// Open returns the queue of a URL: pubsub://<project>, the project defaults to $GCLOUD_PROJECT, or
+// file://<dir> for a local directory.
+func Open(rawURL string) (Queue, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid queue %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "", "pubsub":
+		return &PubSub{Project: u.Host}, nil
+	case "file":
+		return &Dir{Path: u.Host + u.Path}, nil
 	}
-	fmt.Println("published", id)
-	return nil
+	return nil, fmt.Errorf("unsupported queue %q, expecting pubsub://<project> or file://<dir>", rawURL)
 }
 
-func Pull(ctx context.Context, subID string, f func(context.Context, *pubsub.Message)) error {
-	client, err := pubsub.NewClient(ctx, os.Getenv("GCLOUD_PROJECT"))
-	if err != nil {
-		return err
+// Publish publishes a message to the default queue and returns its ID.
+func Publish(ctx context.Context, topic string, msg []byte) (string, error) {
+	return Default.Publish(ctx, topic, msg)
+}
+
+// Receive receives the messages of a subscription of the default queue.
+func Receive(ctx context.Context, subscription string, opts ReceiveOptions, f func(context.Context, *Message)) error {
+	return Default.Receive(ctx, subscription, opts, f)
+}
+
+// ReceiveOptions tune Receive for long-running handlers.
+type ReceiveOptions struct {
+	// Concurrency is the number of messages handled at once, defaults to 1.
+	Concurrency int
+	// MaxExtension is how long the lease of a message keeps being extended while it is handled,
+	// defaults to 24 hours.
+	MaxExtension time.Duration
+}
+
+func (o ReceiveOptions) maxExtension() time.Duration {
+	if o.MaxExtension <= 0 {
+		return 24 * time.Hour
 	}
-	defer client.Close()
+	return o.MaxExtension
+}
+
+// Message is a received message.
+type Message struct {
+	ID   string
+	Data []byte
+
+	once sync.Once
+	done func(ack bool)
+}
+
+// NewMessage returns a message calling done once it is acked or nacked.
+func NewMessage(id string, data []byte, done func(ack bool)) *Message {
+	return &Message{ID: id, Data: data, done: done}
+}
+
+// Ack tells the message is handled, it is not delivered again.
+func (m *Message) Ack() {
+	m.settle(true)
+}
+
+// Nack tells the message failed to be handled, it is delivered again.
+func (m *Message) Nack() {
+	m.settle(false)
+}
+
+func (m *Message) settle(ack bool) {
+	m.once.Do(func() {
+		if m.done != nil {
+			m.done(ack)
+		}
+	})
+}
 
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	sub := client.Subscription(subID)
-	return sub.Receive(ctx, f)
+// DeadLetter is published for a message that failed to be handled.
+type DeadLetter struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+	Data  string `json:"data"`
 }
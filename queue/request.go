@@ -0,0 +1,336 @@
+package queue
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/dio/leo/build"
+	"github.com/spf13/pflag"
+)
+
+// BuildRequestVersion is the version of the BuildRequest schema.
+const BuildRequestVersion = 1
+
+// BuildRequestSchema is the JSON schema of BuildRequest.
+//
+//go:embed build-request.schema.json
+var BuildRequestSchema []byte
+
+// BuildRequest is a versioned build request. It maps one-to-one onto build.Spec. For example:
+//
+//	{
+//	  "version": 1,
+//	  "name": "istio-proxy-1.22.3-fips",
+//	  "target": "istio@1.22.3",
+//	  "flavors": {"fips": true},
+//	  "output": {"target": "istio-proxy", "arch": "amd64"}
+//	}
+type BuildRequest struct {
+	Version int    `json:"version"`
+	Name    string `json:"name,omitempty"`
+	// Target is what to build, e.g. istio@1.22.3 or envoyproxy/envoy@v1.30.4.
+	Target      string          `json:"target"`
+	Overrides   *BuildOverrides `json:"overrides,omitempty"`
+	Patch       *BuildPatch     `json:"patch,omitempty"`
+	Flavors     *BuildFlavors   `json:"flavors,omitempty"`
+	Prereleases bool            `json:"prereleases,omitempty"`
+	RemoteCache string          `json:"remoteCache,omitempty"`
+	Output      *BuildOutput    `json:"output,omitempty"`
+}
+
+// BuildOverrides replace the resolved repositories, e.g. tetratelabs/envoy@<sha>.
+type BuildOverrides struct {
+	IstioProxy string `json:"istioProxy,omitempty"`
+	Envoy      string `json:"envoy,omitempty"`
+}
+
+// BuildPatch is where the patches are fetched from. Source and Name default to github://dio/leo
+// and envoy.
+type BuildPatch struct {
+	Source           string `json:"source,omitempty"`
+	Name             string `json:"name,omitempty"`
+	Suffix           string `json:"suffix,omitempty"`
+	AdditionalDir    string `json:"additionalDir,omitempty"`
+	AdditionalSource string `json:"additionalSource,omitempty"`
+}
+
+// BuildFlavors are the build variants. Wasm defaults to true on amd64.
+type BuildFlavors struct {
+	FIPS                bool   `json:"fips,omitempty"`
+	CryptoUpdateStream  bool   `json:"cryptoUpdateStream,omitempty"`
+	Debug               bool   `json:"debug,omitempty"`
+	Wasm                *bool  `json:"wasm,omitempty"`
+	Gperftools          bool   `json:"gperftools,omitempty"`
+	DynamicModulesBuild string `json:"dynamicModulesBuild,omitempty"`
+}
+
+// BuildOutput is where the build is released. Target defaults to istio-proxy, or envoy for envoy
+// targets.
+type BuildOutput struct {
+	Target string `json:"target,omitempty"`
+	Arch   string `json:"arch,omitempty"`
+	Repo   string `json:"repo,omitempty"`
+}
+
+// NewBuildRequest returns a validated request to build a target, e.g. istio@1.22.3 or
+// envoyproxy/envoy@v1.30.4, into an output target. The name defaults to the output target,
+// version and flavors, e.g. istio-proxy-1.22.3-fips.
+func NewBuildRequest(name, outputTarget, target string, f Flavors) (*BuildRequest, error) {
+	if len(name) == 0 {
+		version := target
+		if strings.HasPrefix(target, "istio@") {
+			version = strings.TrimPrefix(target, "istio@")
+		}
+		name = outputTarget + "-" + strings.NewReplacer("/", "-", "@", "-").Replace(version) + f.suffix()
+	}
+	r := &BuildRequest{
+		Version: BuildRequestVersion,
+		Name:    name,
+		Target:  target,
+		Output:  &BuildOutput{Target: outputTarget},
+	}
+	if f.FIPSBuild || f.CryptoUpdateStream || f.Debug || len(f.DynamicModulesBuild) > 0 {
+		r.Flavors = &BuildFlavors{
+			FIPS:                f.FIPSBuild,
+			CryptoUpdateStream:  f.CryptoUpdateStream,
+			Debug:               f.Debug,
+			DynamicModulesBuild: f.DynamicModulesBuild,
+		}
+	}
+	if len(f.PatchSourceName) > 0 {
+		r.Patch = &BuildPatch{Name: f.PatchSourceName}
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := r.Spec(BuildOutput{}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// DecodeBuildRequest decodes a build request. A message without a version is an InputsBuild or an
+// InputsBuildEnvoy, it is upgraded.
+func DecodeBuildRequest(data []byte) (*BuildRequest, error) {
+	var versioned struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, fmt.Errorf("invalid build request: %w", err)
+	}
+	if versioned.Version == nil {
+		return upgrade(data)
+	}
+
+	var r BuildRequest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid build request: %w", err)
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Validate checks the constraints of BuildRequestSchema which decoding does not check: the version,
+// the <repo>@<ref> references and the output arch. Decoding checks the types and unknown fields.
+func (r *BuildRequest) Validate() error {
+	var errs []error
+	if r.Version != BuildRequestVersion {
+		errs = append(errs, fmt.Errorf("unsupported version %d, expecting %d", r.Version, BuildRequestVersion))
+	}
+	if len(r.Target) == 0 {
+		errs = append(errs, errors.New("target is required"))
+	} else if !isRef(r.Target) {
+		errs = append(errs, fmt.Errorf("invalid target %q, expecting <repo>@<ref>", r.Target))
+	}
+	if r.Overrides != nil {
+		if len(r.Overrides.IstioProxy) > 0 && !isRef(r.Overrides.IstioProxy) {
+			errs = append(errs, fmt.Errorf("invalid overrides.istioProxy %q, expecting <repo>@<ref>", r.Overrides.IstioProxy))
+		}
+		if len(r.Overrides.Envoy) > 0 && !isRef(r.Overrides.Envoy) {
+			errs = append(errs, fmt.Errorf("invalid overrides.envoy %q, expecting <repo>@<ref>", r.Overrides.Envoy))
+		}
+	}
+	if r.Flavors != nil && len(r.Flavors.DynamicModulesBuild) > 0 && !isRef(r.Flavors.DynamicModulesBuild) {
+		errs = append(errs, fmt.Errorf("invalid flavors.dynamicModulesBuild %q, expecting <repo>@<ref>", r.Flavors.DynamicModulesBuild))
+	}
+	if r.Output != nil && len(r.Output.Arch) > 0 && r.Output.Arch != "amd64" && r.Output.Arch != "arm64" {
+		errs = append(errs, fmt.Errorf("unsupported output arch %q, expecting amd64 or arm64", r.Output.Arch))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid build request: %w", err)
+	}
+	return nil
+}
+
+// isRef tells whether s is a <repo>@<ref> reference, the ^[^@]+@[^@]+$ pattern of the schema.
+func isRef(s string) bool {
+	parts := strings.Split(s, "@")
+	return len(parts) == 2 && len(parts[0]) > 0 && len(parts[1]) > 0
+}
+
+// Spec returns the build spec of a request. The output arch and repo default to the ones of
+// defaults, then to runtime.GOARCH and tetrateio/proxy-archives.
+func (r *BuildRequest) Spec(defaults BuildOutput) (build.Spec, error) {
+	var (
+		overrides BuildOverrides
+		patch     BuildPatch
+		flavors   BuildFlavors
+		out       BuildOutput
+	)
+	if r.Overrides != nil {
+		overrides = *r.Overrides
+	}
+	if r.Patch != nil {
+		patch = *r.Patch
+	}
+	if r.Flavors != nil {
+		flavors = *r.Flavors
+	}
+	if r.Output != nil {
+		out = *r.Output
+	}
+	output := &build.Output{
+		Target: out.Target,
+		Arch:   firstOf(out.Arch, defaults.Arch, runtime.GOARCH),
+		Repo:   firstOf(out.Repo, defaults.Repo, "tetrateio/proxy-archives"),
+		Debug:  flavors.Debug,
+	}
+	wasm := output.Arch == "amd64"
+	if flavors.Wasm != nil {
+		wasm = *flavors.Wasm
+	}
+	spec := build.Spec{
+		Target:                r.Target,
+		OverrideIstioProxy:    overrides.IstioProxy,
+		OverrideEnvoy:         overrides.Envoy,
+		PatchSource:           firstOf(patch.Source, "github://dio/leo"),
+		PatchSourceName:       firstOf(patch.Name, "envoy"),
+		PatchSuffix:           patch.Suffix,
+		AdditionalPatchDir:    patch.AdditionalDir,
+		AdditionalPatchSource: patch.AdditionalSource,
+		DynamicModulesBuild:   flavors.DynamicModulesBuild,
+		RemoteCache:           r.RemoteCache,
+		Prereleases:           r.Prereleases,
+		FIPSBuild:             flavors.FIPS,
+		CryptoUpdateStream:    flavors.CryptoUpdateStream,
+		Wasm:                  wasm,
+		Gperftools:            flavors.Gperftools,
+		Debug:                 flavors.Debug,
+		Output:                output,
+	}
+	if err := spec.Validate(); err != nil {
+		return build.Spec{}, fmt.Errorf("invalid build request: %w", err)
+	}
+	return spec, nil
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// Upgrade returns the versioned request of an InputsBuild.
+func (r InputsBuild) Upgrade() (*BuildRequest, error) {
+	if len(r.IstioVersion) == 0 {
+		return nil, errors.New("invalid build request: istioVersion is required")
+	}
+	return upgradeArguments(r.Name, r.Target, "istio@"+r.IstioVersion, r.Arguments)
+}
+
+// Upgrade returns the versioned request of an InputsBuildEnvoy.
+func (r InputsBuildEnvoy) Upgrade() (*BuildRequest, error) {
+	if len(r.Envoy) == 0 {
+		return nil, errors.New("invalid build request: envoy is required")
+	}
+	return upgradeArguments(r.Name, r.Target, r.Envoy, r.Arguments)
+}
+
+func upgrade(data []byte) (*BuildRequest, error) {
+	var legacy struct {
+		InputsBuild
+		Envoy string `json:"envoy"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("invalid build request: %w", err)
+	}
+	switch {
+	case len(legacy.IstioVersion) > 0 && len(legacy.Envoy) > 0:
+		return nil, errors.New("invalid build request: both istioVersion and envoy are set")
+	case len(legacy.IstioVersion) > 0:
+		return legacy.InputsBuild.Upgrade()
+	case len(legacy.Envoy) > 0:
+		return InputsBuildEnvoy{
+			Name:      legacy.Name,
+			Target:    legacy.Target,
+			Envoy:     legacy.Envoy,
+			Arguments: legacy.Arguments,
+		}.Upgrade()
+	}
+	return nil, errors.New("invalid build request: either version, istioVersion or envoy is required")
+}
+
+// upgradeArguments parses the "proxy" command flags of an unversioned request, e.g.
+// "--fips-build --patch-source-name=envoy".
+func upgradeArguments(name, outputTarget, target, arguments string) (*BuildRequest, error) {
+	var (
+		overrides BuildOverrides
+		patch     BuildPatch
+		flavors   BuildFlavors
+		wasm      bool
+	)
+	r := &BuildRequest{Version: BuildRequestVersion, Name: name, Target: target}
+	flags := pflag.NewFlagSet("arguments", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&overrides.IstioProxy, "override-istio-proxy", "", "")
+	flags.StringVar(&overrides.Envoy, "override-envoy", "", "")
+	flags.StringVar(&patch.Source, "patch-source", "", "")
+	flags.StringVar(&patch.Name, "patch-source-name", "", "")
+	flags.StringVar(&patch.Suffix, "patch-suffix", "", "")
+	flags.StringVar(&patch.AdditionalDir, "additional-patch-dir", "", "")
+	flags.StringVar(&patch.AdditionalSource, "additional-patch-source", "", "")
+	flags.BoolVar(&flavors.FIPS, "fips-build", false, "")
+	flags.BoolVar(&flavors.CryptoUpdateStream, "crypto-updatestream", false, "")
+	flags.BoolVar(&flavors.Debug, "debug", false, "")
+	flags.BoolVar(&wasm, "wasm", false, "")
+	flags.BoolVar(&flavors.Gperftools, "gperftools", false, "")
+	flags.StringVar(&flavors.DynamicModulesBuild, "dynamic-modules-build", "", "")
+	flags.StringVar(&r.RemoteCache, "remote-cache", "", "")
+	flags.BoolVar(&r.Prereleases, "prereleases", false, "")
+	if err := flags.Parse(strings.Fields(arguments)); err != nil {
+		return nil, fmt.Errorf("invalid build request arguments %q: %w", arguments, err)
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("invalid build request arguments %q: unexpected %q", arguments, flags.Args())
+	}
+	if flags.Changed("wasm") {
+		flavors.Wasm = &wasm
+	}
+
+	if overrides != (BuildOverrides{}) {
+		r.Overrides = &overrides
+	}
+	if patch != (BuildPatch{}) {
+		r.Patch = &patch
+	}
+	if flavors != (BuildFlavors{}) {
+		r.Flavors = &flavors
+	}
+	if len(outputTarget) > 0 {
+		r.Output = &BuildOutput{Target: outputTarget}
+	}
+	return r, r.Validate()
+}
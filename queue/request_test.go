@@ -0,0 +1,206 @@
+package queue_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+)
+
+func TestDecodeBuildRequest(t *testing.T) {
+	yes := true
+	no := false
+	tests := []struct {
+		name    string
+		data    string
+		want    *queue.BuildRequest
+		wantErr string
+	}{
+		{
+			name: "versioned",
+			data: `{"version":1,"target":"istio@1.22.3","flavors":{"fips":true,"wasm":true},"output":{"arch":"arm64"}}`,
+			want: &queue.BuildRequest{
+				Version: 1,
+				Target:  "istio@1.22.3",
+				Flavors: &queue.BuildFlavors{FIPS: true, Wasm: &yes},
+				Output:  &queue.BuildOutput{Arch: "arm64"},
+			},
+		},
+		{
+			name: "unversioned istio",
+			data: `{"name":"istio-proxy-fips","target":"istio-proxy","istioVersion":"1.22.3","arguments":"--fips-build --patch-source-name=envoy-fips --wasm=false"}`,
+			want: &queue.BuildRequest{
+				Version: 1,
+				Name:    "istio-proxy-fips",
+				Target:  "istio@1.22.3",
+				Patch:   &queue.BuildPatch{Name: "envoy-fips"},
+				Flavors: &queue.BuildFlavors{FIPS: true, Wasm: &no},
+				Output:  &queue.BuildOutput{Target: "istio-proxy"},
+			},
+		},
+		{
+			name: "unversioned envoy",
+			data: `{"target":"envoy","envoy":"envoyproxy/envoy@v1.30.4","arguments":""}`,
+			want: &queue.BuildRequest{Version: 1, Target: "envoyproxy/envoy@v1.30.4", Output: &queue.BuildOutput{Target: "envoy"}},
+		},
+		{name: "unknown field", data: `{"version":1,"target":"istio@1.22.3","fips":true}`, wantErr: `unknown field "fips"`},
+		{name: "unsupported version", data: `{"version":2,"target":"istio@1.22.3"}`, wantErr: "unsupported version 2"},
+		{name: "missing target", data: `{"version":1}`, wantErr: "target is required"},
+		{name: "invalid target", data: `{"version":1,"target":"istio"}`, wantErr: `invalid target "istio"`},
+		{name: "invalid istio proxy override", data: `{"version":1,"target":"istio@1.22.3","overrides":{"istioProxy":"istio/proxy"}}`, wantErr: `invalid overrides.istioProxy "istio/proxy"`},
+		{name: "invalid envoy override", data: `{"version":1,"target":"istio@1.22.3","overrides":{"envoy":"@f00ba47"}}`, wantErr: `invalid overrides.envoy "@f00ba47"`},
+		{name: "invalid dynamic modules build", data: `{"version":1,"target":"istio@1.22.3","flavors":{"dynamicModulesBuild":"a@b@c"}}`, wantErr: `invalid flavors.dynamicModulesBuild "a@b@c"`},
+		{name: "unsupported arch", data: `{"version":1,"target":"istio@1.22.3","output":{"arch":"s390x"}}`, wantErr: `unsupported output arch "s390x"`},
+		{name: "unknown argument", data: `{"istioVersion":"1.22.3","arguments":"--nope"}`, wantErr: "unknown flag: --nope"},
+		{name: "positional argument", data: `{"istioVersion":"1.22.3","arguments":"istio"}`, wantErr: "unexpected"},
+		{name: "both", data: `{"istioVersion":"1.22.3","envoy":"envoyproxy/envoy@v1.30.4"}`, wantErr: "both istioVersion and envoy are set"},
+		{name: "none", data: `{"target":"istio-proxy"}`, wantErr: "either version, istioVersion or envoy is required"},
+		{name: "not json", data: `istio`, wantErr: "invalid build request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queue.DecodeBuildRequest([]byte(tt.data))
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DecodeBuildRequest() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Fatalf("DecodeBuildRequest() = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestBuildRequestSpec(t *testing.T) {
+	no := false
+	tests := []struct {
+		name    string
+		req     queue.BuildRequest
+		want    build.Spec
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			req:  queue.BuildRequest{Version: 1, Target: "istio@1.22.3"},
+			want: build.Spec{
+				Target:          "istio@1.22.3",
+				PatchSource:     "github://dio/leo",
+				PatchSourceName: "envoy",
+				Wasm:            true,
+				Output:          &build.Output{Arch: "amd64", Repo: "tetrateio/proxy-archives"},
+			},
+		},
+		{
+			name: "everything",
+			req: queue.BuildRequest{
+				Version:     1,
+				Target:      "istio@1.22.3",
+				Overrides:   &queue.BuildOverrides{IstioProxy: "tetratelabs/proxy@abc"},
+				Patch:       &queue.BuildPatch{Source: "file://patches", Name: "envoy-fips", Suffix: "-nist-"},
+				Flavors:     &queue.BuildFlavors{FIPS: true, CryptoUpdateStream: true, Debug: true, Wasm: &no},
+				Prereleases: true,
+				RemoteCache: "us-central1",
+				Output:      &queue.BuildOutput{Target: "istio-proxy", Arch: "arm64", Repo: "dio/archives"},
+			},
+			want: build.Spec{
+				Target:             "istio@1.22.3",
+				OverrideIstioProxy: "tetratelabs/proxy@abc",
+				PatchSource:        "file://patches",
+				PatchSourceName:    "envoy-fips",
+				PatchSuffix:        "-nist-",
+				RemoteCache:        "us-central1",
+				Prereleases:        true,
+				FIPSBuild:          true,
+				CryptoUpdateStream: true,
+				Debug:              true,
+				Output:             &build.Output{Target: "istio-proxy", Arch: "arm64", Repo: "dio/archives", Debug: true},
+			},
+		},
+		{
+			name:    "crypto update stream without fips",
+			req:     queue.BuildRequest{Version: 1, Target: "istio@1.22.3", Flavors: &queue.BuildFlavors{CryptoUpdateStream: true}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.req.Spec(queue.BuildOutput{Arch: "amd64"})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expecting an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Spec() = %+v (output %+v), want %+v (output %+v)", got, got.Output, tt.want, tt.want.Output)
+			}
+		})
+	}
+}
+
+func TestNewBuildRequest(t *testing.T) {
+	got, err := queue.NewBuildRequest("", "envoy", "envoyproxy/envoy@v1.30.4", queue.Flavors{FIPSBuild: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(got)
+	if want := `{"version":1,"name":"envoy-envoyproxy-envoy-v1.30.4-fips","target":"envoyproxy/envoy@v1.30.4","flavors":{"fips":true},"output":{"target":"envoy"}}`; string(data) != want {
+		t.Fatalf("NewBuildRequest() = %s, want %s", data, want)
+	}
+	if _, err := queue.NewBuildRequest("", "istio-proxy", "istio@1.22.3", queue.Flavors{CryptoUpdateStream: true}); err == nil {
+		t.Fatal("expecting an error")
+	}
+}
+
+// TestBuildRequestSchema keeps the JSON schema in sync with BuildRequest.
+func TestBuildRequestSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(queue.BuildRequestSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	var properties []string
+	for name, p := range schema.Properties {
+		properties = append(properties, name)
+		for nested := range p.Properties {
+			properties = append(properties, name+"."+nested)
+		}
+	}
+	sort.Strings(properties)
+
+	var fields []string
+	var walk func(prefix string, typ reflect.Type)
+	walk = func(prefix string, typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			name := prefix + strings.Split(f.Tag.Get("json"), ",")[0]
+			fields = append(fields, name)
+			if f.Type.Kind() == reflect.Pointer && f.Type.Elem().Kind() == reflect.Struct {
+				walk(name+".", f.Type.Elem())
+			}
+		}
+	}
+	walk("", reflect.TypeOf(queue.BuildRequest{}))
+	sort.Strings(fields)
+
+	if !reflect.DeepEqual(properties, fields) {
+		t.Fatalf("schema properties = %v, BuildRequest fields = %v", properties, fields)
+	}
+}
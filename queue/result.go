@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/dio/leo/build"
+)
+
+// BuildResultVersion is the version of the BuildResult schema.
+const BuildResultVersion = 1
+
+// Status is the state of a build request.
+type Status string
+
+const (
+	// StatusQueued is a request published but not picked by a worker yet.
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// Failure classifies a failed build request by the step that failed.
+type Failure string
+
+const (
+	// FailureInvalidRequest is a malformed request, it fails again when retried.
+	FailureInvalidRequest Failure = "invalid-request"
+	// FailurePrepare is a failure to resolve, fetch or patch the sources.
+	FailurePrepare Failure = "prepare"
+	// FailureCompile is a failed make target.
+	FailureCompile Failure = "compile"
+	// FailureRelease is a failure to upload the artifacts.
+	FailureRelease Failure = "release"
+	// FailureCanceled is a build stopped by the worker shutting down.
+	FailureCanceled Failure = "canceled"
+)
+
+// BuildResult is published once a build request is handled.
+type BuildResult struct {
+	Version int `json:"version"`
+	// RequestID is the message ID of the build request.
+	RequestID string `json:"requestID"`
+	Name      string `json:"name,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Status    Status `json:"status"`
+	// Failure and Error are set for a failed request.
+	Failure         Failure   `json:"failure,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	// Key identifies the artifacts of the request, requests with the same key are duplicates.
+	Key string `json:"key,omitempty"`
+	// CoalescedWith is the ID of the request the build was shared with, for a duplicate received
+	// while that request was built.
+	CoalescedWith string `json:"coalescedWith,omitempty"`
+	// AlreadyReleased is set when the artifacts were released before, nothing was built.
+	AlreadyReleased bool `json:"alreadyReleased,omitempty"`
+	// Coordinates are the resolved sources, when the request got that far.
+	Coordinates *BuildCoordinates `json:"coordinates,omitempty"`
+	// Artifacts are only set once released, by this request or a previous one.
+	Artifacts *BuildArtifacts `json:"artifacts,omitempty"`
+}
+
+// BuildCoordinates are the resolved Istio, proxy and envoy sources of a build.
+type BuildCoordinates struct {
+	Istio build.IstioCoordinates  `json:"istio"`
+	Proxy build.SourceCoordinates `json:"proxy"`
+	Envoy build.EnvoyCoordinates  `json:"envoy"`
+}
+
+// BuildArtifacts are where a build is released.
+type BuildArtifacts struct {
+	// GCS is the gs:// URL of the tarball.
+	GCS        string `json:"gcs"`
+	ReleaseTag string `json:"releaseTag"`
+	ReleaseURL string `json:"releaseURL"`
+}
+
+// Describe sets the coordinates of a result from a build description.
+func (r *BuildResult) Describe(d *build.Description) {
+	r.Coordinates = &BuildCoordinates{Istio: d.Istio, Proxy: d.Proxy, Envoy: d.Envoy}
+}
+
+// Released sets the artifacts of a result from a build description, once they are released.
+func (r *BuildResult) Released(d *build.Description) {
+	r.Artifacts = &BuildArtifacts{
+		GCS:        d.GCS,
+		ReleaseTag: d.Release.Tag,
+		ReleaseURL: "https://github.com/" + d.Release.Repo + "/releases/tag/" + d.Release.Tag,
+	}
+}
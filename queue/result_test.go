@@ -0,0 +1,31 @@
+package queue_test
+
+import (
+	"testing"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+)
+
+func TestBuildResultDescribe(t *testing.T) {
+	d := &build.Description{
+		Istio:   build.IstioCoordinates{Ref: "istio@1.22.3", SHA: "5f6b3bd"},
+		GCS:     "gs://bucket/istio-proxy-1.22.3.tar.gz",
+		Release: build.ReleaseCoordinates{Repo: "tetrateio/proxy-archives", Tag: "istio-proxy-1.22.3"},
+	}
+	var r queue.BuildResult
+	r.Describe(d)
+	// A build which is not released yet has no artifacts.
+	if r.Coordinates == nil || r.Coordinates.Istio.SHA != "5f6b3bd" || r.Artifacts != nil {
+		t.Fatalf("Describe() = %+v", r)
+	}
+	r.Released(d)
+	want := queue.BuildArtifacts{
+		GCS:        "gs://bucket/istio-proxy-1.22.3.tar.gz",
+		ReleaseTag: "istio-proxy-1.22.3",
+		ReleaseURL: "https://github.com/tetrateio/proxy-archives/releases/tag/istio-proxy-1.22.3",
+	}
+	if r.Artifacts == nil || *r.Artifacts != want {
+		t.Fatalf("Released() artifacts = %+v, want %+v", r.Artifacts, want)
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dio/leo/arg"
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/envoy"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+)
+
+// Server is the HTTP API of leo:
+//
+//	POST /v1/builds                  submits a queue.BuildRequest, returns its record
+//	GET  /v1/builds                  lists the build records, filtered by the query
+//	GET  /v1/builds/{id}             returns a build record
+//	GET  /v1/builds/{id}/artifacts   returns the artifacts of a build
+//	POST /v1/describe                describes a queue.BuildRequest without building it
+//	GET  /v1/resolve?target=<ref>    resolves the dependency chain of a reference
+type Server struct {
+	Queue queue.Queue
+	Store store.Store
+	// Topic is where the submitted builds are published.
+	Topic string
+	// Arch and Repo are the output settings of the requests leaving them out.
+	Arch string
+	Repo string
+	// Token, when set, is the bearer token required by every request.
+	Token string
+}
+
+// maxRequestSize bounds the request bodies, a build request is small.
+const maxRequestSize = 1 << 20
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/builds", s.builds)
+	mux.HandleFunc("/v1/builds/", s.build)
+	mux.HandleFunc("/v1/describe", s.describe)
+	mux.HandleFunc("/v1/resolve", s.resolve)
+	return s.authorize(mux)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.Token) > 0 {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serve serves the API on addr until ctx is done.
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+func (s *Server) builds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.submit(w, r)
+	case http.MethodGet:
+		s.list(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// submit validates a build request, records it as queued and publishes it.
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	req, spec, err := s.decode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Published with the output resolved here, so the worker builds what the record tells.
+	req.Output = &queue.BuildOutput{Target: spec.Output.Target, Arch: spec.Output.Arch, Repo: spec.Output.Repo}
+	data, err := json.Marshal(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	id, err := s.Queue.Publish(r.Context(), s.Topic, data)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("failed to publish the build request: %w", err))
+		return
+	}
+
+	now := time.Now()
+	record := &store.Record{
+		BuildResult: queue.BuildResult{
+			Version:   queue.BuildResultVersion,
+			RequestID: id,
+			Name:      req.Name,
+			Target:    req.Target,
+			Status:    queue.StatusQueued,
+			StartedAt: now,
+		},
+		Request:      req,
+		OutputTarget: spec.Output.Target,
+		Arch:         spec.Output.Arch,
+		UpdatedAt:    now,
+	}
+	// The request is published, a missing record only delays its status until a worker picks it. A
+	// worker may have picked it already, its record is kept.
+	err = s.Store.Create(r.Context(), record)
+	if errors.Is(err, store.ErrExists) {
+		var existing *store.Record
+		if existing, err = s.Store.Get(r.Context(), id); err == nil {
+			record = existing
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "request", id, "record failed to be stored:", err)
+	}
+	writeJSON(w, http.StatusAccepted, record)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := store.Filter{
+		Name:         query.Get("name"),
+		Istio:        query.Get("istio"),
+		OutputTarget: query.Get("target"),
+		Arch:         query.Get("arch"),
+		Status:       queue.Status(query.Get("status")),
+	}
+	if v := query.Get("fips"); len(v) > 0 {
+		fips, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid fips %q", v))
+			return
+		}
+		filter.FIPS = &fips
+	}
+	if v := query.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		filter.Limit = limit
+	}
+	records, err := s.Store.List(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if records == nil {
+		records = []*store.Record{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// build serves /v1/builds/{id} and /v1/builds/{id}/artifacts.
+func (s *Server) build(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/builds/"), "/")
+	if len(id) == 0 || (len(rest) > 0 && rest != "artifacts") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+	record, err := s.Store.Get(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("build %s not found", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if rest != "artifacts" {
+		writeJSON(w, http.StatusOK, record)
+		return
+	}
+	if record.Artifacts == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("build %s has no artifacts yet", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, record.Artifacts)
+}
+
+// describe resolves a build request into the description of what it builds.
+func (s *Server) describe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	_, spec, err := s.decode(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	builder, err := build.New(spec)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d, err := builder.Describe(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// resolve serves the "resolve" command: the chain of an istio or proxy reference, or the Istio
+// workspace of an envoy reference. With all=true, every Istio release using that envoy version.
+func (s *Server) resolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	target := query.Get("target")
+	v := arg.Version(target)
+	switch arg.Repo(v.Name()).Name() {
+	case "istio", "proxy", "tetrateio-proxy":
+		prereleases, _ := strconv.ParseBool(query.Get("prereleases"))
+		chain, err := build.ResolveChain(r.Context(), target, prereleases)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, chain)
+	case "envoy":
+		if all, _ := strconv.ParseBool(query.Get("all")); all {
+			tags, err := envoy.CompatibleReleases(r.Context(), v)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"target": target, "istioReleases": tags})
+			return
+		}
+		sha, err := envoy.ResolveWorkspace(r.Context(), v)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"target": target, "istio": sha})
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported reference %q, supported references: istio@<ref>, istio/proxy@<ref>, tetrateio-proxy@<ref>, envoyproxy/envoy@<ref>", target))
+	}
+}
+
+// decode reads a build request body and returns it with its spec.
+func (s *Server) decode(r *http.Request) (*queue.BuildRequest, build.Spec, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestSize))
+	if err != nil {
+		return nil, build.Spec{}, err
+	}
+	req, err := queue.DecodeBuildRequest(data)
+	if err != nil {
+		return nil, build.Spec{}, err
+	}
+	spec, err := req.Spec(queue.BuildOutput{Arch: s.Arch, Repo: s.Repo})
+	if err != nil {
+		return nil, build.Spec{}, err
+	}
+	return req, spec, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
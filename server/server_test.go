@@ -0,0 +1,197 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/server"
+	"github.com/dio/leo/store"
+)
+
+func newServer(t *testing.T, token string) (*httptest.Server, *queue.Dir, store.Store) {
+	t.Helper()
+	q := &queue.Dir{Path: t.TempDir(), PollInterval: 10 * time.Millisecond}
+	s := &store.Dir{Path: t.TempDir()}
+	srv := httptest.NewServer((&server.Server{
+		Queue: q,
+		Store: s,
+		Topic: "builds",
+		Arch:  "amd64",
+		Repo:  "tetrateio/proxy-archives",
+		Token: token,
+	}).Handler())
+	t.Cleanup(srv.Close)
+	return srv, q, s
+}
+
+func do(t *testing.T, method, url, token, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestSubmit(t *testing.T) {
+	srv, q, s := newServer(t, "")
+
+	status, body := do(t, http.MethodPost, srv.URL+"/v1/builds", "",
+		`{"version":1,"name":"istio-proxy-1.22.3-fips","target":"istio@1.22.3","output":{"target":"istio-proxy"},"flavors":{"fips":true}}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("status = %d, body = %s", status, body)
+	}
+	var submitted store.Record
+	if err := json.Unmarshal([]byte(body), &submitted); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted.RequestID) == 0 || submitted.Status != queue.StatusQueued || submitted.Arch != "amd64" {
+		t.Errorf("submitted = %+v", submitted)
+	}
+
+	// The request is published as submitted.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var published *queue.BuildRequest
+	err := q.Receive(ctx, "builds", queue.ReceiveOptions{}, func(_ context.Context, m *queue.Message) {
+		defer cancel()
+		m.Ack()
+		if m.ID != submitted.RequestID {
+			t.Errorf("published %s, submitted %s", m.ID, submitted.RequestID)
+		}
+		var err error
+		if published, err = queue.DecodeBuildRequest(m.Data); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		t.Fatal(err)
+	}
+	if published == nil || published.Name != "istio-proxy-1.22.3-fips" {
+		t.Fatalf("published = %+v", published)
+	}
+	// The output defaults of the server are published along with the request.
+	if out := published.Output; out == nil || out.Arch != "amd64" || out.Repo != "tetrateio/proxy-archives" {
+		t.Errorf("published output = %+v", out)
+	}
+
+	// The record of the request is served.
+	status, body = do(t, http.MethodGet, srv.URL+"/v1/builds/"+submitted.RequestID, "", "")
+	if status != http.StatusOK || !strings.Contains(body, `"status": "queued"`) {
+		t.Errorf("get: status = %d, body = %s", status, body)
+	}
+	status, body = do(t, http.MethodGet, srv.URL+"/v1/builds/"+submitted.RequestID+"/artifacts", "", "")
+	if status != http.StatusNotFound {
+		t.Errorf("artifacts: status = %d, body = %s", status, body)
+	}
+
+	// Once built, the artifacts are served.
+	record, err := s.Get(context.Background(), submitted.RequestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Status = queue.StatusSucceeded
+	record.Artifacts = &queue.BuildArtifacts{GCS: "gs://bucket/istio-proxy.tar.gz"}
+	if err := s.Put(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	status, body = do(t, http.MethodGet, srv.URL+"/v1/builds/"+submitted.RequestID+"/artifacts", "", "")
+	if status != http.StatusOK || !strings.Contains(body, "gs://bucket/istio-proxy.tar.gz") {
+		t.Errorf("artifacts: status = %d, body = %s", status, body)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	srv, _, s := newServer(t, "secret")
+	start := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+	for _, r := range []*store.Record{
+		{BuildResult: queue.BuildResult{RequestID: "1", Name: "istio-proxy-1.22.3", Status: queue.StatusSucceeded, StartedAt: start}, Arch: "amd64"},
+		{BuildResult: queue.BuildResult{RequestID: "2", Name: "istio-proxy-1.22.3-fips", Status: queue.StatusFailed, StartedAt: start.Add(time.Minute)}, Arch: "arm64"},
+	} {
+		if err := s.Put(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		status   int
+		contains string
+	}{
+		{"no token", http.MethodGet, "/v1/builds", "", "", http.StatusUnauthorized, "bearer token"},
+		{"wrong token", http.MethodGet, "/v1/builds", "wrong", "", http.StatusUnauthorized, "bearer token"},
+		{"list", http.MethodGet, "/v1/builds", "secret", "", http.StatusOK, `"requestID": "2"`},
+		{"list filtered", http.MethodGet, "/v1/builds?arch=amd64&status=succeeded", "secret", "", http.StatusOK, `"requestID": "1"`},
+		{"list none", http.MethodGet, "/v1/builds?arch=s390x", "secret", "", http.StatusOK, "[]"},
+		{"invalid limit", http.MethodGet, "/v1/builds?limit=x", "secret", "", http.StatusBadRequest, "invalid limit"},
+		{"invalid fips", http.MethodGet, "/v1/builds?fips=maybe", "secret", "", http.StatusBadRequest, "invalid fips"},
+		{"get", http.MethodGet, "/v1/builds/1", "secret", "", http.StatusOK, `"name": "istio-proxy-1.22.3"`},
+		{"unknown build", http.MethodGet, "/v1/builds/3", "secret", "", http.StatusNotFound, "not found"},
+		{"unknown path", http.MethodGet, "/v1/builds/1/logs", "secret", "", http.StatusNotFound, "unknown path"},
+		{"wrong method", http.MethodDelete, "/v1/builds/1", "secret", "", http.StatusMethodNotAllowed, "method not allowed"},
+		{"invalid request", http.MethodPost, "/v1/builds", "secret", `{"version":1,"target":"istio@1.22.3","unknown":true}`, http.StatusBadRequest, "unknown"},
+		{"invalid spec", http.MethodPost, "/v1/builds", "secret", `{"version":1,"name":"x","target":"nginx@1.0","output":{"target":"istio-proxy"}}`, http.StatusBadRequest, "error"},
+		{"describe invalid request", http.MethodPost, "/v1/describe", "secret", `{`, http.StatusBadRequest, "error"},
+		{"unsupported reference", http.MethodGet, "/v1/resolve?target=nginx@1.0", "secret", "", http.StatusBadRequest, "unsupported reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := do(t, tt.method, srv.URL+tt.path, tt.token, tt.body)
+			if status != tt.status || !strings.Contains(body, tt.contains) {
+				t.Errorf("status = %d, body = %s, want %d containing %q", status, body, tt.status, tt.contains)
+			}
+		})
+	}
+}
+
+// pickedQueue is a queue which request is picked by a worker as soon as it is published.
+type pickedQueue struct {
+	queue.Queue
+	store store.Store
+}
+
+func (q *pickedQueue) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return "1", q.store.Put(ctx, &store.Record{BuildResult: queue.BuildResult{RequestID: "1", Status: queue.StatusRunning}})
+}
+
+func TestSubmitKeepsRecord(t *testing.T) {
+	s := &store.Dir{Path: t.TempDir()}
+	srv := httptest.NewServer((&server.Server{Queue: &pickedQueue{store: s}, Store: s, Topic: "builds"}).Handler())
+	defer srv.Close()
+
+	status, body := do(t, http.MethodPost, srv.URL+"/v1/builds", "",
+		`{"version":1,"name":"istio-proxy-1.22.3","target":"istio@1.22.3","output":{"target":"istio-proxy"}}`)
+	if status != http.StatusAccepted || !strings.Contains(body, `"status": "running"`) {
+		t.Errorf("status = %d, body = %s", status, body)
+	}
+	record, err := s.Get(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != queue.StatusRunning {
+		t.Errorf("record status = %s, want running", record.Status)
+	}
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+)
+
+// Recorder keeps the record of a build up to date while it runs. Failing to record is only worth a
+// warning, it does not fail the build. A Recorder without a store records nothing.
+type Recorder struct {
+	ctx    context.Context
+	store  Store
+	result *queue.BuildResult
+	record *Record
+}
+
+// NewRecorder returns the recorder of a build result, which is copied into the record every time
+// it is stored. A build recorded again, e.g. a redelivered request, starts a new attempt.
+func NewRecorder(ctx context.Context, s Store, result *queue.BuildResult) *Recorder {
+	r := &Recorder{ctx: ctx, store: s, result: result, record: &Record{}}
+	if r.store == nil {
+		return r
+	}
+	previous, err := r.store.Get(ctx, result.RequestID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		fmt.Fprintln(os.Stderr, "build", result.RequestID, "record failed to be read:", err)
+	}
+	if previous != nil {
+		r.record.Attempt = previous.Attempt
+	}
+	r.record.Attempt++
+	r.put()
+	return r
+}
+
+// Update changes the record and stores it.
+func (r *Recorder) Update(f func(*Record)) {
+	f(r.record)
+	r.put()
+}
+
+// Phase records the start of a phase, it fits build.ProxyBuilder.UsePhases.
+func (r *Recorder) Phase(p build.Phase) {
+	if r.store == nil || r.record.Phase() == p {
+		return
+	}
+	r.record.Start(p, time.Now())
+	r.put()
+}
+
+// Finish records the end of the build, with the status of its result.
+func (r *Recorder) Finish() {
+	r.record.Finish(time.Now())
+	r.put()
+}
+
+func (r *Recorder) put() {
+	if r.store == nil {
+		return
+	}
+	r.record.BuildResult = *r.result
+	if r.record.FinishedAt == nil {
+		r.record.Status = queue.StatusRunning
+	}
+	r.record.UpdatedAt = time.Now()
+	if err := r.store.Put(r.ctx, r.record); err != nil {
+		fmt.Fprintln(os.Stderr, "build", r.result.RequestID, "record failed to be stored:", err)
+	}
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+)
+
+// ErrNotFound is returned by Get for an unknown build.
+var ErrNotFound = errors.New("build not found")
+
+// ErrExists is returned by Create for a build which is already recorded.
+var ErrExists = errors.New("build already recorded")
+
+// Record is the history of a build request. It is the result of the request, along with the
+// request itself and the timestamps of its phases.
+type Record struct {
+	queue.BuildResult
+	Request *queue.BuildRequest `json:"request,omitempty"`
+	// OutputTarget, Arch and Flavors are what was built.
+	OutputTarget string         `json:"outputTarget,omitempty"`
+	Arch         string         `json:"arch,omitempty"`
+	Flavors      *build.Flavors `json:"flavors,omitempty"`
+	// Attempt counts the deliveries of the request, the phases are the ones of the last attempt.
+	Attempt    int           `json:"attempt"`
+	Phases     []PhaseRecord `json:"phases"`
+	UpdatedAt  time.Time     `json:"updatedAt"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"`
+}
+
+// PhaseRecord is a phase of a build. A phase finishes when the next one starts, or when the build
+// finishes.
+type PhaseRecord struct {
+	Phase      build.Phase `json:"phase"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+}
+
+// Start records the start of a phase. Reporting the current phase again does nothing.
+func (r *Record) Start(p build.Phase, now time.Time) {
+	if n := len(r.Phases); n > 0 {
+		last := &r.Phases[n-1]
+		if last.Phase == p {
+			return
+		}
+		if last.FinishedAt == nil {
+			last.FinishedAt = &now
+		}
+	}
+	r.Phases = append(r.Phases, PhaseRecord{Phase: p, StartedAt: now})
+	r.UpdatedAt = now
+}
+
+// Finish records the final status of a build, the last phase finishes with it.
+func (r *Record) Finish(now time.Time) {
+	if n := len(r.Phases); n > 0 && r.Phases[n-1].FinishedAt == nil {
+		r.Phases[n-1].FinishedAt = &now
+	}
+	r.FinishedAt = &now
+	r.UpdatedAt = now
+}
+
+// Phase returns the last started phase, empty when none started.
+func (r *Record) Phase() build.Phase {
+	if len(r.Phases) == 0 {
+		return ""
+	}
+	return r.Phases[len(r.Phases)-1].Phase
+}
+
+// Store keeps the build records.
+type Store interface {
+	Put(ctx context.Context, r *Record) error
+	// Create writes a record unless the build is already recorded, then it returns ErrExists.
+	Create(ctx context.Context, r *Record) error
+	Get(ctx context.Context, id string) (*Record, error)
+	// List returns the records matching f, most recently started first.
+	List(ctx context.Context, f Filter) ([]*Record, error)
+	// Claim claims a build key for a request, so only one request builds it at a time. It returns
+	// the ID of the request holding the claim, which is id when it is claimed. Claiming a key again
+	// renews the claim, a claim which was not renewed for ttl is stale and taken over.
+	Claim(ctx context.Context, key, id string, ttl time.Duration) (string, error)
+	// Unclaim drops the claim of a request on a key, if it still holds it.
+	Unclaim(ctx context.Context, key, id string) error
+}
+
+// Filter selects records. Empty fields match everything.
+type Filter struct {
+	// Name matches the records which name contains it.
+	Name string
+	// Istio matches the records built from an Istio version or minor version, e.g. 1.21.
+	Istio        string
+	OutputTarget string
+	Arch         string
+	FIPS         *bool
+	Status       queue.Status
+	// Limit is the maximum number of records returned, zero is no limit.
+	Limit int
+}
+
+// Match tells whether a record matches the filter.
+func (f Filter) Match(r *Record) bool {
+	if len(f.Name) > 0 && !strings.Contains(r.Name, f.Name) {
+		return false
+	}
+	if len(f.Istio) > 0 && !matchVersion(istioVersion(r), f.Istio) {
+		return false
+	}
+	if len(f.OutputTarget) > 0 && r.OutputTarget != f.OutputTarget {
+		return false
+	}
+	if len(f.Arch) > 0 && r.Arch != f.Arch {
+		return false
+	}
+	if f.FIPS != nil && (r.Flavors == nil || r.Flavors.FIPSBuild != *f.FIPS) {
+		return false
+	}
+	if len(f.Status) > 0 && r.Status != f.Status {
+		return false
+	}
+	return true
+}
+
+// istioVersion returns the Istio version a record was built from, e.g. 1.21.5.
+func istioVersion(r *Record) string {
+	if r.Coordinates != nil {
+		if len(r.Coordinates.Istio.Tag) > 0 {
+			return r.Coordinates.Istio.Tag
+		}
+		if _, version, ok := strings.Cut(r.Coordinates.Istio.Ref, "@"); ok {
+			return version
+		}
+	}
+	if _, version, ok := strings.Cut(r.Target, "@"); ok && strings.HasPrefix(r.Target, "istio@") {
+		return version
+	}
+	return ""
+}
+
+func matchVersion(version, want string) bool {
+	return version == want || strings.HasPrefix(version, want+".")
+}
+
+// Open returns the store of a URL, file://<dir> is the only supported one.
+func Open(rawURL string) (Store, error) {
+	dir, ok := strings.CutPrefix(rawURL, "file://")
+	if !ok || len(dir) == 0 {
+		return nil, fmt.Errorf("unsupported build store %q, expecting file://<dir>", rawURL)
+	}
+	return &Dir{Path: dir}, nil
+}
+
+// Dir keeps a JSON file per record in a directory.
+type Dir struct {
+	Path string
+}
+
+func (d *Dir) file(id string) string {
+	return filepath.Join(d.Path, id+".json")
+}
+
+// Put writes a record, through a temporary file so an interrupted write keeps the old one.
+func (d *Dir) Put(_ context.Context, r *Record) error {
+	tmp, err := d.writeTemp(r, ".tmp")
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.file(r.RequestID))
+}
+
+// Create links a temporary file to the record file, which fails when it exists.
+func (d *Dir) Create(_ context.Context, r *Record) error {
+	tmp, err := d.writeTemp(r, ".create.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, d.file(r.RequestID)); errors.Is(err, os.ErrExist) {
+		return ErrExists
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes a record to a temporary file next to its record file and returns its name.
+func (d *Dir) writeTemp(r *Record, suffix string) (string, error) {
+	if len(r.RequestID) == 0 || strings.ContainsAny(r.RequestID, `/\`) {
+		return "", fmt.Errorf("invalid build ID %q", r.RequestID)
+	}
+	if err := os.MkdirAll(d.Path, 0o755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp := d.file(r.RequestID) + suffix
+	return tmp, os.WriteFile(tmp, append(data, '\n'), 0o644)
+}
+
+// Get reads a record.
+func (d *Dir) Get(_ context.Context, id string) (*Record, error) {
+	if strings.ContainsAny(id, `/\`) {
+		return nil, ErrNotFound
+	}
+	return readRecord(d.file(id))
+}
+
+func readRecord(name string) (*Record, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid build record %s: %w", name, err)
+	}
+	return &r, nil
+}
+
+// List reads every record.
+func (d *Dir) List(_ context.Context, f Filter) ([]*Record, error) {
+	names, err := filepath.Glob(filepath.Join(d.Path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	for _, name := range names {
+		r, err := readRecord(name)
+		if err != nil {
+			return nil, err
+		}
+		if f.Match(r) {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[:f.Limit]
+	}
+	return records, nil
+}
+
+func (d *Dir) claim(key string) string {
+	return filepath.Join(d.Path, "claims", key)
+}
+
+// Claim links the claim file of a key, which fails when it exists. The file is written beforehand,
+// so the owner read from it is never partial. Its modification time is when it was last renewed.
+// Two requests taking over the same stale claim at once may both get it, claims are best effort.
+func (d *Dir) Claim(_ context.Context, key, id string, ttl time.Duration) (string, error) {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid build key %q", key)
+	}
+	if len(id) == 0 || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("invalid build ID %q", id)
+	}
+	name := d.claim(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return "", err
+	}
+	tmp := name + "." + id + ".tmp"
+	if err := os.WriteFile(tmp, []byte(id), 0o644); err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	for {
+		err := os.Link(tmp, name)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		owner, err := os.ReadFile(name)
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(name)
+		}
+		// Unclaimed in between, it is claimed again.
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if string(owner) == id {
+			now := time.Now()
+			return id, os.Chtimes(name, now, now)
+		}
+		if time.Since(info.ModTime()) > ttl {
+			if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			continue
+		}
+		return string(owner), nil
+	}
+}
+
+// Unclaim removes the claim file of a key.
+func (d *Dir) Unclaim(_ context.Context, key, id string) error {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) {
+		return fmt.Errorf("invalid build key %q", key)
+	}
+	owner, err := os.ReadFile(d.claim(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil || string(owner) != id {
+		return err
+	}
+	return os.Remove(d.claim(key))
+}
@@ -0,0 +1,215 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+)
+
+func TestRecordPhases(t *testing.T) {
+	start := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+	var r store.Record
+	r.Start(build.PhaseResolve, start)
+	r.Start(build.PhaseResolve, start.Add(time.Minute))
+	r.Start(build.PhaseFetch, start.Add(2*time.Minute))
+	r.Finish(start.Add(5 * time.Minute))
+
+	if len(r.Phases) != 2 {
+		t.Fatalf("phases = %+v, want resolve and fetch", r.Phases)
+	}
+	if got := r.Phases[0].FinishedAt.Sub(r.Phases[0].StartedAt); got != 2*time.Minute {
+		t.Errorf("resolve took %s, want 2m", got)
+	}
+	if got := r.Phases[1].FinishedAt.Sub(r.Phases[1].StartedAt); got != 3*time.Minute {
+		t.Errorf("fetch took %s, want 3m", got)
+	}
+	if r.Phase() != build.PhaseFetch || r.FinishedAt == nil {
+		t.Errorf("phase = %s, finished at %v", r.Phase(), r.FinishedAt)
+	}
+}
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	s := &store.Dir{Path: t.TempDir()}
+	start := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+	record := func(id, istio, arch string, fips bool, status queue.Status, age time.Duration) *store.Record {
+		return &store.Record{
+			BuildResult: queue.BuildResult{
+				RequestID:   id,
+				Name:        "istio-proxy-" + istio,
+				Target:      "istio@" + istio,
+				Status:      status,
+				StartedAt:   start.Add(-age),
+				Coordinates: &queue.BuildCoordinates{Istio: build.IstioCoordinates{Ref: "istio@" + istio}},
+			},
+			OutputTarget: "istio-proxy",
+			Arch:         arch,
+			Flavors:      &build.Flavors{FIPSBuild: fips},
+		}
+	}
+	records := []*store.Record{
+		record("1", "1.21.4", "arm64", true, queue.StatusSucceeded, 3*time.Hour),
+		record("2", "1.21.5", "arm64", true, queue.StatusFailed, time.Hour),
+		record("3", "1.21.5", "amd64", true, queue.StatusSucceeded, 2*time.Hour),
+		record("4", "1.210.0", "arm64", true, queue.StatusSucceeded, 0),
+		record("5", "1.22.0", "arm64", false, queue.StatusRunning, 0),
+	}
+	for _, r := range records {
+		if err := s.Put(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fips := true
+	tests := []struct {
+		name   string
+		filter store.Filter
+		want   []string
+	}{
+		{name: "all", want: []string{"4", "5", "2", "3", "1"}},
+		{name: "1.21 fips arm64", filter: store.Filter{Istio: "1.21", Arch: "arm64", FIPS: &fips}, want: []string{"2", "1"}},
+		{name: "last succeeded", filter: store.Filter{Istio: "1.21", Status: queue.StatusSucceeded, Limit: 1}, want: []string{"3"}},
+		{name: "patch version", filter: store.Filter{Istio: "1.21.5"}, want: []string{"2", "3"}},
+		{name: "name", filter: store.Filter{Name: "1.22"}, want: []string{"5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, r := range got {
+				ids = append(ids, r.RequestID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("List() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	got, err := s.Get(ctx, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != queue.StatusFailed || got.Arch != "arm64" || !got.Flavors.FIPSBuild {
+		t.Errorf("Get() = %+v", got)
+	}
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if err := s.Put(ctx, &store.Record{BuildResult: queue.BuildResult{RequestID: "../escape"}}); err == nil {
+		t.Error("Put() should reject an ID with a path separator")
+	}
+}
+
+func TestDirClaim(t *testing.T) {
+	ctx := context.Background()
+	s := &store.Dir{Path: t.TempDir()}
+	claim := func(id, want string) {
+		t.Helper()
+		owner, err := s.Claim(ctx, "key", id, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner != want {
+			t.Fatalf("Claim(%s) = %s, want %s", id, owner, want)
+		}
+	}
+	claim("1", "1")
+	claim("2", "1")
+	claim("1", "1")
+	// Only the owner drops the claim.
+	if err := s.Unclaim(ctx, "key", "2"); err != nil {
+		t.Fatal(err)
+	}
+	claim("2", "1")
+	if err := s.Unclaim(ctx, "key", "1"); err != nil {
+		t.Fatal(err)
+	}
+	claim("2", "2")
+	// Claiming again renews a claim, one which is not renewed is taken over.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(s.Path, "claims", "key"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	claim("2", "2")
+	if err := os.Chtimes(filepath.Join(s.Path, "claims", "key"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	claim("3", "3")
+	if _, err := s.Claim(ctx, "../key", "1", time.Hour); err == nil {
+		t.Error("Claim() should reject a key with a path separator")
+	}
+	// The claims are not records.
+	if records, err := s.List(ctx, store.Filter{}); err != nil || len(records) != 0 {
+		t.Errorf("List() = %v, %v, want nothing", records, err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	s := &store.Dir{Path: t.TempDir()}
+	result := &queue.BuildResult{RequestID: "1", Name: "istio-proxy"}
+	for attempt := 1; attempt <= 2; attempt++ {
+		rec := store.NewRecorder(ctx, s, result)
+		rec.Phase(build.PhaseResolve)
+		rec.Phase(build.PhaseResolve)
+		rec.Phase(build.PhaseFetch)
+		got, err := s.Get(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != queue.StatusRunning || got.Attempt != attempt || len(got.Phases) != 2 {
+			t.Fatalf("running record = %+v", got)
+		}
+		result.Status = queue.StatusSucceeded
+		rec.Finish()
+		if got, err = s.Get(ctx, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != queue.StatusSucceeded || got.FinishedAt == nil {
+			t.Fatalf("finished record = %+v", got)
+		}
+	}
+
+	// Without a store, nothing is recorded.
+	rec := store.NewRecorder(ctx, nil, result)
+	rec.Phase(build.PhaseCompile)
+	rec.Finish()
+}
+
+func TestDirCreate(t *testing.T) {
+	ctx := context.Background()
+	s := &store.Dir{Path: t.TempDir()}
+	queued := &store.Record{BuildResult: queue.BuildResult{RequestID: "1", Status: queue.StatusQueued}}
+	if err := s.Create(ctx, queued); err != nil {
+		t.Fatal(err)
+	}
+	running := &store.Record{BuildResult: queue.BuildResult{RequestID: "1", Status: queue.StatusRunning}}
+	if err := s.Put(ctx, running); err != nil {
+		t.Fatal(err)
+	}
+	// The record written in between is not overwritten.
+	if err := s.Create(ctx, queued); !errors.Is(err, store.ErrExists) {
+		t.Fatalf("Create() error = %v, want ErrExists", err)
+	}
+	got, err := s.Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != queue.StatusRunning {
+		t.Errorf("status = %s, want running", got.Status)
+	}
+	if records, err := s.List(ctx, store.Filter{}); err != nil || len(records) != 1 {
+		t.Errorf("List() = %v, %v, want one record", records, err)
+	}
+}
@@ -41,10 +41,12 @@ func GetLatestGoVersion(ctx context.Context) (string, error) {
 }
 
 func GetTarballAndExtract(ctx context.Context, repo, ref, dir string) (string, error) {
+	// The tarball is downloaded into tmp when it is not cached, it is not needed once extracted.
 	tmp, err := os.MkdirTemp(os.TempDir(), "leo.*")
 	if err != nil {
 		return "", err
 	}
+	defer os.RemoveAll(tmp)
 
 	targz, err := github.GetTarball(ctx, repo, ref, tmp)
 	if err != nil {
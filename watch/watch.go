@@ -0,0 +1,295 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/dio/leo/github"
+	"github.com/dio/leo/queue"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of a watch file. For example:
+//
+//	topic: builds
+//	state: leo-watch-state.json
+//	istio:
+//	  since: "1.22"
+//	  flavors:
+//	    - name: istio-proxy
+//	      target: istio-proxy
+//	    - name: istio-proxy-fips
+//	      target: istio-proxy
+//	      arguments: --fips-build
+//	envoy:
+//	  since: "1.30"
+//	  patchesOnly: true
+//	  flavors:
+//	    - name: envoy
+//	      target: envoy
+type Config struct {
+	// Topic is the Pub/Sub topic the build requests are published to.
+	Topic string `yaml:"topic"`
+	// State is the file recording the already requested builds, defaults to leo-watch-state.json.
+	State string  `yaml:"state"`
+	Istio *Source `yaml:"istio"`
+	Envoy *Source `yaml:"envoy"`
+}
+
+// Source is a repository to watch.
+type Source struct {
+	// Repo defaults to istio/istio and envoyproxy/envoy.
+	Repo string `yaml:"repo"`
+	// Since is the oldest minor version to build, e.g. 1.22. It is required, otherwise the first poll
+	// requests a build of every historical release.
+	Since string `yaml:"since"`
+	// PatchesOnly skips the x.y.0 releases. Envoy security fixes ship as patch releases.
+	PatchesOnly bool     `yaml:"patchesOnly"`
+	Flavors     []Flavor `yaml:"flavors"`
+}
+
+// Flavor is a build requested for every new release.
+type Flavor struct {
+	Name   string `yaml:"name"`
+	Target string `yaml:"target"`
+	// Arguments are passed to the build, e.g. --fips-build.
+	Arguments string `yaml:"arguments"`
+}
+
+// ReadConfig reads a watch file.
+func ReadConfig(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid watch file %s: %w", name, err)
+	}
+	if len(c.Topic) == 0 {
+		return nil, fmt.Errorf("invalid watch file %s: topic is required", name)
+	}
+	for _, source := range []struct {
+		name   string
+		source *Source
+	}{{"istio", c.Istio}, {"envoy", c.Envoy}} {
+		if source.source == nil {
+			continue
+		}
+		if len(source.source.Since) == 0 {
+			return nil, fmt.Errorf("invalid watch file %s: %s.since is required", name, source.name)
+		}
+		// The flavor name keys the state, flavors sharing one would be requested once.
+		names := make(map[string]bool, len(source.source.Flavors))
+		for i, flavor := range source.source.Flavors {
+			if len(flavor.Name) == 0 {
+				return nil, fmt.Errorf("invalid watch file %s: %s.flavors[%d].name is required", name, source.name, i)
+			}
+			if names[flavor.Name] {
+				return nil, fmt.Errorf("invalid watch file %s: duplicate %s flavor %s", name, source.name, flavor.Name)
+			}
+			names[flavor.Name] = true
+		}
+	}
+	if len(c.State) == 0 {
+		c.State = "leo-watch-state.json"
+	}
+	return &c, nil
+}
+
+// State records the requested builds, keyed by repo, version and flavor name.
+type State struct {
+	Requested map[string]bool `json:"requested"`
+}
+
+// ReadState reads a state file. A missing file is an empty state.
+func ReadState(name string) (*State, error) {
+	s := &State{Requested: make(map[string]bool)}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", name, err)
+	}
+	if s.Requested == nil {
+		s.Requested = make(map[string]bool)
+	}
+	return s, nil
+}
+
+// Write writes the state file, through a temporary file so an interrupted write keeps the old one.
+func (s *State) Write(name string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".tmp", append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func stateKey(repo, version, flavor string) string {
+	return repo + "@" + version + "/" + flavor
+}
+
+// Publisher sends a build request and returns its message ID.
+type Publisher func(ctx context.Context, topic string, msg []byte) (string, error)
+
+// Request is a published build request.
+type Request struct {
+	Key     string
+	ID      string
+	Message []byte
+}
+
+// Watcher publishes a build request for every flavor of every new release.
+type Watcher struct {
+	Config  *Config
+	Publish Publisher
+	// DryRun leaves the state file untouched.
+	DryRun bool
+}
+
+// Poll checks the watched repositories once. Every published request is recorded in the state file
+// right away, so a failure does not request the same build twice.
+func (w *Watcher) Poll(ctx context.Context) ([]Request, error) {
+	state, err := ReadState(w.Config.State)
+	if err != nil {
+		return nil, err
+	}
+
+	var published []Request
+	publish := func(key string, msg any) error {
+		if state.Requested[key] {
+			return nil
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		id, err := w.Publish(ctx, w.Config.Topic, data)
+		if err != nil {
+			return fmt.Errorf("failed to publish %s: %w", key, err)
+		}
+		published = append(published, Request{Key: key, ID: id, Message: data})
+		state.Requested[key] = true
+		if w.DryRun {
+			return nil
+		}
+		return state.Write(w.Config.State)
+	}
+
+	if source := w.Config.Istio; source != nil {
+		repo := repoOrDefault(source.Repo, "istio/istio")
+		tags, err := newReleases(ctx, repo, source)
+		if err != nil {
+			return published, err
+		}
+		for _, tag := range tags {
+			for _, flavor := range source.Flavors {
+				req, err := queue.InputsBuild{
+					Name:         flavor.Name,
+					Target:       flavor.Target,
+					IstioVersion: tag,
+					Arguments:    flavor.Arguments,
+				}.Upgrade()
+				if err != nil {
+					return published, fmt.Errorf("flavor %s: %w", flavor.Name, err)
+				}
+				if err := publish(stateKey(repo, tag, flavor.Name), req); err != nil {
+					return published, err
+				}
+			}
+		}
+	}
+
+	if source := w.Config.Envoy; source != nil {
+		repo := repoOrDefault(source.Repo, "envoyproxy/envoy")
+		tags, err := newReleases(ctx, repo, source)
+		if err != nil {
+			return published, err
+		}
+		for _, tag := range tags {
+			for _, flavor := range source.Flavors {
+				req, err := queue.InputsBuildEnvoy{
+					Name:      flavor.Name,
+					Target:    flavor.Target,
+					Envoy:     repo + "@" + tag,
+					Arguments: flavor.Arguments,
+				}.Upgrade()
+				if err != nil {
+					return published, fmt.Errorf("flavor %s: %w", flavor.Name, err)
+				}
+				if err := publish(stateKey(repo, tag, flavor.Name), req); err != nil {
+					return published, err
+				}
+			}
+		}
+	}
+	return published, nil
+}
+
+func repoOrDefault(repo, defaultRepo string) string {
+	if len(repo) == 0 {
+		return defaultRepo
+	}
+	return repo
+}
+
+// newReleases returns the stable release tags of repo since source.Since, oldest first.
+func newReleases(ctx context.Context, repo string, source *Source) ([]string, error) {
+	var since *semver.Version
+	if len(source.Since) > 0 {
+		var err error
+		if since, err = semver.NewVersion(source.Since); err != nil {
+			return nil, fmt.Errorf("invalid since %q: %w", source.Since, err)
+		}
+	}
+
+	releases, err := github.ListReleases(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	type tagged struct {
+		tag     string
+		version *semver.Version
+	}
+	var versions []tagged
+	for _, release := range releases {
+		if release.Draft || release.Prerelease {
+			continue
+		}
+		v, err := semver.NewVersion(release.TagName)
+		if err != nil || len(v.Prerelease()) > 0 {
+			continue
+		}
+		if since != nil && v.LessThan(since) {
+			continue
+		}
+		if source.PatchesOnly && v.Patch() == 0 {
+			continue
+		}
+		versions = append(versions, tagged{tag: release.TagName, version: v})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].version.LessThan(versions[j].version)
+	})
+	tags := make([]string, 0, len(versions))
+	for _, v := range versions {
+		tags = append(tags, v.tag)
+	}
+	return tags, nil
+}
@@ -0,0 +1,120 @@
+package watch_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dio/leo/github/githubtest"
+	"github.com/dio/leo/watch"
+)
+
+func TestPoll(t *testing.T) {
+	githubtest.Use(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/istio/istio/releases":
+			fmt.Fprint(w, `[{"tag_name":"1.22.3"},{"tag_name":"1.23.0-rc.1","prerelease":true},{"tag_name":"1.21.5"},{"tag_name":"1.22.2"}]`)
+		case "/repos/envoyproxy/envoy/releases":
+			fmt.Fprint(w, `[{"tag_name":"v1.30.4"},{"tag_name":"v1.31.0"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	config := &watch.Config{
+		Topic: "builds",
+		State: filepath.Join(t.TempDir(), "state.json"),
+		Istio: &watch.Source{
+			Since: "1.22",
+			Flavors: []watch.Flavor{
+				{Name: "istio-proxy", Target: "istio-proxy"},
+				{Name: "istio-proxy-fips", Target: "istio-proxy", Arguments: "--fips-build"},
+			},
+		},
+		Envoy: &watch.Source{
+			PatchesOnly: true,
+			Flavors:     []watch.Flavor{{Name: "envoy", Target: "envoy"}},
+		},
+	}
+
+	var messages []string
+	fail := 3
+	w := &watch.Watcher{Config: config, Publish: func(ctx context.Context, topic string, msg []byte) (string, error) {
+		if len(messages) == fail {
+			return "", errors.New("unavailable")
+		}
+		messages = append(messages, string(msg))
+		return fmt.Sprint(len(messages)), nil
+	}}
+
+	if _, err := w.Poll(context.Background()); err == nil {
+		t.Fatal("Poll() should fail when publishing fails")
+	}
+	fail = -1
+	requests, err := w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, r := range requests {
+		keys = append(keys, r.Key)
+	}
+	// The requests published before the failure are not published again.
+	if want := []string{"istio/istio@1.22.3/istio-proxy-fips", "envoyproxy/envoy@v1.30.4/envoy"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Poll() keys = %v, want %v", keys, want)
+	}
+	if want := `{"version":1,"name":"istio-proxy","target":"istio@1.22.2","output":{"target":"istio-proxy"}}`; messages[0] != want {
+		t.Fatalf("first message = %s, want %s", messages[0], want)
+	}
+
+	requests, err = w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("Poll() = %v, want nothing new", requests)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "valid", content: "topic: builds\nistio:\n  since: \"1.22\"\nenvoy:\n  since: \"1.30\"\n"},
+		{name: "missing topic", content: "istio:\n  since: \"1.22\"\n", err: "topic is required"},
+		{name: "missing istio since", content: "topic: builds\nistio:\n  flavors: []\n", err: "istio.since is required"},
+		{name: "missing envoy since", content: "topic: builds\nenvoy:\n  patchesOnly: true\n", err: "envoy.since is required"},
+		{name: "unnamed flavor", content: "topic: builds\nistio:\n  since: \"1.22\"\n  flavors:\n    - target: istio-proxy\n", err: "istio.flavors[0].name is required"},
+		{name: "duplicate flavor", content: "topic: builds\nenvoy:\n  since: \"1.30\"\n  flavors:\n    - {name: envoy, target: envoy}\n    - {name: envoy, target: envoy, arguments: --debug}\n", err: "duplicate envoy flavor envoy"},
+		{name: "unknown field", content: "topic: builds\nsince: \"1.22\"\n", err: "field since not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "leo-watch.yaml")
+			if err := os.WriteFile(name, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := watch.ReadConfig(name)
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if config.State != "leo-watch-state.json" {
+					t.Fatalf("state = %s, want the default", config.State)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("ReadConfig() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
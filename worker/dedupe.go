@@ -0,0 +1,204 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+	"github.com/dio/sh"
+)
+
+// Key returns the key of a build: its resolved sources, flavors, patches and release coordinates.
+// Requests with the same key, e.g. istio@1.22 and istio@1.22.3, produce the same artifacts.
+func Key(d *build.Description) string {
+	normalized := *d
+	// How the sources were requested does not matter, only what they resolved to.
+	normalized.Istio.Ref = ""
+	normalized.Istio.Tag = ""
+	normalized.Output = ""
+	data, _ := json.Marshal(&normalized)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// released tells whether the tarball of a build is already uploaded.
+func released(ctx context.Context, d *build.Description) (bool, error) {
+	var stderr bytes.Buffer
+	if _, err := sh.Exec(ctx, nil, io.Discard, &stderr, "gsutil", "-q", "stat", d.GCS); err != nil {
+		// gsutil stat exits with 1 for a missing object.
+		if sh.ExitStatus(err) == 1 && stderr.Len() == 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
+
+// flight is a build in progress. Duplicate requests wait for it and share its result.
+type flight struct {
+	id     string
+	done   chan struct{}
+	result *queue.BuildResult
+	err    error
+}
+
+type flights struct {
+	mu       sync.Mutex
+	inFlight map[string]*flight
+}
+
+// coalesce runs build once per key at a time. A request arriving while the same key is built
+// waits for it, and its result is copied from it.
+func (f *flights) coalesce(ctx context.Context, key string, result *queue.BuildResult, build func() error) error {
+	f.mu.Lock()
+	if current, ok := f.inFlight[key]; ok {
+		f.mu.Unlock()
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		result.CoalescedWith = current.id
+		result.Coordinates = current.result.Coordinates
+		result.Artifacts = current.result.Artifacts
+		return current.err
+	}
+	current := &flight{id: result.RequestID, done: make(chan struct{}), result: result}
+	if f.inFlight == nil {
+		f.inFlight = make(map[string]*flight)
+	}
+	f.inFlight[key] = current
+	f.mu.Unlock()
+
+	current.err = build()
+	f.mu.Lock()
+	delete(f.inFlight, key)
+	f.mu.Unlock()
+	close(current.done)
+	return current.err
+}
+
+// claim runs build once its key is claimed in the store, so duplicates received by other workers
+// are not built twice either. A request finding the key claimed waits for the claiming request to
+// finish and copies its result. The claim is renewed while building and dropped by unclaim, once
+// the record is finished. The claim of a request which finished without dropping it, or which
+// stopped renewing it, e.g. on a crash, is taken over.
+func (w *Worker) claim(ctx context.Context, key string, result *queue.BuildResult, build func() error) error {
+	if w.Store == nil {
+		return build()
+	}
+	waiting := ""
+	for {
+		owner, err := w.Store.Claim(ctx, key, result.RequestID, w.claimTTL())
+		if err != nil {
+			return &failed{queue.FailurePrepare, err}
+		}
+		claimed := owner == result.RequestID
+		if claimed {
+			if len(waiting) == 0 {
+				defer w.renew(ctx, key, result.RequestID)()
+				return build()
+			}
+			// Claimed once the awaited build is done, its record tells how it went.
+			owner = waiting
+		}
+
+		r, err := w.Store.Get(ctx, owner)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return &failed{queue.FailurePrepare, err}
+		}
+		switch {
+		case r != nil && r.FinishedAt != nil && owner == waiting:
+			result.CoalescedWith = owner
+			result.Coordinates = r.Coordinates
+			result.Artifacts = r.Artifacts
+			if r.Status == queue.StatusFailed {
+				return &failed{r.Failure, errors.New(r.Error)}
+			}
+			return nil
+		case claimed:
+			// The awaited build left no finished record, this request builds the key instead.
+			defer w.renew(ctx, key, result.RequestID)()
+			return build()
+		case r != nil && r.FinishedAt == nil:
+			waiting = owner
+		default:
+			// Finished before this request waited for it, or unknown: the claim is stale.
+			if err := w.Store.Unclaim(ctx, key, owner); err != nil {
+				return &failed{queue.FailurePrepare, err}
+			}
+			continue
+		}
+		select {
+		case <-time.After(w.claimInterval()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// renew renews the claim of a request on a key until the returned function is called. Once it
+// returns, the claim is not renewed anymore, so dropping it afterwards is final.
+func (w *Worker) renew(ctx context.Context, key, id string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(w.claimInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			owner, err := w.Store.Claim(ctx, key, id, w.claimTTL())
+			if err == nil && owner != id {
+				err = fmt.Errorf("claimed by %s", owner)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "request", id, "claim failed to be renewed:", err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// unclaim drops the claim a request may hold on its key.
+func (w *Worker) unclaim(ctx context.Context, result *queue.BuildResult) {
+	if w.Store == nil || len(result.Key) == 0 {
+		return
+	}
+	if err := w.Store.Unclaim(context.WithoutCancel(ctx), result.Key, result.RequestID); err != nil {
+		fmt.Fprintln(os.Stderr, "request", result.RequestID, "claim failed to be dropped:", err)
+	}
+}
+
+func (w *Worker) claimInterval() time.Duration {
+	if w.ClaimInterval == 0 {
+		return 30 * time.Second
+	}
+	return w.ClaimInterval
+}
+
+// claimTTL is how long a claim which is not renewed lasts, a few missed renewals are tolerated.
+func (w *Worker) claimTTL() time.Duration {
+	return 4 * w.claimInterval()
+}
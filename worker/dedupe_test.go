@@ -0,0 +1,206 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+)
+
+func TestKey(t *testing.T) {
+	description := func(ref, tag string, fips bool) *build.Description {
+		return &build.Description{
+			Istio:   build.IstioCoordinates{Ref: ref, Tag: tag, SHA: "e2c3d8f"},
+			Proxy:   build.SourceCoordinates{Repo: "istio/proxy", SHA: "a0b1c2d"},
+			Envoy:   build.EnvoyCoordinates{Repo: "envoyproxy/envoy", SHA: "f00ba47", Version: "1.30.4"},
+			Flavors: build.Flavors{FIPSBuild: fips},
+			Target:  "istio-proxy",
+			Arch:    "amd64",
+			Output:  "work/" + ref + "/proxy-a0b1c2d/out/*",
+		}
+	}
+	if Key(description("istio@1.22.3", "", false)) != Key(description("istio@1.22", "1.22.3", false)) {
+		t.Error("a shorthand and its tag should have the same key")
+	}
+	if Key(description("istio@1.22.3", "", false)) == Key(description("istio@1.22.3", "", true)) {
+		t.Error("flavors should have different keys")
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var f flights
+	var builds atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	buildErr := &failed{queue.FailureCompile, errors.New("make failed")}
+	build := func() error {
+		builds.Add(1)
+		once.Do(func() { close(started) })
+		<-release
+		return buildErr
+	}
+
+	first := &queue.BuildResult{RequestID: "1", Artifacts: &queue.BuildArtifacts{ReleaseTag: "istio/e2c3d8f"}}
+	var wg sync.WaitGroup
+	var firstErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		firstErr = f.coalesce(context.Background(), "key", first, build)
+	}()
+	<-started
+
+	duplicates := make([]*queue.BuildResult, 3)
+	errs := make([]error, len(duplicates))
+	for i := range duplicates {
+		duplicates[i] = &queue.BuildResult{RequestID: string(rune('2' + i))}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f.coalesce(context.Background(), "key", duplicates[i], build)
+		}(i)
+	}
+	// Let the duplicates find the build in flight.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := builds.Load(); n != 1 {
+		t.Fatalf("built %d times, want once", n)
+	}
+	if firstErr != buildErr {
+		t.Errorf("first error = %v, want %v", firstErr, buildErr)
+	}
+	for i, d := range duplicates {
+		if errs[i] != buildErr || d.CoalescedWith != "1" || d.Artifacts != first.Artifacts {
+			t.Errorf("duplicate %s: error %v, result %+v", d.RequestID, errs[i], d)
+		}
+	}
+
+	// Once done, the key is built again.
+	if err := f.coalesce(context.Background(), "key", &queue.BuildResult{RequestID: "5"}, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceCanceled(t *testing.T) {
+	var f flights
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	go func() {
+		_ = f.coalesce(context.Background(), "key", &queue.BuildResult{RequestID: "1"}, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.coalesce(ctx, "key", &queue.BuildResult{RequestID: "2"}, func() error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("coalesce() = %v, want context.Canceled", err)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	ctx := context.Background()
+	s := &store.Dir{Path: t.TempDir()}
+	w := &Worker{Store: s, ClaimInterval: 25 * time.Millisecond}
+	put := func(id string, finished bool) {
+		t.Helper()
+		r := &store.Record{BuildResult: queue.BuildResult{RequestID: id, Status: queue.StatusRunning}}
+		if finished {
+			now := time.Now()
+			r.Status = queue.StatusSucceeded
+			r.Artifacts = &queue.BuildArtifacts{ReleaseTag: "istio/e2c3d8f"}
+			r.FinishedAt = &now
+		}
+		if err := s.Put(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A duplicate waits for the build claimed by another worker and copies its result.
+	put("1", false)
+	if _, err := s.Claim(ctx, "key", "1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		put("1", true)
+		_ = s.Unclaim(ctx, "key", "1")
+	}()
+	duplicate := &queue.BuildResult{RequestID: "2"}
+	if err := w.claim(ctx, "key", duplicate, func() error {
+		t.Error("the duplicate should not be built")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if duplicate.CoalescedWith != "1" || duplicate.Artifacts == nil {
+		t.Errorf("duplicate = %+v", duplicate)
+	}
+	w.unclaim(ctx, &queue.BuildResult{RequestID: "2", Key: "key"})
+
+	// The claim of a finished request, or of an unknown one, is stale and taken over.
+	for _, owner := range []string{"1", "unknown"} {
+		if _, err := s.Claim(ctx, "key", owner, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		built := false
+		if err := w.claim(ctx, "key", &queue.BuildResult{RequestID: "3"}, func() error {
+			built = true
+			return nil
+		}); err != nil || !built {
+			t.Errorf("owner %s: built = %v, error = %v", owner, built, err)
+		}
+		w.unclaim(ctx, &queue.BuildResult{RequestID: "3", Key: "key"})
+	}
+
+	// The claim of a request which stopped renewing it, e.g. its worker crashed, is taken over.
+	put("4", false)
+	if _, err := s.Claim(ctx, "key", "4", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(s.Path, "claims", "key"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	built := false
+	if err := w.claim(ctx, "key", &queue.BuildResult{RequestID: "5"}, func() error {
+		built = true
+		return nil
+	}); err != nil || !built {
+		t.Errorf("abandoned claim: built = %v, error = %v", built, err)
+	}
+	w.unclaim(ctx, &queue.BuildResult{RequestID: "5", Key: "key"})
+
+	// The claim of a build is renewed while it runs.
+	if err := w.claim(ctx, "key", &queue.BuildResult{RequestID: "6"}, func() error {
+		if err := os.Chtimes(filepath.Join(s.Path, "claims", "key"), old, old); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		info, err := os.Stat(filepath.Join(s.Path, "claims", "key"))
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().After(old) {
+			t.Error("the claim was not renewed")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
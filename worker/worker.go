@@ -0,0 +1,299 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+	"github.com/dio/sh"
+)
+
+// Worker builds and releases the requests received from a queue subscription.
+type Worker struct {
+	// Queue defaults to queue.Default.
+	Queue        queue.Queue
+	Subscription string
+	// DeadLetterTopic, when set, receives the failed requests, which are then acked. Otherwise failed
+	// requests are nacked and redelivered, except the invalid ones, which would fail again.
+	DeadLetterTopic string
+	// ResultTopic, when set, receives a queue.BuildResult for every handled request.
+	ResultTopic string
+	// Concurrency is the number of requests built at once, defaults to 1.
+	Concurrency int
+	// MaxExtension is how long the lease of a request keeps being extended while it is built.
+	MaxExtension time.Duration
+	// DrainTimeout bounds how long the in-flight builds may take once the worker is stopped. Zero
+	// waits for them to finish.
+	DrainTimeout time.Duration
+	// WorkDir is the parent of the per-request work directories, defaults to "work".
+	WorkDir string
+	// Arch and Repo are the release output settings of the requests leaving them out, default to
+	// runtime.GOARCH and tetrateio/proxy-archives.
+	Arch string
+	Repo string
+
+	// Compile runs the make target in the prepared proxy directory. It defaults to "make" with
+	// BUILD_WITH_CONTAINER=1.
+	Compile func(ctx context.Context, dir, target string) error
+	// Released tells whether the artifacts of a build are already released, those requests are
+	// skipped. It defaults to checking the GCS tarball. Rebuild disables it.
+	Released func(ctx context.Context, d *build.Description) (bool, error)
+	Rebuild  bool
+	// Store, when set, keeps a record of every request. It also deduplicates the builds across
+	// workers: without it, only the duplicates received by this worker wait for the same build.
+	Store store.Store
+	// ClaimInterval is how often a duplicate checks the build it waits for in the store, and how
+	// often the claim of a build is renewed, defaults to 30 seconds. A claim not renewed for four
+	// intervals is abandoned, e.g. its worker crashed, and taken over.
+	ClaimInterval time.Duration
+
+	flights flights
+}
+
+func (w *Worker) queue() queue.Queue {
+	if w.Queue == nil {
+		return queue.Default
+	}
+	return w.Queue
+}
+
+// Start receives requests until ctx is done, then waits for the in-flight builds.
+func (w *Worker) Start(ctx context.Context) error {
+	buildCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if w.DrainTimeout <= 0 {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "draining, in-flight builds have", w.DrainTimeout, "to finish")
+		select {
+		case <-time.After(w.DrainTimeout):
+			cancel()
+		case <-buildCtx.Done():
+		}
+	}()
+
+	return w.queue().Receive(ctx, w.Subscription, queue.ReceiveOptions{
+		Concurrency:  w.Concurrency,
+		MaxExtension: w.MaxExtension,
+	}, func(_ context.Context, msg *queue.Message) {
+		// The receive context is done on SIGTERM, builds keep going with buildCtx.
+		result, err := w.Handle(buildCtx, msg.ID, msg.Data)
+		w.report(buildCtx, result)
+		w.settle(buildCtx, msg.ID, msg.Data, err, msg.Ack, msg.Nack)
+	})
+}
+
+// report publishes the result of a request to the results topic.
+func (w *Worker) report(ctx context.Context, result *queue.BuildResult) {
+	if len(w.ResultTopic) == 0 {
+		return
+	}
+	data, err := json.Marshal(result)
+	if err == nil {
+		_, err = w.queue().Publish(ctx, w.ResultTopic, data)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "request", result.RequestID, "result failed to be published:", err)
+	}
+}
+
+// settle acks a handled request, and nacks or dead-letters a failed one. Without a dead-letter topic,
+// an invalid request is acked, redelivering it would fail forever.
+func (w *Worker) settle(ctx context.Context, id string, data []byte, err error, ack, nack func()) {
+	if err == nil {
+		fmt.Fprintln(os.Stderr, "request", id, "done")
+		ack()
+		return
+	}
+	fmt.Fprintln(os.Stderr, "request", id, "failed:", err)
+	if len(w.DeadLetterTopic) == 0 {
+		if classify(err) == queue.FailureInvalidRequest {
+			fmt.Fprintln(os.Stderr, "request", id, "is invalid, dropped")
+			ack()
+			return
+		}
+		nack()
+		return
+	}
+	letter, _ := json.Marshal(&queue.DeadLetter{ID: id, Error: err.Error(), Data: string(data)})
+	if _, err := w.queue().Publish(ctx, w.DeadLetterTopic, letter); err != nil {
+		fmt.Fprintln(os.Stderr, "request", id, "failed to be dead-lettered:", err)
+		nack()
+		return
+	}
+	ack()
+}
+
+// failed is the error of a build step.
+type failed struct {
+	failure queue.Failure
+	err     error
+}
+
+func (e *failed) Error() string {
+	return e.err.Error()
+}
+
+func (e *failed) Unwrap() error {
+	return e.err
+}
+
+// classify returns the failure of an error returned by Handle.
+func classify(err error) queue.Failure {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return queue.FailureCanceled
+	}
+	var f *failed
+	if errors.As(err, &f) {
+		return f.failure
+	}
+	return queue.FailurePrepare
+}
+
+// Handle builds and releases a request. The returned result is never nil.
+func (w *Worker) Handle(ctx context.Context, id string, data []byte) (result *queue.BuildResult, err error) {
+	result = &queue.BuildResult{Version: queue.BuildResultVersion, RequestID: id, StartedAt: time.Now()}
+	rec := store.NewRecorder(ctx, w.Store, result)
+	// Deferred first, so the record is finished with the final status, and the claim of its key is
+	// dropped once the record is finished.
+	defer w.unclaim(ctx, result)
+	defer rec.Finish()
+	defer func() {
+		result.DurationSeconds = time.Since(result.StartedAt).Seconds()
+		result.Status = queue.StatusSucceeded
+		if err != nil {
+			result.Status = queue.StatusFailed
+			result.Failure = classify(err)
+			result.Error = err.Error()
+		}
+	}()
+
+	// Best effort, so the result of a malformed request still tells what it was.
+	_ = json.Unmarshal(data, &struct {
+		Name   *string `json:"name"`
+		Target *string `json:"target"`
+	}{&result.Name, &result.Target})
+
+	req, spec, err := w.spec(data)
+	if req != nil {
+		result.Name = req.Name
+		result.Target = req.Target
+	}
+	if err != nil {
+		return result, &failed{queue.FailureInvalidRequest, err}
+	}
+	builder, err := build.New(spec)
+	if err != nil {
+		return result, &failed{queue.FailureInvalidRequest, err}
+	}
+	rec.Update(func(r *store.Record) {
+		r.Request = req
+		r.OutputTarget = builder.Spec().Output.Target
+		r.Arch = builder.Spec().Output.Arch
+	})
+	builder.UsePhases(rec.Phase)
+
+	workDir := w.WorkDir
+	if len(workDir) == 0 {
+		workDir = "work"
+	}
+	workDir = filepath.Join(workDir, id)
+	builder.UseWorkDir(workDir)
+
+	// Normalize the request to what it resolves to, to find out whether it is a duplicate.
+	rec.Phase(build.PhaseResolve)
+	d, err := builder.Describe(ctx)
+	if err != nil {
+		return result, &failed{queue.FailurePrepare, err}
+	}
+	result.Key = Key(d)
+	result.Describe(d)
+	rec.Update(func(r *store.Record) {
+		r.Flavors = &d.Flavors
+	})
+	if !w.Rebuild {
+		isReleased := w.Released
+		if isReleased == nil {
+			isReleased = released
+		}
+		ok, err := isReleased(ctx, d)
+		if err != nil {
+			return result, &failed{queue.FailurePrepare, err}
+		}
+		if ok {
+			result.AlreadyReleased = true
+			result.Released(d)
+			return result, nil
+		}
+	}
+
+	return result, w.flights.coalesce(ctx, result.Key, result, func() error {
+		return w.claim(ctx, result.Key, result, func() error {
+			if err := w.build(ctx, builder, workDir, rec.Phase); err != nil {
+				return err
+			}
+			// Set before the duplicates waiting for this build copy it.
+			result.Released(d)
+			return nil
+		})
+	})
+}
+
+// build prepares, compiles and releases a build, then removes its work directory, however it ends.
+// A redelivered request prepares its sources again anyway.
+func (w *Worker) build(ctx context.Context, builder *build.ProxyBuilder, workDir string, phase func(build.Phase)) error {
+	// A leftover work directory is only worth a warning.
+	defer func() {
+		if err := os.RemoveAll(workDir); err != nil {
+			fmt.Fprintln(os.Stderr, "work directory", workDir, "failed to be removed:", err)
+		}
+	}()
+
+	dir, err := builder.Prepare(ctx)
+	if err != nil {
+		return &failed{queue.FailurePrepare, err}
+	}
+	c, err := build.ReadContext(filepath.Join(dir, build.ContextFileName))
+	if err != nil {
+		return &failed{queue.FailurePrepare, err}
+	}
+	builder.UseContext(c)
+
+	compile := w.Compile
+	if compile == nil {
+		compile = makeTarget
+	}
+	phase(build.PhaseCompile)
+	if err := compile(ctx, dir, builder.Spec().Output.Target); err != nil {
+		return &failed{queue.FailureCompile, err}
+	}
+
+	builder.Spec().Output.Dir = filepath.Join(dir, "out")
+	if err := builder.Release(ctx); err != nil {
+		return &failed{queue.FailureRelease, err}
+	}
+	return nil
+}
+
+func makeTarget(ctx context.Context, dir, target string) error {
+	return sh.RunWithV(ctx, map[string]string{"BUILD_WITH_CONTAINER": "1"}, "make", "-C", dir, target)
+}
+
+// spec decodes a request and returns its build spec.
+func (w *Worker) spec(data []byte) (*queue.BuildRequest, build.Spec, error) {
+	req, err := queue.DecodeBuildRequest(data)
+	if err != nil {
+		return nil, build.Spec{}, err
+	}
+	spec, err := req.Spec(queue.BuildOutput{Arch: w.Arch, Repo: w.Repo})
+	return req, spec, err
+}
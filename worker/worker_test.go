@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dio/leo/build"
+	"github.com/dio/leo/github/githubtest"
+	"github.com/dio/leo/queue"
+	"github.com/dio/leo/store"
+)
+
+func TestSpec(t *testing.T) {
+	w := &Worker{Arch: "arm64"}
+	tests := []struct {
+		name       string
+		data       string
+		wantTarget string
+		wantErr    bool
+	}{
+		{name: "istio", data: `{"version":1,"target":"istio@1.22.3"}`, wantTarget: "istio@1.22.3"},
+		{name: "unversioned istio", data: `{"istioVersion":"1.22.3","target":"istio-proxy"}`, wantTarget: "istio@1.22.3"},
+		{name: "unversioned envoy", data: `{"envoy":"envoyproxy/envoy@v1.30.4","target":"envoy"}`, wantTarget: "envoyproxy/envoy@v1.30.4"},
+		{name: "both", data: `{"istioVersion":"1.22.3","envoy":"envoyproxy/envoy@v1.30.4"}`, wantErr: true},
+		{name: "none", data: `{"target":"istio-proxy"}`, wantErr: true},
+		{name: "not json", data: `istio`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := w.spec([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expecting an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Target != tt.wantTarget || got.Output.Arch != "arm64" || got.Output.Repo != "tetrateio/proxy-archives" {
+				t.Errorf("unexpected spec %+v, output %+v", got, got.Output)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name           string
+		deadLetter     string
+		err            error
+		publishErr     error
+		wantAck        bool
+		wantDeadLetter bool
+	}{
+		{name: "done", wantAck: true},
+		{name: "failed", err: errors.New("boom")},
+		{name: "invalid", err: &failed{queue.FailureInvalidRequest, errors.New("boom")}, wantAck: true},
+		{name: "invalid dead-lettered", deadLetter: "dead", err: &failed{queue.FailureInvalidRequest, errors.New("boom")}, wantAck: true, wantDeadLetter: true},
+		{name: "dead-lettered", deadLetter: "dead", err: errors.New("boom"), wantAck: true, wantDeadLetter: true},
+		{name: "dead-letter failed", deadLetter: "dead", err: errors.New("boom"), publishErr: errors.New("down"), wantDeadLetter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var letters []queue.DeadLetter
+			w := &Worker{
+				DeadLetterTopic: tt.deadLetter,
+				Queue: publishFunc(func(_ context.Context, topic string, msg []byte) (string, error) {
+					if topic != tt.deadLetter {
+						t.Errorf("unexpected topic %q", topic)
+					}
+					var letter queue.DeadLetter
+					if err := json.Unmarshal(msg, &letter); err != nil {
+						t.Fatal(err)
+					}
+					letters = append(letters, letter)
+					return "1", tt.publishErr
+				}),
+			}
+			var acked, nacked bool
+			w.settle(context.Background(), "42", []byte(`{}`), tt.err, func() { acked = true }, func() { nacked = true })
+			if acked != tt.wantAck || nacked == tt.wantAck {
+				t.Errorf("acked %v, nacked %v, expecting ack %v", acked, nacked, tt.wantAck)
+			}
+			if (len(letters) > 0) != tt.wantDeadLetter {
+				t.Fatalf("dead letters %v, expecting one %v", letters, tt.wantDeadLetter)
+			}
+			if tt.wantDeadLetter && (letters[0].ID != "42" || letters[0].Error != "boom" || letters[0].Data != "{}") {
+				t.Errorf("unexpected dead letter %+v", letters[0])
+			}
+		})
+	}
+}
+
+type publishFunc func(ctx context.Context, topic string, data []byte) (string, error)
+
+func (f publishFunc) Publish(ctx context.Context, topic string, data []byte) (string, error) {
+	return f(ctx, topic, data)
+}
+
+func (f publishFunc) Receive(context.Context, string, queue.ReceiveOptions, func(context.Context, *queue.Message)) error {
+	return errors.New("not implemented")
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want queue.Failure
+	}{
+		{name: "step", err: &failed{queue.FailureCompile, errors.New("make: *** [build] Error 1")}, want: queue.FailureCompile},
+		{name: "canceled step", err: &failed{queue.FailureCompile, fmt.Errorf("make: %w", context.Canceled)}, want: queue.FailureCanceled},
+		{name: "other", err: errors.New("boom"), want: queue.FailurePrepare},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.err); got != tt.want {
+				t.Errorf("classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	q := &queue.Dir{Path: t.TempDir(), PollInterval: time.Millisecond}
+	id, err := q.Publish(context.Background(), "builds", []byte(`{"version":1,"name":"broken","target":"istio"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &store.Dir{Path: t.TempDir()}
+	w := &Worker{Queue: q, Store: s, Subscription: "builds", DeadLetterTopic: "dead", ResultTopic: "results", WorkDir: t.TempDir()}
+	done := make(chan error)
+	go func() { done <- w.Start(ctx) }()
+
+	var letter queue.DeadLetter
+	receiveOne(t, q, "dead", &letter)
+	if letter.ID != id || !strings.Contains(letter.Error, `invalid target "istio"`) {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	var result queue.BuildResult
+	receiveOne(t, q, "results", &result)
+	if result.RequestID != id || result.Name != "broken" || result.Status != queue.StatusFailed || result.Failure != queue.FailureInvalidRequest {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	record, err := s.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != queue.StatusFailed || record.Failure != queue.FailureInvalidRequest || record.Attempt != 1 || record.FinishedAt == nil {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveOne decodes the first message of a topic into v.
+func receiveOne(t *testing.T, q queue.Queue, topic string, v any) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var data []byte
+	_ = q.Receive(ctx, topic, queue.ReceiveOptions{}, func(_ context.Context, msg *queue.Message) {
+		msg.Ack()
+		data = msg.Data
+		cancel()
+	})
+	if data == nil {
+		t.Fatalf("no message published to %s", topic)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildRemovesWorkDir(t *testing.T) {
+	githubtest.Use(t, http.NotFoundHandler())
+	builder, err := build.New(build.Spec{Target: "istio@1.22.3", Output: &build.Output{Arch: "amd64", Repo: "tetrateio/proxy-archives"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := filepath.Join(t.TempDir(), "42")
+	if err := os.MkdirAll(filepath.Join(workDir, "proxy"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	builder.UseWorkDir(workDir)
+
+	w := &Worker{}
+	err = w.build(context.Background(), builder, workDir, func(build.Phase) {})
+	if classify(err) != queue.FailurePrepare {
+		t.Fatalf("build() error = %v, want a prepare failure", err)
+	}
+	if _, err := os.Stat(workDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("work directory left behind after a failure: %v", err)
+	}
+}